@@ -0,0 +1,202 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"strings"
+	"sync/atomic"
+)
+
+var (
+	ready    atomic.Bool // Listener is bound and accepting connections
+	draining atomic.Bool // Graceful shutdown in progress
+)
+
+// adminTLSConfig builds the TLS config for the admin and expvar servers from
+// a certificate, key and optional client CA bundle. It returns nil when no
+// certificate is given. With a client CA, clients must present a certificate
+// signed by it.
+func adminTLSConfig(certFile, keyFile, clientCAFile string) (*tls.Config, error) {
+	if certFile == "" && keyFile == "" {
+		if clientCAFile != "" {
+			return nil, fmt.Errorf("-admin-client-ca requires -admin-tls-cert and -admin-tls-key")
+		}
+		return nil, nil
+	}
+	if certFile == "" || keyFile == "" {
+		return nil, fmt.Errorf("-admin-tls-cert and -admin-tls-key must be given together")
+	}
+
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load admin certificate: %v", err)
+	}
+	cfg := &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+
+	if clientCAFile != "" {
+		pem, err := os.ReadFile(clientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read admin client CA: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in admin client CA '%s'", clientCAFile)
+		}
+		cfg.ClientCAs = pool
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return cfg, nil
+}
+
+// listenAdmin binds addr for an operational HTTP server, wrapping it in TLS
+// when tlsCfg is set. Plain HTTP on a non-loopback address is warned about,
+// since these servers can change routing.
+func listenAdmin(name, addr string, tlsCfg *tls.Config) (net.Listener, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to start %s server: %v", name, err)
+	}
+	if tlsCfg != nil {
+		return tls.NewListener(l, tlsCfg), nil
+	}
+	if ap, err := netip.ParseAddrPort(l.Addr().String()); err != nil || !ap.Addr().IsLoopback() {
+		log.Printf("Warning: %s server on %s is reachable beyond localhost over plain HTTP; bind it to 127.0.0.1 or set -admin-tls-cert", name, addr)
+	}
+	return l, nil
+}
+
+// startAdmin binds the admin HTTP server exposing health probes, metrics and
+// route management, and serves it in the background
+func startAdmin(addr string, s *server, tlsCfg *tls.Config) error {
+	l, err := listenAdmin("admin", addr, tlsCfg)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Starting admin server on %s", addr)
+	go func() {
+		if err := http.Serve(l, s.adminHandler()); err != nil {
+			log.Fatalf("Admin server failed: %v", err)
+		}
+	}()
+	return nil
+}
+
+// adminHandler routes the admin server's endpoints
+func (s *server) adminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/livez", handleLivez)
+	mux.HandleFunc("/readyz", handleReadyz)
+	mux.HandleFunc("/metrics", handleMetrics)
+	mux.HandleFunc("GET /routes", s.handleListRoutes)
+	mux.HandleFunc("POST /routes", s.handleAddRoute)
+	mux.HandleFunc("DELETE /routes/{host}", s.handleRemoveRoute)
+	mux.HandleFunc("POST /reload", s.handleReload)
+	mux.HandleFunc("GET /connections", s.handleConnections)
+	return mux
+}
+
+// handleLivez reports that the process is up
+func handleLivez(w http.ResponseWriter, r *http.Request) {
+	io.WriteString(w, "ok\n")
+}
+
+// handleReadyz reports whether the proxy should receive new connections
+func handleReadyz(w http.ResponseWriter, r *http.Request) {
+	if !ready.Load() || draining.Load() {
+		http.Error(w, "not ready", http.StatusServiceUnavailable)
+		return
+	}
+	io.WriteString(w, "ok\n")
+}
+
+// handleListRoutes returns the active routes as JSON
+func (s *server) handleListRoutes(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.routes.Load().Routes())
+}
+
+// handleAddRoute adds a single route given in -route syntax as the request body.
+// Runtime changes are not persisted and are lost on restart.
+func (s *server) handleAddRoute(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, 64<<10))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	cfg, err := parseRoute(strings.TrimSpace(string(body)))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	s.routesMu.Lock()
+	next, err := s.routes.Load().withRoute(cfg)
+	if err == nil {
+		s.routes.Store(next)
+	}
+	s.routesMu.Unlock()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	log.Printf("Added route for %s via admin API", cfg.Host)
+	writeJSON(w, http.StatusCreated, cfg)
+}
+
+// handleRemoveRoute removes the route for a single host, written as in
+// -route. The host is put in the form its route is stored under, which only
+// normalizes plain hostnames: patterns and hash salts keep their case.
+func (s *server) handleRemoveRoute(w http.ResponseWriter, r *http.Request) {
+	cfg, err := parseRouteHost(r.PathValue("host"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	host := cfg.Host
+
+	s.routesMu.Lock()
+	next, ok := s.routes.Load().withoutRoute(host)
+	if ok {
+		s.routes.Store(next)
+	}
+	s.routesMu.Unlock()
+	if !ok {
+		http.Error(w, "no route for host: "+host, http.StatusNotFound)
+		return
+	}
+
+	log.Printf("Removed route for %s via admin API", host)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleReload re-reads -config and swaps in its routes, reporting the new
+// route count, or the error with the running routes left as they were
+func (s *server) handleReload(w http.ResponseWriter, r *http.Request) {
+	rm, err := s.reload()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	log.Printf("Reloaded %d routes from %s via admin API", rm.len(), configPath)
+	writeJSON(w, http.StatusOK, map[string]int{"routes": rm.len()})
+}
+
+// handleConnections lists the connections currently relaying to a backend
+func (s *server) handleConnections(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.live.Snapshot())
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// serveAdmin sends a request to srv's admin handler and returns the response
+func serveAdmin(srv *server, method, path, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	rec := httptest.NewRecorder()
+	srv.adminHandler().ServeHTTP(rec, req)
+	return rec
+}
+
+func TestAdminProbes(t *testing.T) {
+	defer func(r, d bool) { ready.Store(r); draining.Store(d) }(ready.Load(), draining.Load())
+	srv := newTestServer(t)
+	tests := []struct {
+		name            string
+		ready, draining bool
+		readyz          int
+	}{
+		{"starting", false, false, http.StatusServiceUnavailable},
+		{"accepting", true, false, http.StatusOK},
+		{"draining", true, true, http.StatusServiceUnavailable},
+	}
+	for _, tt := range tests {
+		ready.Store(tt.ready)
+		draining.Store(tt.draining)
+		if rec := serveAdmin(srv, http.MethodGet, "/livez", ""); rec.Code != http.StatusOK {
+			t.Errorf("%s: /livez = %d, want 200", tt.name, rec.Code)
+		}
+		if rec := serveAdmin(srv, http.MethodGet, "/readyz", ""); rec.Code != tt.readyz {
+			t.Errorf("%s: /readyz = %d, want %d", tt.name, rec.Code, tt.readyz)
+		}
+	}
+}
+
+func TestAdminRemoveRouteKeepsCase(t *testing.T) {
+	hashed := hashHost("SaLt", "secret.example.com")
+	for _, host := range []string{
+		`~^\S+\.Foo$`,
+		hashed,
+		"Example.COM.",
+	} {
+		srv := newTestServer(t, `~^\S+\.Foo$=:8080`, hashed+"=:8081", "example.com=:8082")
+		req := httptest.NewRequest(http.MethodDelete, "/routes/"+url.PathEscape(host), nil)
+		rec := httptest.NewRecorder()
+		srv.adminHandler().ServeHTTP(rec, req)
+		if rec.Code != http.StatusNoContent {
+			t.Errorf("DELETE /routes/%s = %d %s, want 204", host, rec.Code, rec.Body)
+		}
+		if n := srv.routes.Load().len(); n != 2 {
+			t.Errorf("after removing %s, %d routes remain, want 2", host, n)
+		}
+	}
+}
+
+func TestAdminAddAndRemoveRoute(t *testing.T) {
+	srv := newTestServer(t, "example.com=:8080")
+
+	if rec := serveAdmin(srv, http.MethodPost, "/routes", "api.example.com=:9090\n"); rec.Code != http.StatusCreated {
+		t.Fatalf("POST /routes = %d %s, want 201", rec.Code, rec.Body)
+	}
+	if cfg, ok := srv.routes.Load().Lookup("api.example.com"); !ok || cfg.Target != "localhost:9090" {
+		t.Errorf("Lookup after adding = %v, %v; want the added route", cfg, ok)
+	}
+	if rec := serveAdmin(srv, http.MethodPost, "/routes", "api.example.com=:9091"); rec.Code != http.StatusConflict {
+		t.Errorf("POST /routes for an existing host = %d, want 409", rec.Code)
+	}
+	if rec := serveAdmin(srv, http.MethodPost, "/routes", "api.example.com=:9091,lgo=off"); rec.Code != http.StatusBadRequest {
+		t.Errorf("POST /routes with an invalid route = %d, want 400", rec.Code)
+	}
+
+	if rec := serveAdmin(srv, http.MethodDelete, "/routes/api.example.com", ""); rec.Code != http.StatusNoContent {
+		t.Fatalf("DELETE /routes/api.example.com = %d %s, want 204", rec.Code, rec.Body)
+	}
+	if cfg, ok := srv.routes.Load().Lookup("api.example.com"); ok {
+		t.Errorf("Lookup after removing = %v, want no route", cfg)
+	}
+	if _, ok := srv.routes.Load().Lookup("example.com"); !ok {
+		t.Error("removing one route dropped another")
+	}
+	if rec := serveAdmin(srv, http.MethodDelete, "/routes/api.example.com", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("DELETE of a missing route = %d, want 404", rec.Code)
+	}
+}
+
+func TestAdminReload(t *testing.T) {
+	defer func(p string) { configPath = p }(configPath)
+	configPath = filepath.Join(t.TempDir(), "proxys.json")
+	writeConfig := func(data string) {
+		if err := os.WriteFile(configPath, []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	srv := newTestServer(t, "example.com=:8080")
+	srv.flagRoutes = []string{"example.com=:8080"}
+
+	writeConfig(`{"routes": ["a.example.com=:8081", "b.example.com=:8082"]}`)
+	rec := serveAdmin(srv, http.MethodPost, "/reload", "")
+	if rec.Code != http.StatusOK || strings.TrimSpace(rec.Body.String()) != `{"routes":3}` {
+		t.Fatalf("POST /reload = %d %s, want 200 with 3 routes", rec.Code, rec.Body)
+	}
+	if _, ok := srv.routes.Load().Lookup("b.example.com"); !ok {
+		t.Error("route from the changed config not picked up")
+	}
+
+	writeConfig(`{"routes": ["c.example.com=:8083", "bad.example.com=:8084,lgo=off"]}`)
+	if rec := serveAdmin(srv, http.MethodPost, "/reload", ""); rec.Code != http.StatusBadRequest {
+		t.Errorf("POST /reload of a bad config = %d, want 400", rec.Code)
+	}
+	rm := srv.routes.Load()
+	if _, ok := rm.Lookup("c.example.com"); ok || rm.len() != 3 {
+		t.Errorf("a bad config changed the running routes to %v", rm.Routes())
+	}
+}
+
+// testCert is a certificate and key issued by a test CA, or self-signed
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	der  []byte
+}
+
+// issueCert returns a certificate for name signed by ca, or a self-signed CA
+// certificate when ca is nil
+func issueCert(t *testing.T, name string, ca *testCert) *testCert {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.IPv6loopback, net.IPv4(127, 0, 0, 1)},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	parent, signer := tmpl, key
+	if ca == nil {
+		tmpl.IsCA, tmpl.BasicConstraintsValid = true, true
+		tmpl.KeyUsage = x509.KeyUsageCertSign
+	} else {
+		parent, signer = ca.cert, ca.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCert{cert: cert, key: key, der: der}
+}
+
+// writePEM writes c's certificate and key as PEM files in dir and returns
+// their paths
+func (c *testCert) writePEM(t *testing.T, dir, name string) (certFile, keyFile string) {
+	t.Helper()
+	keyDER, err := x509.MarshalECPrivateKey(c.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile = filepath.Join(dir, name+".crt"), filepath.Join(dir, name+".key")
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.der}), 0o644)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600)
+	return certFile, keyFile
+}
+
+func (c *testCert) tlsCertificate() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{c.der}, PrivateKey: c.key}
+}
+
+func TestAdminRequiresClientCertificate(t *testing.T) {
+	dir := t.TempDir()
+	ca := issueCert(t, "admin CA", nil)
+	caFile, _ := ca.writePEM(t, dir, "ca")
+	certFile, keyFile := issueCert(t, "admin", ca).writePEM(t, dir, "admin")
+	tlsCfg, err := adminTLSConfig(certFile, keyFile, caFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := listenAdmin("admin", "127.0.0.1:0", tlsCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go http.Serve(l, newTestServer(t).adminHandler())
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	tests := []struct {
+		name   string
+		certs  []tls.Certificate
+		wantOK bool
+	}{
+		{"no client certificate", nil, false},
+		{"certificate from another CA", []tls.Certificate{issueCert(t, "rogue", issueCert(t, "rogue CA", nil)).tlsCertificate()}, false},
+		{"certificate from the client CA", []tls.Certificate{issueCert(t, "operator", ca).tlsCertificate()}, true},
+	}
+	for _, tt := range tests {
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots, Certificates: tt.certs}}}
+		resp, err := client.Get("https://" + l.Addr().String() + "/livez")
+		if err == nil {
+			resp.Body.Close()
+		}
+		if ok := err == nil && resp.StatusCode == http.StatusOK; ok != tt.wantOK {
+			t.Errorf("%s: GET /livez succeeded = %v (err %v), want %v", tt.name, ok, err, tt.wantOK)
+		}
+		client.CloseIdleConnections()
+	}
+
+	if _, err := adminTLSConfig("", "", caFile); err == nil {
+		t.Error("-admin-client-ca without a certificate was accepted")
+	}
+}
+
+func TestConnectionsShowLiveByteCounts(t *testing.T) {
+	defer func(v bool) { liveStats = v }(liveStats)
+	liveStats = true
+	hello := helloFor(t, "example.com")
+	// An echo backend, so bytes flow both ways
+	backend := startBackend(t, func(c net.Conn) {
+		defer c.Close()
+		io.Copy(c, c)
+	})
+	srv := newTestServer(t, "example.com="+backend)
+	addr := serveTest(t, srv)
+
+	listed := func() []liveConnStatus {
+		var conns []liveConnStatus
+		rec := serveAdmin(srv, http.MethodGet, "/connections", "")
+		if err := json.Unmarshal(rec.Body.Bytes(), &conns); err != nil {
+			t.Fatalf("/connections is not valid JSON: %v", err)
+		}
+		return conns
+	}
+	conn := dialHello(t, addr, hello)
+	echoed := make([]byte, len(hello))
+	io.ReadFull(conn, echoed)
+
+	last := int64(len(hello))
+	for i := 1; i <= 3; i++ {
+		chunk := strings.Repeat("x", 1000*i)
+		io.WriteString(conn, chunk)
+		io.ReadFull(conn, make([]byte, len(chunk)))
+		want := last + int64(len(chunk))
+		if !waitFor(2*time.Second, func() bool {
+			conns := listed()
+			return len(conns) == 1 && conns[0].BytesUpstream == want && conns[0].BytesDownstream == want
+		}) {
+			t.Fatalf("after %d writes /connections = %+v, want %d bytes each way", i, listed(), want)
+		}
+		last = want
+	}
+	if c := listed()[0]; c.SNI != "example.com" || c.Backend != backend || c.ClientIP != "127.0.0.1" {
+		t.Errorf("/connections lists %+v, want example.com from 127.0.0.1 to %s", c, backend)
+	}
+
+	conn.Close()
+	waitIdle(t) // Before liveStats is restored
+	if conns := listed(); len(conns) != 0 {
+		t.Errorf("/connections still lists %+v after the connection closed", conns)
+	}
+}
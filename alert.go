@@ -0,0 +1,44 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"maps"
+	"slices"
+	"strings"
+)
+
+// tlsAlerts are the alert descriptions a maintenance route can answer with
+var tlsAlerts = map[string]byte{
+	"handshake_failure": 40,
+	"access_denied":     49,
+	"internal_error":    80,
+	"user_canceled":     90,
+	"unrecognized_name": 112,
+}
+
+// defaultMaintenanceAlert is sent by routes given maintenance=true
+const defaultMaintenanceAlert = "internal_error"
+
+// parseMaintenance parses the value of the maintenance route option into the
+// name of the alert to send, or "" for maintenance=false
+func parseMaintenance(value string) (string, error) {
+	switch value {
+	case "", "true":
+		return defaultMaintenanceAlert, nil
+	case "false":
+		return "", nil
+	}
+	if _, ok := tlsAlerts[value]; !ok {
+		names := slices.Sorted(maps.Keys(tlsAlerts))
+		return "", fmt.Errorf("invalid maintenance option '%s' (use true, false or an alert: %s)", value, strings.Join(names, ", "))
+	}
+	return value, nil
+}
+
+// writeAlert sends a fatal TLS alert record. It goes out before any server
+// hello, so it uses the TLS 1.2 record version that every client accepts.
+func writeAlert(w io.Writer, name string) error {
+	_, err := w.Write([]byte{recordTypeAlert, 3, 3, 0, 2, 2, tlsAlerts[name]})
+	return err
+}
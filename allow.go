@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+)
+
+// allowedTargets restricts the backends proxys may dial, set by -allow-target
+// (nil allows any backend)
+var allowedTargets *targetAllowlist
+
+// targetAllowlist holds the backend hosts proxys may dial. IP literals match
+// CIDR and IP entries; hostnames match hostname entries by name, since the
+// address they resolve to is only known when dialing.
+type targetAllowlist struct {
+	prefixes []netip.Prefix
+	hosts    map[string]bool
+}
+
+// parseTargetAllowlist parses comma-separated CIDRs, IPs and hostnames
+func parseTargetAllowlist(specs []string) (*targetAllowlist, error) {
+	a := &targetAllowlist{hosts: make(map[string]bool)}
+	for _, spec := range specs {
+		for _, entry := range strings.Split(spec, ",") {
+			entry = strings.TrimSpace(entry)
+			if entry == "" {
+				continue
+			}
+			if prefix, err := netip.ParsePrefix(entry); err == nil {
+				a.prefixes = append(a.prefixes, prefix.Masked())
+				continue
+			}
+			if ip, err := netip.ParseAddr(entry); err == nil {
+				a.prefixes = append(a.prefixes, netip.PrefixFrom(ip, ip.BitLen()))
+				continue
+			}
+			if strings.ContainsAny(entry, ":/") {
+				return nil, fmt.Errorf("invalid allowed target '%s' (use a CIDR, IP or hostname)", entry)
+			}
+			a.hosts[normalizeHost(entry)] = true
+		}
+	}
+	return a, nil
+}
+
+// Allows reports whether the backend address target (host:port) may be dialed
+func (a *targetAllowlist) Allows(target string) bool {
+	if a == nil {
+		return true
+	}
+	host, _, err := net.SplitHostPort(target)
+	if err != nil {
+		return false
+	}
+	if ip, err := netip.ParseAddr(host); err == nil {
+		ip = ip.Unmap()
+		for _, p := range a.prefixes {
+			if p.Contains(ip) {
+				return true
+			}
+		}
+		return false
+	}
+	return a.hosts[normalizeHost(host)]
+}
+
+// checkRouteTargets verifies that the backends of cfg known at parse time
+// are allowed. Backends computed per connection are checked before dialing.
+func checkRouteTargets(cfg *RouteConfig) error {
+	if allowedTargets == nil || cfg.Pattern != nil {
+		return nil
+	}
+	var targets []string
+	switch {
+	case cfg.Reject:
+		return nil
+	case cfg.Upstream != "":
+		return nil // Pool members are checked when the pool is defined
+	case cfg.Passthrough:
+		if transparent || !cfg.exactHost() {
+			return nil
+		}
+		targets = []string{net.JoinHostPort(cfg.Host, cfg.passthroughPort())}
+	default:
+		targets = append([]string{cfg.Target}, cfg.Fallbacks...)
+	}
+	for _, t := range targets {
+		if !allowedTargets.Allows(t) {
+			return fmt.Errorf("target '%s' for %s is not allowed by -allow-target", t, cfg.Host)
+		}
+	}
+	return nil
+}
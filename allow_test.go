@@ -0,0 +1,74 @@
+package main
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// useAllowedTargets sets -allow-target for the rest of the test
+func useAllowedTargets(t *testing.T, specs ...string) {
+	t.Helper()
+	a, err := parseTargetAllowlist(specs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	prev := allowedTargets
+	allowedTargets = a
+	t.Cleanup(func() {
+		waitIdle(t)
+		allowedTargets = prev
+	})
+}
+
+func TestAllowTargetStaticRoutes(t *testing.T) {
+	useAllowedTargets(t, "127.0.0.0/8,::1", "backend.internal")
+	tests := []struct {
+		route   string
+		allowed bool
+	}{
+		{"a.example.com=127.0.0.1:8443", true},
+		{"a.example.com=[::1]:8443", true},
+		{"a.example.com=Backend.Internal:8443", true},
+		{"a.example.com=10.0.0.1:443", false},
+		{"a.example.com=other.internal:443", false},
+		{"a.example.com=127.0.0.1:8443|10.0.0.1:443", false},
+		{"a.example.com", false}, // Passthrough dials a.example.com:443
+		{"backend.internal", true},
+		{"a.example.com=reject", true},
+	}
+	for _, tt := range tests {
+		_, err := parseRoute(tt.route)
+		if allowed := err == nil; allowed != tt.allowed {
+			t.Errorf("parseRoute(%s): %v, want allowed %v", tt.route, err, tt.allowed)
+		}
+	}
+
+	if _, err := parseTargetAllowlist([]string{"10.0.0.0/33"}); err == nil {
+		t.Error("an invalid CIDR was accepted")
+	}
+}
+
+func TestAllowTargetComputedBackends(t *testing.T) {
+	useAllowedTargets(t, "127.0.0.0/8")
+	hello1 := helloFor(t, "1.example.com")
+	_, port, _ := net.SplitHostPort(startAnswerBackend(t, len(hello1), "ok"))
+	// The first label picks the backend's last octet
+	addr := serveTest(t, newTestServer(t, `~^(\d+)\.example\.com$=127.0.0.$1:`+port, `~^(\w+)\.example\.org$=$1.internal:443`))
+
+	conn := dialHello(t, addr, hello1)
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if got, err := io.ReadAll(conn); string(got) != "ok" {
+		t.Errorf("allowed computed backend: read %q, %v; want the backend's answer", got, err)
+	}
+
+	before := connsRejected.with(rejectPolicy, "target_denied").Load()
+	conn = dialHello(t, addr, helloFor(t, "db.example.org"))
+	if !waitClosed(conn, 2*time.Second) {
+		t.Fatal("connection to a disallowed computed backend was not closed")
+	}
+	if got := connsRejected.with(rejectPolicy, "target_denied").Load() - before; got != 1 {
+		t.Errorf("target_denied rejections rose by %d, want 1", got)
+	}
+}
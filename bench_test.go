@@ -0,0 +1,124 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"testing"
+)
+
+// Workload overrides for BenchmarkProxy, e.g.
+// go test -run '^$' -bench Proxy -streams 64 -stream-bytes 4194304
+var (
+	benchStreams     = flag.Int("streams", 0, "BenchmarkProxy: concurrent streams per operation (0 runs the default matrix)")
+	benchStreamBytes = flag.Int("stream-bytes", 0, "BenchmarkProxy: bytes each stream sends and gets echoed back (0 runs the default matrix)")
+)
+
+// startEchoBackend runs a stub backend that consumes a ClientHello of
+// helloLen bytes, then echoes everything back
+func startEchoBackend(b *testing.B, helloLen int) string {
+	return startBackend(b, func(c net.Conn) {
+		defer c.Close()
+		if _, err := io.ReadFull(c, make([]byte, helloLen)); err != nil {
+			return
+		}
+		io.Copy(c, c)
+	})
+}
+
+// BenchmarkProxy drives concurrent streams through a loopback proxy to an
+// echo backend. Each operation opens every stream, sends its ClientHello and
+// payload and reads the payload back, so MB/s counts both directions and
+// includes connection setup.
+func BenchmarkProxy(b *testing.B) {
+	log.SetOutput(io.Discard)
+	b.Cleanup(func() { log.SetOutput(logOutput) })
+
+	type workload struct{ streams, size int }
+	workloads := []workload{{1, 64 << 10}, {1, 4 << 20}, {16, 64 << 10}, {16, 1 << 20}}
+	if *benchStreams > 0 || *benchStreamBytes > 0 {
+		w := workload{streams: 1, size: 64 << 10}
+		if *benchStreams > 0 {
+			w.streams = *benchStreams
+		}
+		if *benchStreamBytes > 0 {
+			w.size = *benchStreamBytes
+		}
+		workloads = []workload{w}
+	}
+
+	for _, scenario := range []string{"routed", "passthrough"} {
+		for _, w := range workloads {
+			b.Run(fmt.Sprintf("%s/streams=%d/bytes=%d", scenario, w.streams, w.size), func(b *testing.B) {
+				benchmarkProxy(b, scenario, w.streams, w.size)
+			})
+		}
+	}
+}
+
+func benchmarkProxy(b *testing.B, scenario string, streams, size int) {
+	// Passthrough dials the SNI itself, so route localhost to the backend's
+	// port
+	sni := "example.com"
+	if scenario == "passthrough" {
+		sni = "localhost"
+	}
+	hello := helloFor(b, sni)
+	backend := startEchoBackend(b, len(hello))
+	route := "example.com=" + backend
+	if scenario == "passthrough" {
+		_, port, _ := net.SplitHostPort(backend)
+		route = "localhost,passthroughport=" + port
+	}
+	addr := serveTest(b, newTestServer(b, route))
+
+	payload := make([]byte, size)
+	b.SetBytes(int64(2 * streams * size))
+	b.ReportAllocs()
+	for b.Loop() {
+		var wg sync.WaitGroup
+		errs := make(chan error, streams)
+		for range streams {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				errs <- proxyStream(addr, hello, payload)
+			}()
+		}
+		wg.Wait()
+		close(errs)
+		for err := range errs {
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+// proxyStream sends hello and payload through the proxy at addr and reads
+// the payload back
+func proxyStream(addr string, hello, payload []byte) error {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	written := make(chan error, 1)
+	go func() {
+		if _, err := conn.Write(hello); err != nil {
+			written <- err
+			return
+		}
+		_, err := conn.Write(payload)
+		written <- err
+	}()
+	n, err := io.CopyN(io.Discard, conn, int64(len(payload)))
+	if err != nil {
+		return fmt.Errorf("read %d of %d echoed bytes: %v", n, len(payload), err)
+	}
+	return <-written
+}
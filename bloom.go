@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"hash/maphash"
+	"io"
+	"math"
+	"os"
+	"strings"
+)
+
+// bloomFilter is a set of strings in a fixed number of bits. Has never
+// misses an added string, but reports others as present at roughly the false
+// positive rate the filter was sized for.
+type bloomFilter struct {
+	bits   []uint64
+	m      uint64 // Number of bits
+	k      int    // Bit positions per string
+	s1, s2 maphash.Seed
+}
+
+// newBloomFilter sizes a filter for n strings at false positive rate p
+func newBloomFilter(n int, p float64) *bloomFilter {
+	n = max(n, 1)
+	m := uint64(math.Ceil(-float64(n) * math.Log(p) / (math.Ln2 * math.Ln2)))
+	m = max(m, 64)
+	k := max(int(math.Round(float64(m)/float64(n)*math.Ln2)), 1)
+	return &bloomFilter{
+		bits: make([]uint64, (m+63)/64),
+		m:    m,
+		k:    k,
+		s1:   maphash.MakeSeed(),
+		s2:   maphash.MakeSeed(),
+	}
+}
+
+// positions calls fn with the k bit positions of s, derived from two hashes
+func (f *bloomFilter) positions(s string, fn func(uint64) bool) {
+	h1, h2 := maphash.String(f.s1, s), maphash.String(f.s2, s)|1
+	for i := range f.k {
+		if !fn((h1 + uint64(i)*h2) % f.m) {
+			return
+		}
+	}
+}
+
+// Add inserts s
+func (f *bloomFilter) Add(s string) {
+	f.positions(s, func(bit uint64) bool {
+		f.bits[bit/64] |= 1 << (bit % 64)
+		return true
+	})
+}
+
+// Has reports whether s was probably added
+func (f *bloomFilter) Has(s string) bool {
+	found := true
+	f.positions(s, func(bit uint64) bool {
+		found = f.bits[bit/64]&(1<<(bit%64)) != 0
+		return found
+	})
+	return found
+}
+
+// Size returns the memory taken by the filter's bits, in bytes
+func (f *bloomFilter) Size() int {
+	return len(f.bits) * 8
+}
+
+// loadAllowlist reads a file of hostnames, one per line, into a Bloom filter
+// with false positive rate p. Blank lines and lines starting with # are
+// ignored. It returns the filter and the number of hostnames.
+func loadAllowlist(path string, p float64) (*bloomFilter, int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to open allowlist '%s': %v", path, err)
+	}
+	defer f.Close()
+
+	// Count first so the filter is sized without holding every name
+	n := 0
+	err = eachAllowlistHost(f, func(string) { n++ })
+	if err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to read allowlist '%s': %v", path, err)
+	}
+
+	filter := newBloomFilter(n, p)
+	if err := eachAllowlistHost(f, filter.Add); err != nil {
+		return nil, 0, fmt.Errorf("failed to read allowlist '%s': %v", path, err)
+	}
+	return filter, n, nil
+}
+
+// eachAllowlistHost calls fn with each normalized hostname in r
+func eachAllowlistHost(r io.Reader, fn func(string)) error {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fn(normalizeHost(line))
+	}
+	return scanner.Err()
+}
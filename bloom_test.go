@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestBloomFilterFalsePositiveRate(t *testing.T) {
+	const n, p = 10000, 0.01
+	f := newBloomFilter(n, p)
+	for i := range n {
+		f.Add(fmt.Sprintf("host%d.example.com", i))
+	}
+	for i := range n {
+		if h := fmt.Sprintf("host%d.example.com", i); !f.Has(h) {
+			t.Fatalf("Has(%s) = false for an added host", h)
+		}
+	}
+
+	// Twice the configured rate leaves room for chance over this many probes
+	const probes = 100000
+	fp := 0
+	for i := range probes {
+		if f.Has(fmt.Sprintf("other%d.example.org", i)) {
+			fp++
+		}
+	}
+	if rate := float64(fp) / probes; rate > 2*p {
+		t.Errorf("false positive rate = %.4f, want at most about %.2f", rate, p)
+	}
+}
+
+func TestLoadAllowlist(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "allow.txt")
+	data := "# permitted hosts\nA.Example.com\n\n  b.example.com.  \n#c.example.com\n"
+	if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	f, n, err := loadAllowlist(path, 0.001)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Errorf("loaded %d hosts, want 2", n)
+	}
+	for _, h := range []string{"a.example.com", "b.example.com"} {
+		if !f.Has(h) {
+			t.Errorf("Has(%s) = false, want the listed host", h)
+		}
+	}
+	if f.Has("c.example.com") {
+		t.Error("Has(c.example.com) = true for a commented out host")
+	}
+
+	if _, _, err := loadAllowlist(filepath.Join(t.TempDir(), "missing.txt"), 0.001); err == nil {
+		t.Error("loadAllowlist of a missing file succeeded, want an error")
+	}
+}
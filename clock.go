@@ -0,0 +1,40 @@
+package main
+
+import "time"
+
+// clock tells the time for measurements, windows and schedules, and runs the
+// timers and tickers behind them. Socket deadlines are enforced by the
+// runtime against the wall clock, so they keep using time.Now directly.
+type clock interface {
+	Now() time.Time
+	Since(t time.Time) time.Duration
+	After(d time.Duration) <-chan time.Time
+	AfterFunc(d time.Duration, f func())
+	NewTicker(d time.Duration) ticker
+}
+
+// ticker delivers the time on C every period until stopped, like time.Ticker
+type ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+// realClock is the system clock
+type realClock struct{}
+
+func (realClock) Now() time.Time                         { return time.Now() }
+func (realClock) Since(t time.Time) time.Duration        { return time.Since(t) }
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+func (realClock) AfterFunc(d time.Duration, f func())    { time.AfterFunc(d, f) }
+func (realClock) NewTicker(d time.Duration) ticker       { return realTicker{time.NewTicker(d)} }
+
+// realTicker is a ticker backed by time.Ticker
+type realTicker struct {
+	t *time.Ticker
+}
+
+func (r realTicker) C() <-chan time.Time { return r.t.C }
+func (r realTicker) Stop()               { r.t.Stop() }
+
+// clk is the clock used throughout proxys, replaceable for testing
+var clk clock = realClock{}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock is a clock that only moves when Advance is called. Timers and
+// tickers fire during Advance, AfterFunc callbacks on the calling goroutine.
+type fakeClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []*fakeTimer
+}
+
+// fakeTimer is a pending After, AfterFunc or ticker of a fakeClock
+type fakeTimer struct {
+	clock   *fakeClock
+	when    time.Time
+	period  time.Duration // Ticker period (0 for one-shot timers)
+	ch      chan time.Time
+	fn      func()
+	stopped bool
+}
+
+func (t *fakeTimer) C() <-chan time.Time { return t.ch }
+
+func (t *fakeTimer) Stop() {
+	t.clock.mu.Lock()
+	t.stopped = true
+	t.clock.mu.Unlock()
+}
+
+// useFakeClock replaces clk with a fake clock for the rest of the test. It
+// first waits for connections from earlier tests, which read clk, to finish.
+func useFakeClock(t *testing.T) *fakeClock {
+	waitIdle(t)
+	c := &fakeClock{now: time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)}
+	prev := clk
+	clk = c
+	t.Cleanup(func() { clk = prev })
+	return c
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Since(t time.Time) time.Duration {
+	return c.Now().Sub(t)
+}
+
+func (c *fakeClock) add(d, period time.Duration, fn func()) *fakeTimer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := &fakeTimer{clock: c, when: c.now.Add(d), period: period, ch: make(chan time.Time, 1), fn: fn}
+	c.timers = append(c.timers, t)
+	return t
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	return c.add(d, 0, nil).ch
+}
+
+func (c *fakeClock) AfterFunc(d time.Duration, f func()) {
+	c.add(d, 0, f)
+}
+
+func (c *fakeClock) NewTicker(d time.Duration) ticker {
+	return c.add(d, d, nil)
+}
+
+// pending returns the number of timers and tickers waiting to fire
+func (c *fakeClock) pending() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.timers)
+}
+
+// Advance moves the clock forward by d, firing every timer that comes due
+// in order. Ticks a receiver has not taken yet are dropped, as with
+// time.Ticker.
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	end := c.now.Add(d)
+	for {
+		sort.SliceStable(c.timers, func(i, j int) bool { return c.timers[i].when.Before(c.timers[j].when) })
+		if len(c.timers) == 0 || c.timers[0].when.After(end) {
+			break
+		}
+		t := c.timers[0]
+		c.now = t.when
+		if t.period > 0 && !t.stopped {
+			t.when = t.when.Add(t.period)
+		} else {
+			c.timers = c.timers[1:]
+		}
+		if t.stopped {
+			continue
+		}
+		if t.fn != nil {
+			c.mu.Unlock()
+			t.fn()
+			c.mu.Lock()
+			continue
+		}
+		select {
+		case t.ch <- c.now:
+		default:
+		}
+	}
+	c.now = end
+	c.mu.Unlock()
+}
+
+// captureLog sends log output to a buffer for the rest of the test
+func captureLog(t *testing.T) *syncBuffer {
+	var buf syncBuffer
+	log.SetOutput(&buf)
+	t.Cleanup(func() { log.SetOutput(logOutput) })
+	return &buf
+}
+
+// logOutput is where the log package writes outside captureLog
+var logOutput = log.Writer()
+
+// syncBuffer is a bytes.Buffer safe for concurrent log writes
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestWaitForDrainTimeoutOnFakeClock(t *testing.T) {
+	fc := useFakeClock(t)
+	logs := captureLog(t)
+
+	// A connection that never finishes keeps the drain waiting
+	srv := newTestServer(t)
+	srv.active.Add(1)
+	defer srv.active.Done()
+	activeConns.Add(1)
+	defer activeConns.Add(-1)
+
+	done := make(chan struct{})
+	go func() {
+		srv.waitForDrain(time.Hour)
+		close(done)
+	}()
+
+	// The drain timeout and progress ticker are both registered
+	if !waitFor(time.Second, func() bool { return fc.pending() == 2 }) {
+		t.Fatalf("waitForDrain registered %d timers, want 2", fc.pending())
+	}
+	fc.Advance(time.Hour)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("waitForDrain did not return once the fake clock passed its timeout")
+	}
+	if out := logs.String(); !strings.Contains(out, "Shutdown timeout of 1h0m0s reached, exiting with 1 active connections") {
+		t.Errorf("drain log does not report the timeout:\n%s", out)
+	}
+}
+
+func TestRateLimiterOnFakeClock(t *testing.T) {
+	fc := useFakeClock(t)
+	logs := captureLog(t)
+
+	r := &rateLimiter{host: "example.com", limit: 2}
+	var got []bool
+	for range 4 {
+		got = append(got, r.Allow())
+	}
+	if want := []bool{true, true, false, false}; !slices.Equal(got, want) {
+		t.Errorf("Allow in the first second = %v, want %v", got, want)
+	}
+
+	// A new second admits lines again
+	fc.Advance(time.Second)
+	if !r.Allow() {
+		t.Error("Allow in the next second = false, want true")
+	}
+
+	// The suppressed lines are reported once per summary interval
+	fc.Advance(logSummaryInterval)
+	if out := logs.String(); strings.Count(out, "Suppressed 2 routing log lines for example.com") != 1 {
+		t.Errorf("summary log = %q, want one line reporting 2 suppressed lines", out)
+	}
+}
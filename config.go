@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// dumpConfig writes the effective flag values and resolved routes as JSON
+func dumpConfig(w io.Writer, rm *RouteMap) error {
+	flags := make(map[string]any)
+	flag.VisitAll(func(f *flag.Flag) {
+		if rf, ok := f.Value.(*listFlags); ok {
+			flags[f.Name] = []string(*rf)
+			return
+		}
+		flags[f.Name] = f.Value.String()
+	})
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(struct {
+		Flags  map[string]any `json:"flags"`
+		Routes []*RouteConfig `json:"routes"`
+	}{flags, rm.Routes()})
+}
+
+// fileConfig is the format of -config files. Upstreams and routes use the
+// same syntax as the -upstream and -route flags.
+type fileConfig struct {
+	Upstreams []string `json:"upstreams,omitempty"`
+	Routes    []string `json:"routes"`
+}
+
+// loadConfig reads a -config file
+func loadConfig(path string) (*fileConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config '%s': %v", path, err)
+	}
+	var fc fileConfig
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&fc); err != nil {
+		return nil, fmt.Errorf("failed to parse config '%s': %v", path, err)
+	}
+	return &fc, nil
+}
+
+// exportConfig writes the upstreams and rm as a -config file
+func exportConfig(path string, rm *RouteMap) error {
+	fc := fileConfig{Routes: []string{}}
+	names := make([]string, 0, len(upstreams))
+	for name := range upstreams {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fc.Upstreams = append(fc.Upstreams, upstreams[name].String())
+	}
+	for _, cfg := range rm.Routes() {
+		fc.Routes = append(fc.Routes, cfg.String())
+	}
+
+	data, err := json.MarshalIndent(fc, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(path, append(data, '\n'), 0o644); err != nil {
+		return fmt.Errorf("failed to write config '%s': %v", path, err)
+	}
+	return nil
+}
+
+// reload re-reads -config and atomically replaces the routes with those from
+// the flags and the file. Routes added or removed through the admin API are
+// dropped. Upstreams cannot change at runtime, so a file whose upstreams
+// differ from the ones loaded at startup is rejected. On error the running
+// routes are left untouched.
+func (s *server) reload() (rm *RouteMap, err error) {
+	defer func() {
+		if err != nil {
+			configReloads.inc("error")
+		} else {
+			configReloads.inc("success")
+		}
+	}()
+	if configPath == "" {
+		return nil, fmt.Errorf("no -config file to reload")
+	}
+	fc, err := loadConfig(configPath)
+	if err != nil {
+		return nil, err
+	}
+	if !slices.Equal(fc.Upstreams, s.configUpstreams) {
+		return nil, fmt.Errorf("upstreams in config '%s' changed; restart to apply them", configPath)
+	}
+	rm, err = parseRoutes(append(slices.Clone(s.flagRoutes), fc.Routes...))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse routes in config '%s': %v", configPath, err)
+	}
+
+	s.routesMu.Lock()
+	old := s.routes.Swap(rm)
+	s.routesMu.Unlock()
+	logRouteDiff(old, rm)
+	return rm, nil
+}
+
+// logRouteDiff logs every route added, removed or changed between old and
+// next, as an audit trail of reloads, and counts them
+func logRouteDiff(old, next *RouteMap) {
+	key := func(cfg *RouteConfig) string {
+		if cfg.NoALPN {
+			return cfg.Host + " (noalpn)"
+		}
+		return cfg.Host
+	}
+	before := make(map[string]string)
+	for _, cfg := range old.Routes() {
+		before[key(cfg)] = cfg.String()
+	}
+	var added, removed, changed int
+	for _, cfg := range next.Routes() {
+		k, spec := key(cfg), cfg.String()
+		prev, ok := before[k]
+		delete(before, k)
+		switch {
+		case !ok:
+			added++
+			log.Printf("Reload added route %s", spec)
+		case prev != spec:
+			changed++
+			log.Printf("Reload changed route %s: %s -> %s", k, prev, spec)
+		}
+	}
+	for _, k := range slices.Sorted(maps.Keys(before)) {
+		removed++
+		log.Printf("Reload removed route %s", before[k])
+	}
+	routeReloadChanges.add(int64(added), "added")
+	routeReloadChanges.add(int64(removed), "removed")
+	routeReloadChanges.add(int64(changed), "changed")
+	log.Printf("Reload: %d routes added, %d removed, %d changed", added, removed, changed)
+}
+
+// dsnEnv names the environment variable holding a compact configuration
+const dsnEnv = "PROXYS_DSN"
+
+// applyDSN sets flags from a DSN of ;-separated flag=value pairs, e.g.
+// listen=:443;route=a.com=:8080;route=b.com. Flags given on the command line
+// take precedence; repeatable flags such as route accumulate from both. A
+// bool flag given without a value is set to true.
+func applyDSN(dsn string) error {
+	explicit := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+
+	for _, pair := range strings.Split(dsn, ";") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		name, value, hasValue := strings.Cut(pair, "=")
+		f := flag.Lookup(name)
+		if f == nil {
+			return fmt.Errorf("%s: unknown setting '%s'", dsnEnv, name)
+		}
+		if _, repeatable := f.Value.(*listFlags); !repeatable && explicit[name] {
+			continue
+		}
+		if !hasValue {
+			value = "true"
+		}
+		if err := f.Value.Set(value); err != nil {
+			return fmt.Errorf("%s: invalid value '%s' for %s: %v", dsnEnv, value, name, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestDumpConfig(t *testing.T) {
+	useFlagSet(t)
+	var listenFlag string
+	var routeFlags listFlags
+	flag.StringVar(&listenFlag, "listen", ":443", "")
+	flag.Var(&routeFlags, "route", "")
+	if err := flag.CommandLine.Parse([]string{"-listen", ":8443", "-route", "example.com=:8080", "-route", ".example.org"}); err != nil {
+		t.Fatal(err)
+	}
+	rm, err := parseRoutes(routeFlags)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	if err := dumpConfig(&out, rm); err != nil {
+		t.Fatal(err)
+	}
+	var dumped struct {
+		Flags  map[string]any `json:"flags"`
+		Routes []struct {
+			Host        string `json:"host"`
+			Target      string `json:"target"`
+			Passthrough bool   `json:"passthrough"`
+		} `json:"routes"`
+	}
+	if err := json.Unmarshal(out.Bytes(), &dumped); err != nil {
+		t.Fatalf("dump is not valid JSON: %v\n%s", err, out.String())
+	}
+	if got := dumped.Flags["listen"]; got != ":8443" {
+		t.Errorf("dumped listen = %v, want :8443", got)
+	}
+	if got, ok := dumped.Flags["route"].([]any); !ok || !slices.Equal(got, []any{"example.com=:8080", ".example.org"}) {
+		t.Errorf("dumped route = %v, want both -route values", dumped.Flags["route"])
+	}
+	if len(dumped.Routes) != 2 {
+		t.Fatalf("dumped %d routes, want 2:\n%s", len(dumped.Routes), out.String())
+	}
+	for _, r := range dumped.Routes {
+		switch r.Host {
+		case "example.com":
+			if r.Target != "localhost:8080" || r.Passthrough {
+				t.Errorf("dumped example.com route = %+v, want target localhost:8080", r)
+			}
+		case ".example.org":
+			if !r.Passthrough {
+				t.Errorf("dumped .example.org route = %+v, want passthrough", r)
+			}
+		default:
+			t.Errorf("unexpected dumped route %+v", r)
+		}
+	}
+}
+
+// useFlagSet replaces flag.CommandLine with an empty set for the rest of the
+// test, since the real flags are only registered in main
+func useFlagSet(t *testing.T) {
+	prev := flag.CommandLine
+	flag.CommandLine = flag.NewFlagSet("proxys", flag.ContinueOnError)
+	t.Cleanup(func() { flag.CommandLine = prev })
+}
+
+func TestRouteSourcesShareHostNormalization(t *testing.T) {
+	useFlagSet(t)
+	var routeFlags listFlags
+	flag.Var(&routeFlags, "route", "")
+
+	// One host written three ways: on the command line, in the DSN and in
+	// a config file
+	if err := flag.CommandLine.Parse([]string{"-route", "Example.com=:8080"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := applyDSN("route=EXAMPLE.COM.=:8081"); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "proxys.json")
+	if err := os.WriteFile(path, []byte(`{"routes": ["example.COM=:8082"]}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	fc, err := loadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, pair := range [][]string{
+		{routeFlags[0], routeFlags[1]},
+		{routeFlags[0], fc.Routes[0]},
+		{routeFlags[1], fc.Routes[0]},
+	} {
+		_, err := parseRoutes(pair)
+		if err == nil || err.Error() != "duplicate route for host: example.com" {
+			t.Errorf("parseRoutes(%q) = %v, want a duplicate route for example.com", pair, err)
+		}
+	}
+}
+
+func TestApplyDSN(t *testing.T) {
+	useFlagSet(t)
+	var listenFlag, logFlag string
+	var dumpFlag bool
+	var routeFlags listFlags
+	flag.StringVar(&listenFlag, "listen", ":443", "")
+	flag.StringVar(&logFlag, "log-level", "info", "")
+	flag.BoolVar(&dumpFlag, "dump-config", false, "")
+	flag.Var(&routeFlags, "route", "")
+
+	// The command line wins for single-valued flags; routes accumulate
+	if err := flag.CommandLine.Parse([]string{"-log-level", "debug", "-route", "c.example.com=:8082"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := applyDSN(" listen=:8443; route=a.example.com=:8080;route=b.example.com;log-level=info;dump-config;"); err != nil {
+		t.Fatal(err)
+	}
+	if listenFlag != ":8443" {
+		t.Errorf("listen = %s, want :8443 from the DSN", listenFlag)
+	}
+	if logFlag != "debug" {
+		t.Errorf("log-level = %s, want debug from the command line", logFlag)
+	}
+	if !dumpFlag {
+		t.Error("dump-config given without a value was not set")
+	}
+	if want := []string{"c.example.com=:8082", "a.example.com=:8080", "b.example.com"}; !slices.Equal(routeFlags, want) {
+		t.Errorf("routes = %q, want %q", routeFlags, want)
+	}
+	if _, err := parseRoutes(routeFlags); err != nil {
+		t.Errorf("routes from the DSN do not parse: %v", err)
+	}
+
+	for _, dsn := range []string{"listne=:443", "dump-config=maybe"} {
+		if err := applyDSN(dsn); err == nil {
+			t.Errorf("applyDSN(%q) succeeded, want an error", dsn)
+		}
+	}
+}
+
+func TestExportConfigRoundTrip(t *testing.T) {
+	defer func(prev map[string]*upstreamPool) { upstreams = prev }(upstreams)
+	pool, err := parseUpstream("cache=10.0.0.1:443,10.0.0.2:443")
+	if err != nil {
+		t.Fatal(err)
+	}
+	upstreams = map[string]*upstreamPool{"cache": pool}
+
+	routes := []string{
+		"example.com=:8080|:8081@127.0.0.1:1080|127.0.0.1:1081,proxyselect=latency,proxywindow=22:00-06:00,log=summary",
+		"bulk.example.com=:8080,maxbytes=1000,firstbyte=2s,copybuf=64k,maxdialconcurrency=4,dialtimeout=3s,logratelimit=5,priority=10",
+		"cache.example.com,upstream=cache",
+		".example.org,passthroughport=8443,noalpn",
+		`~^(\w+)\.example\.net$=$1.internal:443,replay=false`,
+		"blocked.example.com=reject,log=off",
+		"down.example.com=:8080,maintenance=internal_error",
+		hashHost("salt", "secret.example.com") + "=:8080",
+		"*=:9000",
+	}
+	rm, err := parseRoutes(routes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := exportConfig(path, rm); err != nil {
+		t.Fatal(err)
+	}
+
+	fc, err := loadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(fc.Upstreams, []string{pool.String()}) {
+		t.Errorf("exported upstreams = %q, want %q", fc.Upstreams, pool.String())
+	}
+	imported, err := parseRoutes(fc.Routes)
+	if err != nil {
+		t.Fatalf("exported routes do not parse: %v", err)
+	}
+	want, _ := json.Marshal(rm.Routes())
+	got, _ := json.Marshal(imported.Routes())
+	if !bytes.Equal(got, want) {
+		t.Errorf("imported routes differ from the exported ones:\n got %s\nwant %s", got, want)
+	}
+	for i, cfg := range imported.Routes() {
+		if orig := rm.Routes()[i]; cfg.String() != orig.String() || cfg.HashSalt != orig.HashSalt || (cfg.Pattern == nil) != (orig.Pattern == nil) {
+			t.Errorf("route %s imported as %s", orig, cfg)
+		}
+	}
+}
+
+func TestLogRouteDiff(t *testing.T) {
+	logs := captureLog(t)
+	old, err := parseRoutes([]string{"a.example.com=:8001", "b.example.com=:8002", "c.example.com=:8003"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	next, err := parseRoutes([]string{"a.example.com=:8001", "b.example.com=:9002", "d.example.com=:8004"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	added, removed, changed := routeReloadChanges.with("added").Load(), routeReloadChanges.with("removed").Load(), routeReloadChanges.with("changed").Load()
+
+	logRouteDiff(old, next)
+	out := logs.String()
+	for _, want := range []string{
+		"Reload added route d.example.com",
+		"Reload removed route c.example.com",
+		"Reload changed route b.example.com:",
+		"Reload: 1 routes added, 1 removed, 1 changed",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("reload log lacks %q:\n%s", want, out)
+		}
+	}
+	if strings.Contains(out, "a.example.com") {
+		t.Errorf("reload log mentions the unchanged route:\n%s", out)
+	}
+	if got := routeReloadChanges.with("added").Load() - added; got != 1 {
+		t.Errorf("added routes counted %d, want 1", got)
+	}
+	if got := routeReloadChanges.with("removed").Load() - removed; got != 1 {
+		t.Errorf("removed routes counted %d, want 1", got)
+	}
+	if got := routeReloadChanges.with("changed").Load() - changed; got != 1 {
+		t.Errorf("changed routes counted %d, want 1", got)
+	}
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/csv"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	connLogQueueSize          = 1024        // Close records queued before dropping
+	connLogFlushInterval      = time.Second // Maximum time a record waits in the write buffer
+	connLogCheckpointInterval = time.Minute // How often a chained log's position is logged
+)
+
+// Compression of rotated connection log files
+const (
+	connLogCompressNone = "none"
+	connLogCompressGzip = "gzip"
+)
+
+// validateConnLogCompress checks a -conn-log-compress value
+func validateConnLogCompress(compress string) error {
+	switch compress {
+	case connLogCompressNone, connLogCompressGzip:
+		return nil
+	}
+	return fmt.Errorf("unsupported compression '%s' (use none or gzip)", compress)
+}
+
+var connLogDropped = newCounter("conn_log_dropped_total", "Connection records not written to the -conn-log file", "reason")
+
+// connLogHeader names the columns of every connection log file
+var connLogHeader = []string{"time", "client_ip", "sni", "backend", "bytes_upstream", "bytes_downstream", "duration_seconds", "reason", "backend_local_addr"}
+
+// connLog appends a CSV row per closed connection to a file, rotating it once
+// it reaches maxSize. Records are queued without blocking; when the queue is
+// full they are dropped.
+type connLog struct {
+	path     string
+	maxSize  int64  // Rotate once the file reaches this many bytes (0 disables)
+	compress string // Compression of rotated files: none or gzip
+	chainKey []byte // HMAC key chaining the rows for tamper evidence (nil disables)
+	queue    chan connEvent
+	stop     chan struct{}
+	done     chan struct{}
+
+	f    *os.File
+	buf  *bufio.Writer
+	csv  *csv.Writer
+	size int64 // Bytes in the current file, including buffered ones
+
+	chain          []byte // Chain value of the last row written (nil before the first row of a chain)
+	rows           int64  // Rows written to the current file by this process
+	checkpointRows int64  // rows at the last checkpoint
+
+	compressing sync.WaitGroup // Rotated files being compressed in the background
+}
+
+// countingWriter adds the length of every write to n
+type countingWriter struct {
+	io.Writer
+	n *int64
+}
+
+func (w countingWriter) Write(p []byte) (int, error) {
+	n, err := w.Writer.Write(p)
+	*w.n += int64(n)
+	return n, err
+}
+
+func newConnLog(path string, maxSize int64, compress string, chainKey []byte) (*connLog, error) {
+	l := &connLog{
+		path:     path,
+		maxSize:  maxSize,
+		compress: compress,
+		chainKey: chainKey,
+		queue:    make(chan connEvent, connLogQueueSize),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	go l.run()
+	return l, nil
+}
+
+// Send queues ev for writing, dropping it if the queue is full
+func (l *connLog) Send(ev connEvent) {
+	select {
+	case l.queue <- ev:
+	default:
+		connLogDropped.inc("queue_full")
+	}
+}
+
+// Close writes queued records, closes the file and waits for rotated files
+// to finish compressing
+func (l *connLog) Close() {
+	close(l.stop)
+	<-l.done
+	l.compressing.Wait()
+}
+
+func (l *connLog) run() {
+	defer close(l.done)
+
+	ticker := time.NewTicker(connLogFlushInterval)
+	defer ticker.Stop()
+	checkpoints := time.NewTicker(connLogCheckpointInterval)
+	defer checkpoints.Stop()
+
+	for {
+		select {
+		case ev := <-l.queue:
+			l.write(ev)
+		case <-ticker.C:
+			l.flush()
+		case <-checkpoints.C:
+			if l.rows > l.checkpointRows {
+				l.checkpoint()
+			}
+		case <-l.stop:
+			for {
+				select {
+				case ev := <-l.queue:
+					l.write(ev)
+				default:
+					l.flush()
+					if l.f != nil {
+						l.checkpoint()
+						l.f.Close()
+					}
+					return
+				}
+			}
+		}
+	}
+}
+
+// open opens the log file for appending, writing the header if it is new
+func (l *connLog) open() error {
+	f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to open connection log '%s': %v", l.path, err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("failed to open connection log '%s': %v", l.path, err)
+	}
+
+	// A chained log carries on from the last row written: the file's own
+	// when appending to one with rows, otherwise the last row of the file
+	// rotated before it, so that removing a whole file breaks the chain too
+	l.rows, l.checkpointRows = 0, 0
+	if l.chainKey != nil {
+		last, err := lastChain(l.path)
+		if err == nil && last == nil && l.chain == nil {
+			last, err = lastRotatedChain(l.path)
+		}
+		if err != nil {
+			f.Close()
+			return fmt.Errorf("failed to continue chain of connection log '%s': %v", l.path, err)
+		}
+		if last != nil {
+			l.chain = last
+		}
+	}
+
+	l.f = f
+	l.buf = bufio.NewWriter(f)
+	l.csv = csv.NewWriter(countingWriter{l.buf, &l.size})
+	l.size = info.Size()
+	if l.size == 0 {
+		header := connLogHeader
+		if l.chainKey != nil {
+			header = append(slices.Clip(header), connLogChainColumn)
+		}
+		l.csv.Write(header)
+		l.csv.Flush()
+	}
+	return nil
+}
+
+func (l *connLog) write(ev connEvent) {
+	if l.f == nil {
+		// A failed rotation left no file open; try again with each record
+		if err := l.open(); err != nil {
+			log.Printf("Failed to write connection log: %v", err)
+			connLogDropped.inc("write_failed")
+			return
+		}
+	}
+
+	record := []string{
+		ev.Time.UTC().Format(time.RFC3339Nano),
+		ev.ClientIP,
+		ev.SNI,
+		ev.Backend,
+		strconv.FormatInt(ev.BytesUp, 10),
+		strconv.FormatInt(ev.BytesDown, 10),
+		strconv.FormatFloat(ev.Duration, 'f', 3, 64),
+		ev.Reason,
+		ev.BackendLocal,
+	}
+	if l.chainKey != nil {
+		l.chain = chainMAC(l.chainKey, l.chain, record)
+		record = append(record, hex.EncodeToString(l.chain))
+	}
+	l.rows++
+	l.csv.Write(record)
+	l.csv.Flush()
+	if err := l.csv.Error(); err != nil {
+		log.Printf("Failed to write connection log '%s': %v", l.path, err)
+		connLogDropped.inc("write_failed")
+		return
+	}
+
+	if l.maxSize > 0 && l.size >= l.maxSize {
+		l.rotate()
+	}
+}
+
+// checkpoint logs the position and chain value of a chained log, so rows
+// removed from its end later are detectable against the process log
+func (l *connLog) checkpoint() {
+	if l.chainKey == nil {
+		return
+	}
+	l.checkpointRows = l.rows
+	log.Printf("Connection log checkpoint: %s, %d rows written, chain %s", l.path, l.rows, hex.EncodeToString(l.chain))
+}
+
+func (l *connLog) flush() {
+	if l.f == nil {
+		return
+	}
+	if err := l.buf.Flush(); err != nil {
+		log.Printf("Failed to write connection log '%s': %v", l.path, err)
+	}
+}
+
+// rotate moves the current file aside with a timestamp suffix and starts a
+// new one, e.g. conns.csv becomes conns-20060102-150405.000.csv. With
+// compression the rotated file is then compressed in the background, so
+// writing carries on.
+func (l *connLog) rotate() {
+	l.flush()
+	l.checkpoint()
+	l.f.Close()
+	l.f = nil
+
+	rotated := rotatedName(l.path, time.Now())
+	if err := os.Rename(l.path, rotated); err != nil {
+		log.Printf("Failed to rotate connection log '%s': %v", l.path, err)
+	} else if l.compress == connLogCompressGzip {
+		l.compressing.Add(1)
+		go func() {
+			defer l.compressing.Done()
+			if err := gzipFile(rotated); err != nil {
+				log.Printf("Failed to compress connection log '%s': %v", rotated, err)
+			}
+		}()
+	}
+	if err := l.open(); err != nil {
+		log.Printf("Failed to rotate connection log: %v", err)
+	}
+}
+
+// rotatedName returns an unused name to rotate path to at t. A rotation in
+// the same millisecond as an earlier one takes the next free millisecond, so
+// no rotated file is overwritten and the names still sort in rotation order.
+func rotatedName(path string, t time.Time) string {
+	ext := filepath.Ext(path)
+	for {
+		name := strings.TrimSuffix(path, ext) + "-" + t.Format("20060102-150405.000") + ext
+		if !fileExists(name) && !fileExists(name+".gz") {
+			return name
+		}
+		t = t.Add(time.Millisecond)
+	}
+}
+
+// fileExists reports whether anything exists at path
+func fileExists(path string) bool {
+	_, err := os.Lstat(path)
+	return err == nil
+}
+
+// gzipFile replaces the file at path with a gzip-compressed path.gz. On error
+// the original is kept and any partial output removed.
+func gzipFile(path string) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := os.OpenFile(path+".gz", os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(dst)
+	zw.Name = filepath.Base(path)
+	_, err = io.Copy(zw, src)
+	if cerr := zw.Close(); err == nil {
+		err = cerr
+	}
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(path + ".gz")
+		return err
+	}
+	return os.Remove(path)
+}
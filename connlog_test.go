@@ -0,0 +1,224 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// readConnLog returns the rows of the connection log file at path, header
+// included
+func readConnLog(t *testing.T, path string) [][]string {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	rows, err := csv.NewReader(f).ReadAll()
+	if err != nil {
+		t.Fatalf("%s is not valid CSV: %v", path, err)
+	}
+	return rows
+}
+
+func TestConnLogRecordsConnections(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "conns.csv")
+	hello := helloFor(t, "example.com")
+	backend := startAnswerBackend(t, len(hello), "answer")
+	srv := newTestServer(t, "example.com="+backend)
+	var err error
+	if srv.connLog, err = newConnLog(path, 0, connLogCompressNone, nil); err != nil {
+		t.Fatal(err)
+	}
+	addr := serveTest(t, srv)
+
+	conn := dialHello(t, addr, hello)
+	if !waitClosed(conn, 2*time.Second) {
+		t.Fatal("connection was not closed")
+	}
+	waitIdle(t)
+	srv.connLog.Close()
+
+	rows := readConnLog(t, path)
+	if len(rows) != 2 || !slices.Equal(rows[0], connLogHeader) {
+		t.Fatalf("connection log = %q, want the header and one row", rows)
+	}
+	row := make(map[string]string)
+	for i, col := range rows[0] {
+		row[col] = rows[1][i]
+	}
+	want := map[string]string{
+		"client_ip":        "127.0.0.1",
+		"sni":              "example.com",
+		"backend":          backend,
+		"bytes_upstream":   strconv.Itoa(len(hello)),
+		"bytes_downstream": strconv.Itoa(len("answer")),
+		"reason":           "eof",
+	}
+	for col, v := range want {
+		if row[col] != v {
+			t.Errorf("column %s = %q, want %q", col, row[col], v)
+		}
+	}
+	if _, err := time.Parse(time.RFC3339Nano, row["time"]); err != nil {
+		t.Errorf("column time: %v", err)
+	}
+	if !strings.HasPrefix(row["backend_local_addr"], "127.0.0.1:") {
+		t.Errorf("column backend_local_addr = %q, want a loopback address", row["backend_local_addr"])
+	}
+}
+
+func TestConnLogRotatesAtMaxSize(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "conns.csv")
+	const maxSize = 300
+	l, err := newConnLog(path, maxSize, connLogCompressNone, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const records = 10
+	for range records {
+		l.Send(connEvent{Type: "close", Time: time.Now(), SNI: "example.com", ClientIP: "192.0.2.1", Backend: "127.0.0.1:8443", Reason: "eof"})
+		// Rotated file names have millisecond timestamps
+		time.Sleep(5 * time.Millisecond)
+	}
+	l.Close()
+
+	files := connLogFiles(t, path)
+	if len(files) < 3 {
+		t.Fatalf("got files %v, want several rotations of a %d byte limit", files, maxSize)
+	}
+	var rows int
+	for i, f := range files {
+		info, err := os.Stat(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rotated := i < len(files)-1
+		if rotated && info.Size() < maxSize || !rotated && info.Size() >= maxSize {
+			t.Errorf("%s is %d bytes, want rotation exactly once it reaches %d", f, info.Size(), maxSize)
+		}
+		got := readConnLog(t, f)
+		if len(got) == 0 || !slices.Equal(got[0], connLogHeader) {
+			t.Errorf("%s does not start with the header", f)
+		}
+		rows += len(got) - 1
+	}
+	if rows != records {
+		t.Errorf("files hold %d rows, want %d", rows, records)
+	}
+}
+
+func TestConnLogCompressesRotatedFiles(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "conns.csv")
+	l, err := newConnLog(path, 300, connLogCompressGzip, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const records = 10
+	for i := range records {
+		l.Send(connEvent{Type: "close", Time: time.Now(), SNI: fmt.Sprintf("%d.example.com", i), ClientIP: "192.0.2.1", Backend: "127.0.0.1:8443", Reason: "eof"})
+		time.Sleep(5 * time.Millisecond)
+	}
+	l.Close()
+
+	if plain, _ := filepath.Glob(filepath.Join(dir, "conns-*.csv")); len(plain) > 0 {
+		t.Errorf("rotated files left uncompressed: %v", plain)
+	}
+	segments, err := filepath.Glob(filepath.Join(dir, "conns-*.csv.gz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(segments) < 2 {
+		t.Fatalf("got compressed segments %v, want several", segments)
+	}
+	slices.Sort(segments)
+
+	// The segments and the current file hold every row, in order
+	var snis []string
+	for _, seg := range append(segments, path) {
+		f, err := os.Open(seg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var r io.Reader = f
+		if strings.HasSuffix(seg, ".gz") {
+			zr, err := gzip.NewReader(f)
+			if err != nil {
+				t.Fatalf("%s is not a gzip file: %v", seg, err)
+			}
+			r = zr
+		}
+		rows, err := csv.NewReader(r).ReadAll()
+		f.Close()
+		if err != nil {
+			t.Fatalf("%s does not decompress to valid CSV: %v", seg, err)
+		}
+		if len(rows) == 0 || !slices.Equal(rows[0], connLogHeader) {
+			t.Fatalf("%s does not start with the header", seg)
+		}
+		col := slices.Index(connLogHeader, "sni")
+		for _, row := range rows[1:] {
+			snis = append(snis, row[col])
+		}
+	}
+	var want []string
+	for i := range records {
+		want = append(want, fmt.Sprintf("%d.example.com", i))
+	}
+	if !slices.Equal(snis, want) {
+		t.Errorf("rows across segments have SNIs %v, want %v", snis, want)
+	}
+}
+
+func TestRotatedNameAvoidsOverwrite(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "conns.csv")
+	at := time.Date(2024, 1, 2, 15, 4, 5, 0, time.UTC)
+	want := []string{"conns-20240102-150405.000.csv", "conns-20240102-150405.001.csv", "conns-20240102-150405.002.csv"}
+	for i, name := range want {
+		if got := filepath.Base(rotatedName(path, at)); got != name {
+			t.Fatalf("rotation %d named %s, want %s", i+1, got, name)
+		}
+		// A compressed file takes the name as well
+		if i == 1 {
+			name += ".gz"
+		}
+		os.WriteFile(filepath.Join(dir, name), nil, 0o644)
+	}
+	if !slices.IsSorted(want) {
+		t.Errorf("rotated names %v do not sort in rotation order", want)
+	}
+}
+
+func TestConnLogRotationsWithinOneMillisecond(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "conns.csv")
+	l, err := newConnLog(path, 1, connLogCompressNone, testChainKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const records = 20
+	for i := range records {
+		l.Send(connEvent{Type: "close", Time: time.Now(), SNI: fmt.Sprintf("%d.example.com", i), ClientIP: "192.0.2.1", Backend: "127.0.0.1:8443", Reason: "eof"})
+	}
+	l.Close()
+
+	// Every rotated file survives, and the chain runs through them in order
+	files := connLogFiles(t, path)
+	if len(files) != records+1 {
+		t.Fatalf("got %d files, want %d rotated files and the current one", len(files), records)
+	}
+	if code, out := verifyFiles(files...); code != 0 {
+		t.Errorf("verify of all files failed:\n%s", out)
+	}
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// connLogChainColumn is the last column of connection logs written with
+// -conn-log-chain-key
+const connLogChainColumn = "chain"
+
+var errUnchained = errors.New("file was written without -conn-log-chain-key; move it aside to start a chained log")
+
+// loadChainKey reads the HMAC key for -conn-log-chain-key from path
+func loadChainKey(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read chain key '%s': %v", path, err)
+	}
+	key := bytes.TrimSpace(data)
+	if len(key) == 0 {
+		return nil, fmt.Errorf("chain key '%s' is empty", path)
+	}
+	return key, nil
+}
+
+// chainMAC returns the chain value of a row: an HMAC over the previous row's
+// chain value and the row's fields, so changing, removing or reordering rows
+// breaks every later value. The first row of a file continues from the last
+// chain value of the file rotated before it (-conn-log-chain-from when
+// verifying); only the first file ever written starts from nil.
+func chainMAC(key, prev []byte, fields []string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(prev)
+	for _, f := range fields {
+		binary.Write(mac, binary.BigEndian, uint32(len(f)))
+		io.WriteString(mac, f)
+	}
+	return mac.Sum(nil)
+}
+
+// openConnLog opens a connection log for reading, decompressing it if its
+// name ends in .gz
+func openConnLog(path string) (io.ReadCloser, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasSuffix(path, ".gz") {
+		return f, nil
+	}
+	zr, err := gzip.NewReader(bufio.NewReader(f))
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{zr, f}, nil
+}
+
+// lastChain returns the chain value of the last row of a connection log, or
+// nil if it has no rows yet. The whole file is read, since an SNI can hold a
+// quoted newline and so no offset within the file is known to start a row.
+func lastChain(path string) ([]byte, error) {
+	f, err := openConnLog(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	cr := csv.NewReader(bufio.NewReader(f))
+	cr.ReuseRecord = true
+	header, err := cr.Read()
+	if err == io.EOF {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read header: %v", err)
+	}
+	if len(header) == 0 || header[len(header)-1] != connLogChainColumn {
+		return nil, errUnchained
+	}
+
+	var last string
+	for {
+		record, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read rows: %v", err)
+		}
+		last = record[len(record)-1]
+	}
+	if last == "" {
+		return nil, nil
+	}
+	return hex.DecodeString(last)
+}
+
+// lastRotatedChain returns the chain value of the last row of the newest
+// file rotated away from path, or nil if there is none or it is unchained
+func lastRotatedChain(path string) ([]byte, error) {
+	ext := filepath.Ext(path)
+	matches, err := filepath.Glob(strings.TrimSuffix(path, ext) + "-*" + ext + "*")
+	if err != nil || len(matches) == 0 {
+		return nil, err
+	}
+
+	// Timestamped names sort by age. A file whose compression was cut short
+	// still has its plain copy, which is complete.
+	slices.SortFunc(matches, func(a, b string) int {
+		return strings.Compare(strings.TrimSuffix(a, ".gz"), strings.TrimSuffix(b, ".gz"))
+	})
+	newest := matches[len(matches)-1]
+	if plain := strings.TrimSuffix(newest, ".gz"); slices.Contains(matches, plain) {
+		newest = plain
+	}
+
+	chain, err := lastChain(newest)
+	if errors.Is(err, errUnchained) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("'%s': %v", newest, err)
+	}
+	return chain, nil
+}
+
+// verifyConnLog checks the chain of a connection log written with key whose
+// first row chains from prev, and returns the number of rows and the final
+// chain value. The error names the first row that does not match.
+func verifyConnLog(r io.Reader, key, prev []byte) (rows int, last []byte, err error) {
+	cr := csv.NewReader(r)
+	header, err := cr.Read()
+	if err != nil {
+		return 0, prev, fmt.Errorf("failed to read header: %v", err)
+	}
+	if len(header) == 0 || header[len(header)-1] != connLogChainColumn {
+		return 0, prev, fmt.Errorf("no %s column; the log was written without -conn-log-chain-key", connLogChainColumn)
+	}
+	cr.FieldsPerRecord = len(header)
+
+	for {
+		record, err := cr.Read()
+		if err == io.EOF {
+			return rows, prev, nil
+		}
+		rows++
+		if err != nil {
+			return rows, prev, fmt.Errorf("row %d: %v", rows, err)
+		}
+		n := len(record) - 1
+		want := chainMAC(key, prev, record[:n])
+		if got, err := hex.DecodeString(record[n]); err != nil || !hmac.Equal(got, want) {
+			if rows == 1 {
+				return rows, prev, fmt.Errorf("row 1: chain mismatch; this row was altered, or the file does not directly follow the one before it")
+			}
+			return rows, prev, fmt.Errorf("row %d: chain mismatch; this or an earlier row was altered, removed or reordered", rows)
+		}
+		prev = want
+	}
+}
+
+// runVerifyConnLogs implements `proxys verify-conn-log`, checking the files
+// as one chain in the order given, the first continuing from the hex chain
+// value from, and printing each one's row count and final chain value. It
+// stops at the first failure and returns the exit code.
+func runVerifyConnLogs(w io.Writer, keyPath, from string, paths []string) int {
+	if keyPath == "" || len(paths) == 0 {
+		fmt.Fprintln(w, "usage: proxys verify-conn-log -conn-log-chain-key <path> [-conn-log-chain-from <chain>] <file>...")
+		return 2
+	}
+	key, err := loadChainKey(keyPath)
+	if err != nil {
+		fmt.Fprintln(w, err)
+		return 2
+	}
+	prev, err := hex.DecodeString(from)
+	if err != nil {
+		fmt.Fprintf(w, "invalid -conn-log-chain-from '%s': %v\n", from, err)
+		return 2
+	}
+
+	for _, path := range paths {
+		f, err := openConnLog(path)
+		if err != nil {
+			fmt.Fprintf(w, "%s: FAIL: %v\n", path, err)
+			return 1
+		}
+		var rows int
+		rows, prev, err = verifyConnLog(bufio.NewReader(f), key, prev)
+		f.Close()
+		if err != nil {
+			fmt.Fprintf(w, "%s: FAIL: %v\n", path, err)
+			return 1
+		}
+		fmt.Fprintf(w, "%s: ok, %d rows, chain %x\n", path, rows, prev)
+	}
+	return 0
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testChainKey = []byte("test chain key")
+
+// writeConnLog sends one close record per SNI through a chained connection
+// log at path and closes it. A pause between records keeps rotated file
+// names, which have millisecond timestamps, apart.
+func writeConnLog(t *testing.T, path string, maxSize int64, snis ...string) {
+	t.Helper()
+	l, err := newConnLog(path, maxSize, connLogCompressNone, testChainKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, sni := range snis {
+		l.Send(connEvent{Type: "close", Time: time.Now(), SNI: sni, ClientIP: "192.0.2.1", Backend: "127.0.0.1:8443", Reason: "eof"})
+		time.Sleep(5 * time.Millisecond)
+	}
+	l.Close()
+}
+
+// connLogFiles returns the rotated files for path, oldest first, followed by
+// path itself
+func connLogFiles(t *testing.T, path string) []string {
+	t.Helper()
+	rotated, err := filepath.Glob(strings.TrimSuffix(path, ".csv") + "-*.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	slices.Sort(rotated)
+	return append(rotated, path)
+}
+
+func verifyFiles(paths ...string) (int, string) {
+	var out bytes.Buffer
+	keyPath := filepath.Join(filepath.Dir(paths[0]), "chain.key")
+	os.WriteFile(keyPath, testChainKey, 0o600)
+	code := runVerifyConnLogs(&out, keyPath, "", paths)
+	return code, out.String()
+}
+
+func TestConnLogChainVerifies(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "conns.csv")
+	writeConnLog(t, path, 0, "a.example.com", "b.example.com", "c.example.com")
+	if code, out := verifyFiles(path); code != 0 {
+		t.Fatalf("verify of an unmodified log failed:\n%s", out)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	altered := bytes.Replace(data, []byte("b.example.com"), []byte("x.example.com"), 1)
+	if err := os.WriteFile(path, altered, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	code, out := verifyFiles(path)
+	if code != 1 || !strings.Contains(out, "row 2: chain mismatch") {
+		t.Errorf("verify of an altered log = %d:\n%s\nwant a mismatch at row 2", code, out)
+	}
+}
+
+func TestConnLogChainContinuesAfterQuotedNewline(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "conns.csv")
+	writeConnLog(t, path, 0, "a.example.com", "b\nc.example.com")
+
+	// A restart reads the last chain value back, which must not trip over
+	// the newline quoted inside the last row
+	writeConnLog(t, path, 0, "d.example.com")
+	if code, out := verifyFiles(path); code != 0 {
+		t.Fatalf("verify after restart failed:\n%s", out)
+	}
+}
+
+func TestConnLogChainSpansRotatedFiles(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "conns.csv")
+	snis := []string{"a.example.com", "b.example.com", "c.example.com", "d.example.com", "e.example.com"}
+	writeConnLog(t, path, 1, snis...)
+
+	// A restart onto the fresh current file continues from the newest
+	// rotated one
+	writeConnLog(t, path, 0, "f.example.com")
+
+	files := connLogFiles(t, path)
+	if len(files) != len(snis)+1 {
+		t.Fatalf("got files %v, want %d rotated files and the current one", files, len(snis))
+	}
+	if code, out := verifyFiles(files...); code != 0 {
+		t.Fatalf("verify of all files failed:\n%s", out)
+	}
+
+	// Removing a whole file breaks the chain at the file after it
+	gap := slices.Delete(slices.Clone(files), 2, 3)
+	code, out := verifyFiles(gap...)
+	if code != 1 || !strings.Contains(out, files[3]+": FAIL: row 1: chain mismatch") {
+		t.Errorf("verify with %s removed = %d:\n%s\nwant a mismatch at the start of %s", files[2], code, out, files[3])
+	}
+}
+
+func TestVerifyConnLogsChainFrom(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "conns.csv")
+	writeConnLog(t, path, 1, "a.example.com", "b.example.com", "c.example.com")
+	files := connLogFiles(t, path)
+
+	// Checking a later file alone needs the chain value it continues from
+	keyPath := filepath.Join(dir, "chain.key")
+	os.WriteFile(keyPath, testChainKey, 0o600)
+	first, err := lastChain(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	if code := runVerifyConnLogs(&out, keyPath, "", files[1:]); code != 1 {
+		t.Errorf("verify without -conn-log-chain-from = %d, want 1:\n%s", code, out.String())
+	}
+	out.Reset()
+	if code := runVerifyConnLogs(&out, keyPath, hex.EncodeToString(first), files[1:]); code != 0 {
+		t.Errorf("verify with -conn-log-chain-from = %d, want 0:\n%s", code, out.String())
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+const (
+	controlTimeout    = 2 * time.Second // Timeout for a single control service request
+	controlMaxBody    = 4096            // Largest route accepted from the control service
+	controlMaxEntries = 10000           // Cached answers kept before new ones are not cached
+
+	// controlPlaceholderHost stands in for the SNI while a control answer
+	// is parsed
+	controlPlaceholderHost = "control.invalid"
+)
+
+var controlLookups = newCounter("control_lookups_total", "Route lookups for unconfigured SNIs against the control service", "result")
+
+// controlClient resolves routes for SNIs missing from the route map by
+// asking an HTTP control service, caching answers for ttl. The service is
+// queried with GET <url>?sni=<sni> and answers 200 with the part of a route
+// after '=' (target[@proxy][,options]), an empty 200 for passthrough, or 404
+// for an unknown SNI. Unknown SNIs are cached too.
+type controlClient struct {
+	url    string
+	ttl    time.Duration
+	client *http.Client
+
+	mu    sync.Mutex
+	cache map[string]controlEntry
+}
+
+type controlEntry struct {
+	cfg     *RouteConfig // nil for an unknown SNI
+	expires time.Time
+}
+
+func newControlClient(rawURL string, ttl time.Duration) (*controlClient, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid control URL '%s' (use http:// or https://)", rawURL)
+	}
+	return &controlClient{
+		url:    rawURL,
+		ttl:    ttl,
+		client: &http.Client{Timeout: controlTimeout},
+		cache:  make(map[string]controlEntry),
+	}, nil
+}
+
+// Lookup returns the route for sni from the cache or the control service.
+// Failed requests are not cached, so the next connection retries.
+func (c *controlClient) Lookup(sni string) (*RouteConfig, bool) {
+	if !controlSafeSNI(sni) {
+		controlLookups.inc("invalid_sni")
+		debugf("Not looking up SNI %q with the control service: not a hostname", sni)
+		return nil, false
+	}
+	now := clk.Now()
+
+	c.mu.Lock()
+	entry, ok := c.cache[sni]
+	c.mu.Unlock()
+	if ok && now.Before(entry.expires) {
+		controlLookups.inc("cached")
+		return entry.cfg, entry.cfg != nil
+	}
+
+	cfg, err := c.fetch(sni)
+	if err != nil {
+		controlLookups.inc("error")
+		log.Printf("Control lookup for %s failed: %v", sni, err)
+		return nil, false
+	}
+	if cfg != nil {
+		controlLookups.inc("found")
+	} else {
+		controlLookups.inc("not_found")
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.cache) >= controlMaxEntries {
+		for k, e := range c.cache {
+			if !now.Before(e.expires) {
+				delete(c.cache, k)
+			}
+		}
+	}
+	if len(c.cache) < controlMaxEntries {
+		c.cache[sni] = controlEntry{cfg: cfg, expires: now.Add(c.ttl)}
+	}
+	return cfg, cfg != nil
+}
+
+// fetch asks the control service for the route of sni, returning nil for
+// an unknown SNI
+func (c *controlClient) fetch(sni string) (*RouteConfig, error) {
+	sep := "?"
+	if strings.Contains(c.url, "?") {
+		sep = "&"
+	}
+	resp, err := c.client.Get(c.url + sep + "sni=" + url.QueryEscape(sni))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, controlMaxBody))
+	if err != nil {
+		return nil, err
+	}
+	// Only the answer is parsed, against a placeholder host, so nothing the
+	// client put in its SNI can become part of the route
+	answer := strings.TrimSpace(string(body))
+	spec := controlPlaceholderHost
+	if answer != "" {
+		spec += "=" + answer
+	}
+	cfg, err := parseRoute(spec)
+	if err != nil {
+		return nil, fmt.Errorf("invalid route '%s': %v", answer, err)
+	}
+	cfg.Host = sni
+	return cfg, nil
+}
+
+// controlSafeSNI reports whether sni may be looked up. SNIs carrying route
+// syntax or whitespace are never valid hostnames, so they are not sent to
+// the control service.
+func controlSafeSNI(sni string) bool {
+	return sni != "" && !strings.ContainsAny(sni, "=,|@") && !strings.ContainsFunc(sni, unicode.IsSpace)
+}
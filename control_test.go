@@ -0,0 +1,121 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// controlService is a mock control service counting the queries per SNI
+type controlService struct {
+	mu      sync.Mutex
+	queries map[string]int
+}
+
+func (s *controlService) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	sni := r.URL.Query().Get("sni")
+	s.mu.Lock()
+	s.queries[sni]++
+	s.mu.Unlock()
+	switch sni {
+	case "known.example.com":
+		w.Write([]byte("10.0.0.1:443,log=summary\n"))
+	case "pass.example.com", "a.example.com=10.6.6.6:443":
+	case "broken.example.com":
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (s *controlService) count(sni string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.queries[sni]
+}
+
+func TestControlClientCachesAnswers(t *testing.T) {
+	fc := useFakeClock(t)
+	svc := &controlService{queries: make(map[string]int)}
+	hs := httptest.NewServer(svc)
+	defer hs.Close()
+	c, err := newControlClient(hs.URL+"/route", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for range 2 {
+		cfg, ok := c.Lookup("known.example.com")
+		if !ok || cfg.Target != "10.0.0.1:443" || cfg.Log != routeLogSummary {
+			t.Fatalf("Lookup(known.example.com) = %+v, %v; want the control service's route", cfg, ok)
+		}
+		if cfg, ok := c.Lookup("pass.example.com"); !ok || !cfg.Passthrough {
+			t.Errorf("Lookup(pass.example.com) = %+v, %v; want passthrough", cfg, ok)
+		}
+		if _, ok := c.Lookup("unknown.example.com"); ok {
+			t.Error("Lookup(unknown.example.com) found a route")
+		}
+		if _, ok := c.Lookup("broken.example.com"); ok {
+			t.Error("Lookup(broken.example.com) found a route")
+		}
+	}
+
+	// Answers, including unknown SNIs, are cached; failures are retried
+	want := map[string]int{"known.example.com": 1, "pass.example.com": 1, "unknown.example.com": 1, "broken.example.com": 2}
+	for sni, n := range want {
+		if got := svc.count(sni); got != n {
+			t.Errorf("%s queried %d times, want %d", sni, got, n)
+		}
+	}
+
+	// Past the TTL the service is asked again
+	fc.Advance(time.Minute)
+	c.Lookup("known.example.com")
+	c.Lookup("unknown.example.com")
+	if got := svc.count("known.example.com"); got != 2 {
+		t.Errorf("known.example.com queried %d times after the TTL, want 2", got)
+	}
+	if got := svc.count("unknown.example.com"); got != 2 {
+		t.Errorf("unknown.example.com queried %d times after the TTL, want 2", got)
+	}
+}
+
+func TestNewControlClientRejectsBadURL(t *testing.T) {
+	for _, u := range []string{"ftp://control.example.com", "control.example.com/route", "http://"} {
+		if _, err := newControlClient(u, time.Minute); err == nil {
+			t.Errorf("newControlClient(%q) succeeded, want an error", u)
+		}
+	}
+}
+
+func TestControlClientIgnoresRouteSyntaxInSNI(t *testing.T) {
+	svc := &controlService{queries: make(map[string]int)}
+	hs := httptest.NewServer(svc)
+	defer hs.Close()
+	c, err := newControlClient(hs.URL+"/route", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// SNIs carrying route syntax are not looked up at all
+	for _, sni := range []string{"a.example.com=10.6.6.6:443", "a.example.com,maxbytes=1", "a.example.com@10.6.6.6:1080", "a.example.com|b", "a.example.com b"} {
+		if cfg, ok := c.Lookup(sni); ok {
+			t.Errorf("Lookup(%q) = %+v, want no route", sni, cfg)
+		}
+		if n := svc.count(sni); n != 0 {
+			t.Errorf("%q sent to the control service %d times", sni, n)
+		}
+	}
+
+	// Even if one reached the service, only its answer is parsed: an empty
+	// answer is passthrough to the SNI, not to the target the client wrote
+	cfg, err := c.fetch("a.example.com=10.6.6.6:443")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cfg.Passthrough || cfg.Target != "" || cfg.Host != "a.example.com=10.6.6.6:443" {
+		t.Errorf("fetch of an SNI with a target = %+v, want passthrough with no target", cfg)
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var errQuotaExceeded = errors.New("byte quota exceeded")
+
+// copyWindow copies src to dst holding at most window bytes in flight. The
+// reader and writer are wrapped so io.CopyBuffer cannot bypass the buffer
+// through ReadFrom or WriteTo.
+func copyWindow(dst io.Writer, src io.Reader, window int) (int64, error) {
+	buf := make([]byte, window)
+	return io.CopyBuffer(struct{ io.Writer }{dst}, struct{ io.Reader }{src}, buf)
+}
+
+// copyBufSizes are the copy buffer sizes a route can select with copybuf
+var copyBufSizes = []int{4 << 10, 16 << 10, 32 << 10, 64 << 10, 256 << 10}
+
+// copyBufPools holds one buffer pool per size, so routes with different
+// buffer sizes never hand each other mismatched buffers
+var copyBufPools = func() map[int]*sync.Pool {
+	pools := make(map[int]*sync.Pool, len(copyBufSizes))
+	for _, size := range copyBufSizes {
+		pools[size] = &sync.Pool{New: func() any {
+			buf := make([]byte, size)
+			return &buf
+		}}
+	}
+	return pools
+}()
+
+// parseCopyBufSize parses a copybuf value such as 64k into one of copyBufSizes
+func parseCopyBufSize(value string) (int, error) {
+	n, err := strconv.Atoi(strings.TrimSuffix(strings.ToLower(value), "k"))
+	if err == nil {
+		if _, ok := copyBufPools[n<<10]; ok {
+			return n << 10, nil
+		}
+	}
+	names := make([]string, len(copyBufSizes))
+	for i, size := range copyBufSizes {
+		names[i] = fmt.Sprintf("%dk", size>>10)
+	}
+	return 0, fmt.Errorf("invalid copybuf option '%s' (use one of %s)", value, strings.Join(names, ", "))
+}
+
+// copyPooled copies src to dst through a pooled buffer of the given size,
+// which must be one of copyBufSizes. Like copyWindow, it hides ReadFrom and
+// WriteTo so the buffer is actually used.
+func copyPooled(dst io.Writer, src io.Reader, size int) (int64, error) {
+	pool := copyBufPools[size]
+	buf := pool.Get().(*[]byte)
+	defer pool.Put(buf)
+	return io.CopyBuffer(struct{ io.Writer }{dst}, struct{ io.Reader }{src}, *buf)
+}
+
+// copyFunc returns the copy the route relays each direction with. A copybuf
+// buffer is used unless -max-inflight is set and smaller, in which case the
+// -max-inflight window applies, so the smaller of the two bounds wins.
+func (c *RouteConfig) copyFunc() func(dst io.Writer, src io.Reader) (int64, error) {
+	switch {
+	case c.CopyBuffer > 0 && (maxInflight == 0 || c.CopyBuffer <= maxInflight):
+		return func(dst io.Writer, src io.Reader) (int64, error) {
+			return copyPooled(dst, src, c.CopyBuffer)
+		}
+	case maxInflight > 0:
+		return func(dst io.Writer, src io.Reader) (int64, error) {
+			return copyWindow(dst, src, maxInflight)
+		}
+	}
+	return io.Copy
+}
+
+// limitSocketBuffers shrinks the kernel socket buffers of conn to window bytes
+// so a stalled peer applies backpressure sooner. Connections that do not
+// expose socket buffers, such as SOCKS-wrapped ones, are left unchanged and
+// logged at debug level, so a skipped setting is not mistaken for an applied one.
+func limitSocketBuffers(conn net.Conn, window int) {
+	sc, ok := conn.(interface {
+		SetReadBuffer(int) error
+		SetWriteBuffer(int) error
+	})
+	if !ok {
+		debugf("Skipped socket buffer tuning for %s: %T does not expose socket options", conn.RemoteAddr(), conn)
+		return
+	}
+	if err := sc.SetReadBuffer(window); err != nil {
+		debugf("Failed to set read buffer for %s: %v", conn.RemoteAddr(), err)
+	}
+	if err := sc.SetWriteBuffer(window); err != nil {
+		debugf("Failed to set write buffer for %s: %v", conn.RemoteAddr(), err)
+	}
+}
+
+// firstReadSize is the buffer for the first read from a backend, which
+// usually holds the ServerHello
+const firstReadSize = 4 << 10
+
+// copyFirstRead waits up to timeout for src's first data and writes it to
+// dst. The deadline is cleared again, so it does not limit the rest of the
+// session, and the caller copies the rest from src itself rather than through
+// a wrapping reader, which would rule out the kernel's zero-copy path.
+func copyFirstRead(dst io.Writer, src net.Conn, timeout time.Duration) (int64, error) {
+	buf := make([]byte, firstReadSize)
+	src.SetReadDeadline(time.Now().Add(timeout))
+	n, err := src.Read(buf)
+	src.SetReadDeadline(time.Time{})
+	if n > 0 {
+		w, werr := dst.Write(buf[:n])
+		if werr != nil {
+			return int64(w), werr
+		}
+	}
+	return int64(n), err
+}
+
+// byteQuota is a per-connection byte limit shared by both copy directions
+type byteQuota struct {
+	limit int64
+	used  atomic.Int64
+}
+
+// quotaWriter writes through to Writer until the shared quota is used up,
+// then writes only what remains and fails with errQuotaExceeded
+type quotaWriter struct {
+	io.Writer
+	q *byteQuota
+}
+
+func (w *quotaWriter) Write(p []byte) (int, error) {
+	// Reserve first so concurrent directions cannot both overshoot
+	over := w.q.used.Add(int64(len(p))) - w.q.limit
+	if over <= 0 {
+		return w.Writer.Write(p)
+	}
+
+	allowed := int64(len(p)) - over
+	if allowed <= 0 {
+		return 0, errQuotaExceeded
+	}
+	n, err := w.Writer.Write(p[:allowed])
+	if err != nil {
+		return n, err
+	}
+	return n, errQuotaExceeded
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"slices"
+	"testing"
+)
+
+// writeRecorder records the size of each write it receives
+type writeRecorder struct {
+	bytes.Buffer
+	writes []int
+}
+
+func (w *writeRecorder) Write(p []byte) (int, error) {
+	w.writes = append(w.writes, len(p))
+	return w.Buffer.Write(p)
+}
+
+// largestWrite returns the size of the largest write w received
+func (w *writeRecorder) largestWrite() int {
+	if len(w.writes) == 0 {
+		return 0
+	}
+	return slices.Max(w.writes)
+}
+
+func TestCopyWindowBoundsInflightBytes(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789"), 10000)
+	for _, window := range []int{1, 1000, 4096} {
+		// bytes.Reader has WriteTo and bytes.Buffer has ReadFrom, either of
+		// which would bypass the window if the copy used them
+		var dst writeRecorder
+		n, err := copyWindow(&dst, bytes.NewReader(data), window)
+		if err != nil || n != int64(len(data)) || !bytes.Equal(dst.Bytes(), data) {
+			t.Fatalf("window %d: copied %d bytes, err %v; want all %d", window, n, err, len(data))
+		}
+		if got := dst.largestWrite(); got > window {
+			t.Errorf("window %d: a single write carried %d bytes", window, got)
+		}
+	}
+}
+
+func TestCopyPooledUsesRouteBufferSize(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789"), 100000)
+	for _, opt := range []string{"4k", "64K", "256k"} {
+		cfg, err := parseRoute("example.com=127.0.0.1:8443,copybuf=" + opt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var dst writeRecorder
+		n, err := copyPooled(&dst, bytes.NewReader(data), cfg.CopyBuffer)
+		if err != nil || n != int64(len(data)) || !bytes.Equal(dst.Bytes(), data) {
+			t.Fatalf("copybuf=%s: copied %d bytes, err %v; want all %d", opt, n, err, len(data))
+		}
+		if got := dst.largestWrite(); got != cfg.CopyBuffer {
+			t.Errorf("copybuf=%s: largest write %d bytes, want the %d byte buffer", opt, got, cfg.CopyBuffer)
+		}
+	}
+
+	for _, opt := range []string{"8k", "64kb", "0"} {
+		if _, err := parseRoute("example.com=127.0.0.1:8443,copybuf=" + opt); err == nil {
+			t.Errorf("copybuf=%s was accepted, want an error", opt)
+		}
+	}
+}
+
+func TestCopyFuncWithMaxInflight(t *testing.T) {
+	defer func(n int) { maxInflight = n }(maxInflight)
+	data := bytes.Repeat([]byte("0123456789"), 100000)
+	tests := []struct {
+		copybuf     string
+		maxInflight int
+		want        int
+	}{
+		{"4k", 0, 4 << 10},
+		{"4k", 16 << 10, 4 << 10},      // The route's smaller buffer is kept
+		{"64k", 16 << 10, 16 << 10},    // -max-inflight caps a larger one
+		{"", 16 << 10, 16 << 10},       // -max-inflight alone
+		{"256k", 256 << 10, 256 << 10}, // Equal sizes use the pooled buffer
+	}
+	for _, tt := range tests {
+		route := "example.com=127.0.0.1:8443"
+		if tt.copybuf != "" {
+			route += ",copybuf=" + tt.copybuf
+		}
+		cfg, err := parseRoute(route)
+		if err != nil {
+			t.Fatal(err)
+		}
+		maxInflight = tt.maxInflight
+		var dst writeRecorder
+		if n, err := cfg.copyFunc()(&dst, bytes.NewReader(data)); err != nil || n != int64(len(data)) {
+			t.Fatalf("copybuf=%s, -max-inflight %d: copied %d bytes, err %v; want all %d", tt.copybuf, tt.maxInflight, n, err, len(data))
+		}
+		if got := dst.largestWrite(); got != tt.want {
+			t.Errorf("copybuf=%s, -max-inflight %d: largest write %d bytes, want %d", tt.copybuf, tt.maxInflight, got, tt.want)
+		}
+	}
+}
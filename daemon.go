@@ -0,0 +1,29 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// writePIDFile writes the current process ID to path
+func writePIDFile(path string) error {
+	if err := os.WriteFile(path, []byte(strconv.Itoa(os.Getpid())+"\n"), 0644); err != nil {
+		return fmt.Errorf("failed to write PID file: %v", err)
+	}
+	return nil
+}
+
+// removePIDFile removes the PID file at path, unless a successor that took
+// over the listener has replaced it with its own
+func removePIDFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err == nil && strings.TrimSpace(string(data)) != strconv.Itoa(os.Getpid()) {
+		return nil
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove PID file: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestPIDFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "proxys.pid")
+	if err := writePIDFile(path); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.TrimSpace(string(data)); got != strconv.Itoa(os.Getpid()) {
+		t.Errorf("PID file holds %q, want %d", got, os.Getpid())
+	}
+
+	if err := removePIDFile(path); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("PID file still there after removal: %v", err)
+	}
+	if err := removePIDFile(path); err != nil {
+		t.Errorf("removing a missing PID file: %v", err)
+	}
+}
+
+func TestPIDFileKeptForSuccessor(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "proxys.pid")
+	if err := os.WriteFile(path, []byte("1\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := removePIDFile(path); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("PID file of the process that took over was removed: %v", err)
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+// backendDialer opens connections to backends and SOCKS proxies. *net.Dialer
+// implements it, as do userspace network stacks such as a WireGuard netstack.
+type backendDialer interface {
+	DialContext(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+// backendDialers are the dialers routes can select with dialer=<name>
+var backendDialers = make(map[string]backendDialer)
+
+// registerBackendDialer makes d available to routes as dialer=name. Builds
+// that reach backends over a userspace tunnel call it from an init function.
+func registerBackendDialer(name string, d backendDialer) {
+	if _, dup := backendDialers[name]; dup {
+		panic("duplicate backend dialer " + name)
+	}
+	backendDialers[name] = d
+}
+
+// baseDialer returns the dialer the route reaches its backend or SOCKS proxy
+// through: the registered dialer it names, or the host network, with TCP
+// Fast Open under -backend-tfo. A nil resolver uses the system resolver.
+func (c *RouteConfig) baseDialer(resolver *net.Resolver) backendDialer {
+	if d, ok := backendDialers[c.Dialer]; ok {
+		return d
+	}
+	d := &net.Dialer{Resolver: resolver}
+	if backendTFO {
+		d.Control = tfoControl
+	}
+	return d
+}
+
+// dialerAdapter gives a backendDialer the Dial method of proxy.Dialer, so a
+// SOCKS proxy can be reached through it
+type dialerAdapter struct {
+	backendDialer
+}
+
+func (d dialerAdapter) Dial(network, addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+// createDialer creates a dialer function that dials through base, optionally
+// via a SOCKS proxy, and gives up after timeout
+func createDialer(socksAddr string, base backendDialer, timeout time.Duration) (func(network, addr string) (net.Conn, error), error) {
+	d := base
+	if socksAddr != "" {
+		if err := checkHostPort(socksAddr); err != nil {
+			return nil, fmt.Errorf("invalid SOCKS proxy address '%s': %v", socksAddr, err)
+		}
+		// Backend names are resolved by the SOCKS proxy; the resolver only applies to the proxy address
+		socksDialer, err := proxy.SOCKS5("tcp", socksAddr, nil, dialerAdapter{base})
+		if err != nil {
+			return nil, fmt.Errorf("failed to create SOCKS5 dialer: %v", err)
+		}
+		d = socksDialer.(proxy.ContextDialer)
+	}
+	return func(network, addr string) (net.Conn, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		return d.DialContext(ctx, network, addr)
+	}, nil
+}
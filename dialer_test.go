@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+// refusingDialer records the addresses it is asked to dial and refuses them
+type refusingDialer struct {
+	mu    sync.Mutex
+	addrs []string
+}
+
+func (d *refusingDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.addrs = append(d.addrs, addr)
+	return nil, errors.New("refused")
+}
+
+func TestCustomDialerPerRoute(t *testing.T) {
+	hello := helloFor(t, "direct.example.com")
+	direct := startAnswerBackend(t, len(hello), "direct")
+	// 192.0.2.1 is unreachable, so only the in-memory dialer can answer
+	addr := serveTest(t, newTestServer(t, "tunnel.example.com=192.0.2.1:443,dialer=pipe", "direct.example.com="+direct))
+
+	for sni, want := range map[string]string{"tunnel.example.com": "ok", "direct.example.com": "direct"} {
+		conn := dialHello(t, addr, helloFor(t, sni))
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		if got, err := io.ReadAll(conn); string(got) != want {
+			t.Errorf("%s: read %q, %v; want %q", sni, got, err, want)
+		}
+	}
+
+	if _, err := parseRoute("example.com=:8080,dialer=no-such-dialer"); err == nil {
+		t.Error("parseRoute with an unregistered dialer succeeded, want an error")
+	}
+}
+
+func TestCustomDialerReachesSOCKSProxy(t *testing.T) {
+	d := &refusingDialer{}
+	dial, err := createDialer("10.0.0.1:1080", d, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dial("tcp", "backend.internal:443"); err == nil {
+		t.Error("dial through a refused SOCKS proxy succeeded")
+	}
+	if want := []string{"10.0.0.1:1080"}; !slices.Equal(d.addrs, want) {
+		t.Errorf("custom dialer was asked for %q, want only the SOCKS proxy %q", d.addrs, want)
+	}
+}
+
+// deadlineDialer records how long each dial had until its deadline and dials
+// the in-memory backend of pipeDialer
+type deadlineDialer struct {
+	mu   sync.Mutex
+	left []time.Duration
+}
+
+func (d *deadlineDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	deadline, _ := ctx.Deadline()
+	d.mu.Lock()
+	d.left = append(d.left, time.Until(deadline))
+	d.mu.Unlock()
+	return pipeDialer{}.DialContext(ctx, network, addr)
+}
+
+func (d *deadlineDialer) last() time.Duration {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.left[len(d.left)-1]
+}
+
+var testDeadlineDialer = &deadlineDialer{}
+
+func init() {
+	registerBackendDialer("deadline", testDeadlineDialer)
+}
+
+func TestRouteDialTimeout(t *testing.T) {
+	addr := serveTest(t, newTestServer(t,
+		"slow.example.com=192.0.2.1:443,dialer=deadline,dialtimeout=45s",
+		"fast.example.com=192.0.2.1:443,dialer=deadline",
+	))
+	tests := []struct {
+		sni  string
+		want time.Duration
+	}{
+		{"slow.example.com", 45 * time.Second},
+		{"fast.example.com", dialTimeout},
+	}
+	for _, tt := range tests {
+		conn := dialHello(t, addr, helloFor(t, tt.sni))
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		if got, err := io.ReadAll(conn); string(got) != "ok" {
+			t.Fatalf("%s: read %q, %v; want the in-memory backend's answer", tt.sni, got, err)
+		}
+		if left := testDeadlineDialer.last(); left > tt.want || left < tt.want-time.Second {
+			t.Errorf("%s: dial had %s until its deadline, want %s", tt.sni, left, tt.want)
+		}
+	}
+
+	for _, v := range []string{"0s", "-1s", "soon"} {
+		if _, err := parseRoute("example.com=:8080,dialtimeout=" + v); err == nil {
+			t.Errorf("parseRoute with dialtimeout=%s succeeded, want an error", v)
+		}
+	}
+}
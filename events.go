@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+const (
+	eventBatchSize     = 100             // Maximum events per webhook POST
+	eventFlushInterval = time.Second     // Maximum time an event waits for a batch to fill
+	eventPostTimeout   = 5 * time.Second // Timeout for a single webhook POST
+)
+
+var eventsDropped = newCounter("events_dropped_total", "Connection events not delivered to the webhook", "reason")
+
+// connEvent describes a connection opening or closing
+type connEvent struct {
+	Type         string    `json:"type"` // "open" or "close"
+	Time         time.Time `json:"time"`
+	SNI          string    `json:"sni"`
+	ClientIP     string    `json:"client_ip"`
+	Backend      string    `json:"backend"`
+	BackendLocal string    `json:"backend_local_addr"`         // Local side of the backend connection, the proxy's when using SOCKS5
+	BytesUp      int64     `json:"bytes_upstream,omitempty"`   // Client to backend
+	BytesDown    int64     `json:"bytes_downstream,omitempty"` // Backend to client
+	Duration     float64   `json:"duration_seconds,omitempty"`
+	Reason       string    `json:"reason,omitempty"` // Why the connection closed: eof, error or quota_exceeded
+	Error        string    `json:"error,omitempty"`  // Error detail when Reason is error
+}
+
+// eventWebhook delivers connection events to an HTTP endpoint in batches.
+// Events are queued without blocking; when the queue is full they are dropped.
+type eventWebhook struct {
+	url    string
+	client *http.Client
+	queue  chan connEvent
+	stop   chan struct{}
+	done   chan struct{}
+}
+
+func newEventWebhook(url string, queueSize int) *eventWebhook {
+	w := &eventWebhook{
+		url:    url,
+		client: &http.Client{Timeout: eventPostTimeout},
+		queue:  make(chan connEvent, queueSize),
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	go w.run()
+	return w
+}
+
+// Send queues ev for delivery, dropping it if the queue is full
+func (w *eventWebhook) Send(ev connEvent) {
+	select {
+	case w.queue <- ev:
+	default:
+		eventsDropped.inc("queue_full")
+	}
+}
+
+// Close flushes queued events and stops delivery
+func (w *eventWebhook) Close() {
+	close(w.stop)
+	<-w.done
+}
+
+func (w *eventWebhook) run() {
+	defer close(w.done)
+
+	batch := make([]connEvent, 0, eventBatchSize)
+	ticker := time.NewTicker(eventFlushInterval)
+	defer ticker.Stop()
+
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := w.post(batch); err != nil {
+			log.Printf("Failed to deliver %d events to webhook: %v", len(batch), err)
+			eventsDropped.add(int64(len(batch)), "post_failed")
+		}
+		batch = batch[:0]
+	}
+
+	for {
+		select {
+		case ev := <-w.queue:
+			batch = append(batch, ev)
+			if len(batch) == eventBatchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		case <-w.stop:
+			for {
+				select {
+				case ev := <-w.queue:
+					batch = append(batch, ev)
+					if len(batch) == eventBatchSize {
+						flush()
+					}
+				default:
+					flush()
+					return
+				}
+			}
+		}
+	}
+}
+
+// post sends a batch of events as a JSON array
+func (w *eventWebhook) post(batch []connEvent) error {
+	body, err := json.Marshal(batch)
+	if err != nil {
+		return err
+	}
+	resp, err := w.client.Post(w.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// eventReceiver collects the events POSTed to a test webhook
+type eventReceiver struct {
+	mu     sync.Mutex
+	events []connEvent
+}
+
+func (r *eventReceiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	var batch []connEvent
+	if err := json.NewDecoder(req.Body).Decode(&batch); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	r.mu.Lock()
+	r.events = append(r.events, batch...)
+	r.mu.Unlock()
+}
+
+func (r *eventReceiver) received() []connEvent {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]connEvent(nil), r.events...)
+}
+
+func TestCloseEventCarriesCopyError(t *testing.T) {
+	recv := &eventReceiver{}
+	hook := httptest.NewServer(recv)
+	defer hook.Close()
+
+	stalled := make(chan struct{})
+	defer close(stalled)
+	backend := startBackend(t, func(c net.Conn) {
+		<-stalled
+		c.Close()
+	})
+	srv := newTestServer(t, "example.com="+backend+",firstbyte=50ms")
+	srv.events = newEventWebhook(hook.URL, 16)
+	addr := serveTest(t, srv)
+
+	conn := dialHello(t, addr, helloFor(t, "example.com"))
+	if !waitClosed(conn, 2*time.Second) {
+		t.Fatal("connection was not closed")
+	}
+	// The connection is listed until after its close event is sent
+	waitFor(2*time.Second, func() bool { return len(srv.live.Snapshot()) == 0 })
+	srv.events.Close()
+
+	var closed *connEvent
+	for _, ev := range recv.received() {
+		if ev.Type == "close" {
+			closed = &ev
+		}
+	}
+	if closed == nil {
+		t.Fatalf("no close event among %+v", recv.received())
+	}
+	if closed.Reason != "error" || !strings.Contains(closed.Error, "sent no data within 50ms") {
+		t.Errorf("close event reason %q, error %q; want error with the first byte timeout", closed.Reason, closed.Error)
+	}
+}
+
+func TestOpenAndCloseEventsDelivered(t *testing.T) {
+	recv := &eventReceiver{}
+	hook := httptest.NewServer(recv)
+	defer hook.Close()
+
+	hello := helloFor(t, "example.com")
+	backend := startAnswerBackend(t, len(hello), "answer")
+	srv := newTestServer(t, "example.com="+backend)
+	srv.events = newEventWebhook(hook.URL, 16)
+	addr := serveTest(t, srv)
+
+	conn := dialHello(t, addr, hello)
+	if !waitClosed(conn, 2*time.Second) {
+		t.Fatal("connection was not closed")
+	}
+	waitFor(2*time.Second, func() bool { return len(srv.live.Snapshot()) == 0 })
+	srv.events.Close()
+
+	events := recv.received()
+	if len(events) != 2 || events[0].Type != "open" || events[1].Type != "close" {
+		t.Fatalf("received %+v, want an open and a close event", events)
+	}
+	for _, ev := range events {
+		if ev.SNI != "example.com" || ev.Backend != backend || ev.ClientIP != "127.0.0.1" || ev.BackendLocal == "" {
+			t.Errorf("%s event = %+v, want the connection's SNI, client, backend and local address", ev.Type, ev)
+		}
+	}
+	if closed := events[1]; closed.Reason != "eof" || closed.BytesUp != int64(len(hello)) || closed.BytesDown != int64(len("answer")) {
+		t.Errorf("close event = %+v, want eof with %d bytes up and %d down", closed, len(hello), len("answer"))
+	}
+}
+
+func TestEventQueueOverflowDoesNotBlock(t *testing.T) {
+	// A webhook that never answers keeps the sender stuck on its first POST
+	stuck := make(chan struct{})
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { <-stuck }))
+	defer hook.Close()
+	defer close(stuck)
+
+	w := newEventWebhook(hook.URL, 4)
+	before := eventsDropped.with("queue_full").Load()
+	done := make(chan struct{})
+	go func() {
+		for range 1000 {
+			w.Send(connEvent{Type: "open", SNI: "example.com"})
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Send blocked on a full queue")
+	}
+	if dropped := eventsDropped.with("queue_full").Load() - before; dropped < 1000-4-eventBatchSize {
+		t.Errorf("%d events dropped, want all beyond the queue and one batch", dropped)
+	}
+}
@@ -0,0 +1,32 @@
+package main
+
+import "fmt"
+
+// Client attributes -geoip-label can partition metrics by
+const (
+	geoLabelCountry = "country" // ISO 3166 country code, a few hundred values at most
+	geoLabelASN     = "asn"     // Autonomous system number, tens of thousands of values
+)
+
+// geoUnknown labels client IPs the GeoIP database has no entry for
+const geoUnknown = "unknown"
+
+var (
+	geoConns = newCounter("geo_connections_total", "Connections accepted, by the client's -geoip-label value", "geo")
+	geoBytes = newCounter("geo_bytes_transferred_total", "Bytes relayed between clients and backends, by the client's -geoip-label value", "geo", "direction")
+)
+
+// geoDB labels client IPs from a GeoIP database. It stays open for the life
+// of the process, since connections outliving the drain may still look up.
+type geoDB interface {
+	// Label returns the client's country code or ASN, or geoUnknown
+	Label(ip string) string
+}
+
+func validateGeoLabel(label string) error {
+	switch label {
+	case geoLabelCountry, geoLabelASN:
+		return nil
+	}
+	return fmt.Errorf("unknown GeoIP label '%s' (use %s or %s)", label, geoLabelCountry, geoLabelASN)
+}
@@ -0,0 +1,55 @@
+//go:build geoip
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// geoipSupported reports whether this build can read -geoip-db
+const geoipSupported = true
+
+// maxmindDB labels client IPs from a MaxMind database: a Country or City
+// database for country labels, an ASN database for ASN labels
+type maxmindDB struct {
+	r     *maxminddb.Reader
+	label string
+}
+
+// maxmindRecord holds the fields of a MaxMind record used for labels
+type maxmindRecord struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	ASN uint `maxminddb:"autonomous_system_number"`
+}
+
+func openGeoDB(path, label string) (geoDB, error) {
+	r, err := maxminddb.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open GeoIP database '%s': %v", path, err)
+	}
+	return &maxmindDB{r: r, label: label}, nil
+}
+
+func (db *maxmindDB) Label(ip string) string {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return geoUnknown
+	}
+	var rec maxmindRecord
+	if err := db.r.Lookup(addr, &rec); err != nil {
+		return geoUnknown
+	}
+	switch {
+	case db.label == geoLabelASN && rec.ASN != 0:
+		return "AS" + strconv.FormatUint(uint64(rec.ASN), 10)
+	case db.label == geoLabelCountry && rec.Country.ISOCode != "":
+		return rec.Country.ISOCode
+	}
+	return geoUnknown
+}
@@ -0,0 +1,179 @@
+//go:build geoip
+
+package main
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// mmdbValue encodes v in the MaxMind DB data section format. Only the types
+// test records need are supported: strings, unsigned integers, maps and
+// arrays.
+func mmdbValue(v any) []byte {
+	switch v := v.(type) {
+	case string:
+		return append([]byte{2<<5 | byte(len(v))}, v...)
+	case uint16:
+		return mmdbUint(5, uint64(v))
+	case uint32:
+		return mmdbUint(6, uint64(v))
+	case uint64:
+		return mmdbUint(9, v)
+	case map[string]any:
+		b := []byte{7<<5 | byte(len(v))}
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		slices.Sort(keys)
+		for _, k := range keys {
+			b = append(b, mmdbValue(k)...)
+			b = append(b, mmdbValue(v[k])...)
+		}
+		return b
+	case []any:
+		b := []byte{byte(len(v)), 11 - 7}
+		for _, e := range v {
+			b = append(b, mmdbValue(e)...)
+		}
+		return b
+	}
+	panic("unsupported MaxMind DB value")
+}
+
+func mmdbUint(typ byte, n uint64) []byte {
+	var digits []byte
+	for ; n > 0; n >>= 8 {
+		digits = append([]byte{byte(n)}, digits...)
+	}
+	if typ > 7 {
+		return append([]byte{byte(len(digits)), typ - 7}, digits...)
+	}
+	return append([]byte{typ<<5 | byte(len(digits))}, digits...)
+}
+
+// writeTestGeoDB writes an IPv4 MaxMind DB holding record for the addresses
+// in prefix and nothing else, and returns its path
+func writeTestGeoDB(t *testing.T, prefix netip.Prefix, record map[string]any) string {
+	t.Helper()
+
+	// One node per prefix bit: the bit's side leads on, the other side to
+	// "no data", which is the node count
+	bits := prefix.Bits()
+	nodes := uint32(bits)
+	addr := prefix.Addr().As4()
+	var tree []byte
+	for i := range bits {
+		next := uint32(i + 1)
+		if i == bits-1 {
+			next = nodes + 16 // The record, at the start of the data section
+		}
+		left, right := next, nodes
+		if addr[i/8]>>(7-i%8)&1 == 1 {
+			left, right = nodes, next
+		}
+		tree = append(tree, byte(left>>16), byte(left>>8), byte(left), byte(right>>16), byte(right>>8), byte(right))
+	}
+
+	var db bytes.Buffer
+	db.Write(tree)
+	db.Write(make([]byte, 16))
+	db.Write(mmdbValue(record))
+	db.WriteString("\xab\xcd\xefMaxMind.com")
+	db.Write(mmdbValue(map[string]any{
+		"binary_format_major_version": uint16(2),
+		"binary_format_minor_version": uint16(0),
+		"build_epoch":                 uint64(time.Now().Unix()),
+		"database_type":               "proxys-Test",
+		"description":                 map[string]any{"en": "proxys test database"},
+		"ip_version":                  uint16(4),
+		"languages":                   []any{"en"},
+		"node_count":                  nodes,
+		"record_size":                 uint16(24),
+	}))
+
+	path := filepath.Join(t.TempDir(), "test.mmdb")
+	if err := os.WriteFile(path, db.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// testGeoRecord is the record of the test database, for loopback clients
+var testGeoRecord = map[string]any{
+	"country":                  map[string]any{"iso_code": "ZZ"},
+	"autonomous_system_number": uint32(64512),
+}
+
+func TestMaxmindDBLabels(t *testing.T) {
+	path := writeTestGeoDB(t, netip.MustParsePrefix("127.0.0.0/8"), testGeoRecord)
+	tests := []struct {
+		label string
+		ip    string
+		want  string
+	}{
+		{geoLabelCountry, "127.0.0.1", "ZZ"},
+		{geoLabelCountry, "127.255.0.9", "ZZ"},
+		{geoLabelCountry, "192.0.2.1", geoUnknown},
+		{geoLabelCountry, "::1", geoUnknown},
+		{geoLabelCountry, "not an address", geoUnknown},
+		{geoLabelASN, "127.0.0.1", "AS64512"},
+		{geoLabelASN, "192.0.2.1", geoUnknown},
+	}
+	for _, tt := range tests {
+		db, err := openGeoDB(path, tt.label)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := db.Label(tt.ip); got != tt.want {
+			t.Errorf("%s label of %s = %q, want %q", tt.label, tt.ip, got, tt.want)
+		}
+	}
+}
+
+func TestGeoLabelsConnectionMetrics(t *testing.T) {
+	db, err := openGeoDB(writeTestGeoDB(t, netip.MustParsePrefix("127.0.0.0/8"), testGeoRecord), geoLabelCountry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logs := captureLog(t)
+
+	hello := helloFor(t, "example.com")
+	backend := startBackend(t, func(c net.Conn) {
+		defer c.Close()
+		io.ReadFull(c, make([]byte, len(hello)))
+		c.Write([]byte("ok"))
+	})
+	srv := newTestServer(t, "example.com="+backend)
+	srv.geo = db
+	addr := serveTest(t, srv)
+
+	conns := geoConns.with("ZZ").Load()
+	down := geoBytes.with("ZZ", "downstream").Load()
+	conn := dialHello(t, addr, hello)
+	if !waitClosed(conn, 2*time.Second) {
+		t.Fatal("connection was not closed after the backend closed")
+	}
+	if !waitFor(2*time.Second, func() bool { return strings.Contains(logs.String(), "example.com closed after") }) {
+		t.Fatalf("no close log line:\n%s", logs.String())
+	}
+
+	if got := geoConns.with("ZZ").Load() - conns; got != 1 {
+		t.Errorf("geo_connections_total{geo=\"ZZ\"} rose by %d, want 1", got)
+	}
+	if got := geoBytes.with("ZZ", "downstream").Load() - down; got != 2 {
+		t.Errorf("geo_bytes_transferred_total{geo=\"ZZ\",direction=\"downstream\"} rose by %d, want 2", got)
+	}
+	if out := logs.String(); !strings.Contains(out, ", client in ZZ") {
+		t.Errorf("close log line does not name the client's country:\n%s", out)
+	}
+}
@@ -0,0 +1,12 @@
+//go:build !geoip
+
+package main
+
+import "fmt"
+
+// geoipSupported reports whether this build can read -geoip-db
+const geoipSupported = false
+
+func openGeoDB(path, label string) (geoDB, error) {
+	return nil, fmt.Errorf("GeoIP support is not built in (build with -tags geoip)")
+}
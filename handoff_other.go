@@ -0,0 +1,16 @@
+//go:build !unix
+
+package main
+
+import (
+	"fmt"
+	"net"
+)
+
+func receiveListener(path string) (net.Listener, error) {
+	return nil, fmt.Errorf("listener handoff is not supported on this platform")
+}
+
+func serveHandoff(path string, l net.Listener, done func()) error {
+	return fmt.Errorf("listener handoff is not supported on this platform")
+}
@@ -0,0 +1,107 @@
+//go:build unix
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"syscall"
+	"time"
+)
+
+// handoffTimeout bounds receiving a listener from the previous process
+const handoffTimeout = 5 * time.Second
+
+// receiveListener takes over the listener of the process serving the handoff
+// socket at path. It returns nil if no process is serving it.
+func receiveListener(path string) (net.Listener, error) {
+	conn, err := net.DialTimeout("unix", path, handoffTimeout)
+	if errors.Is(err, syscall.ENOENT) || errors.Is(err, syscall.ECONNREFUSED) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to handoff socket '%s': %v", path, err)
+	}
+	defer conn.Close()
+	uc := conn.(*net.UnixConn)
+	uc.SetDeadline(time.Now().Add(handoffTimeout))
+
+	oob := make([]byte, syscall.CmsgSpace(4))
+	_, oobn, _, _, err := uc.ReadMsgUnix(make([]byte, 1), oob)
+	if err != nil {
+		return nil, fmt.Errorf("failed to receive listener over '%s': %v", path, err)
+	}
+	msgs, err := syscall.ParseSocketControlMessage(oob[:oobn])
+	if err != nil || len(msgs) != 1 {
+		return nil, fmt.Errorf("no listener received over '%s'", path)
+	}
+	fds, err := syscall.ParseUnixRights(&msgs[0])
+	if err != nil || len(fds) != 1 {
+		return nil, fmt.Errorf("no listener received over '%s'", path)
+	}
+
+	f := os.NewFile(uintptr(fds[0]), "handoff-listener")
+	defer f.Close()
+	l, err := net.FileListener(f)
+	if err != nil {
+		return nil, fmt.Errorf("failed to use listener received over '%s': %v", path, err)
+	}
+	return l, nil
+}
+
+// serveHandoff listens on the handoff socket at path. When a new process
+// connects, it is passed l and done is called, so this process stops
+// accepting and drains while the new one accepts on the same socket.
+func serveHandoff(path string, l net.Listener, done func()) error {
+	sc, ok := l.(syscall.Conn)
+	if !ok {
+		return fmt.Errorf("listener on %s cannot be handed off", l.Addr())
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return fmt.Errorf("listener on %s cannot be handed off: %v", l.Addr(), err)
+	}
+
+	// A predecessor leaves its socket file behind for this process to replace
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove old handoff socket '%s': %v", path, err)
+	}
+	ul, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		return fmt.Errorf("failed to listen on handoff socket '%s': %v", path, err)
+	}
+	if err := os.Chmod(path, 0o600); err != nil {
+		ul.Close()
+		return fmt.Errorf("failed to restrict handoff socket '%s': %v", path, err)
+	}
+	ul.SetUnlinkOnClose(false) // The successor replaces the file
+
+	go func() {
+		defer ul.Close()
+		for {
+			conn, err := ul.AcceptUnix()
+			if err != nil {
+				return
+			}
+			var sendErr error
+			err = raw.Control(func(fd uintptr) {
+				_, _, sendErr = conn.WriteMsgUnix([]byte{0}, syscall.UnixRights(int(fd)), nil)
+			})
+			conn.Close()
+			if err == nil {
+				err = sendErr
+			}
+			if err != nil {
+				log.Printf("Failed to hand off listener %s: %v", l.Addr(), err)
+				continue
+			}
+			log.Printf("Handed off listener %s to a new process, draining connections", l.Addr())
+			done()
+			return
+		}
+	}()
+	return nil
+}
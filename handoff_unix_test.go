@@ -0,0 +1,63 @@
+//go:build unix
+
+package main
+
+import (
+	"io"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestListenerHandoff(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "handoff.sock")
+	if l, err := receiveListener(path); l != nil || err != nil {
+		t.Fatalf("receiveListener without a predecessor = %v, %v; want nil, nil", l, err)
+	}
+
+	hello := helloFor(t, "example.com")
+	old := newTestServer(t, "example.com="+startAnswerBackend(t, len(hello), "old"))
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	addr := l.Addr().String()
+	go old.serve(l)
+
+	handedOff := make(chan struct{})
+	if err := serveHandoff(path, l, func() { close(handedOff) }); err != nil {
+		t.Fatal(err)
+	}
+	read := func() string {
+		conn := dialHello(t, addr, hello)
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		b, _ := io.ReadAll(conn)
+		return string(b)
+	}
+	if got := read(); got != "old" {
+		t.Fatalf("before the handoff the client got %q, want %q", got, "old")
+	}
+
+	// The new server takes over the same socket and the old one stops
+	// accepting on it
+	nl, err := receiveListener(path)
+	if err != nil || nl == nil {
+		t.Fatalf("receiveListener = %v, %v; want the old server's listener", nl, err)
+	}
+	defer nl.Close()
+	select {
+	case <-handedOff:
+	case <-time.After(2 * time.Second):
+		t.Fatal("the old server was not told about the handoff")
+	}
+	l.Close()
+	if nl.Addr().String() != addr {
+		t.Errorf("received listener on %s, want %s", nl.Addr(), addr)
+	}
+	go newTestServer(t, "example.com="+startAnswerBackend(t, len(hello), "new")).serve(nl)
+	if got := read(); got != "new" {
+		t.Errorf("after the handoff the client got %q, want %q", got, "new")
+	}
+}
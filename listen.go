@@ -0,0 +1,42 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"syscall"
+	"time"
+)
+
+// bindRetryInterval is the pause between bind attempts under -bind-retry
+const bindRetryInterval = 250 * time.Millisecond
+
+// listenRetry binds addr, retrying for up to retry while the address is in
+// use, e.g. by a predecessor that is still shutting down. A bind that keeps
+// failing because the address is taken gets an explanatory error.
+func listenRetry(network, addr string, retry time.Duration) (net.Listener, error) {
+	deadline := time.Now().Add(retry)
+	for attempt := 1; ; attempt++ {
+		l, err := net.Listen(network, addr)
+		if err == nil {
+			if attempt > 1 {
+				log.Printf("Bound %s after %d attempts", addr, attempt)
+			}
+			return l, nil
+		}
+		if !errors.Is(err, syscall.EADDRINUSE) {
+			return nil, err
+		}
+		if time.Now().Add(bindRetryInterval).After(deadline) {
+			if retry > 0 {
+				return nil, fmt.Errorf("address %s is still in use after retrying for %s; check for another proxys instance or service on that port: %v", addr, retry, err)
+			}
+			return nil, fmt.Errorf("address %s is already in use; check for another proxys instance or service on that port, or use -bind-retry to wait for one that is exiting: %v", addr, err)
+		}
+		if attempt == 1 {
+			log.Printf("Address %s is in use, retrying for up to %s", addr, retry)
+		}
+		time.Sleep(bindRetryInterval)
+	}
+}
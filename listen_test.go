@@ -0,0 +1,65 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestListenRetryNetwork(t *testing.T) {
+	l, err := listenRetry("tcp4", "127.0.0.1:0", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+
+	// An IPv4 address cannot be bound as tcp6, so the network must reach the bind
+	if l, err := listenRetry("tcp6", "127.0.0.1:0", 0); err == nil {
+		l.Close()
+		t.Error("listenRetry bound an IPv4 address with -listen-network tcp6")
+	}
+}
+
+func TestValidateNetwork(t *testing.T) {
+	for _, network := range []string{"tcp", "tcp4", "tcp6"} {
+		if err := validateNetwork(network); err != nil {
+			t.Errorf("validateNetwork(%s): %v", network, err)
+		}
+	}
+	for _, network := range []string{"", "udp", "unix", "tcp5"} {
+		if err := validateNetwork(network); err == nil {
+			t.Errorf("validateNetwork(%q) succeeded, want an error", network)
+		}
+	}
+}
+
+func TestListenRetryAddressInUse(t *testing.T) {
+	logs := captureLog(t)
+	held, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := held.Addr().String()
+
+	// Without -bind-retry the error explains the conflict at once
+	if _, err := listenRetry("tcp", addr, 0); err == nil || !strings.Contains(err.Error(), "address "+addr+" is already in use; check for another proxys instance") {
+		t.Errorf("listenRetry of a taken address = %v, want an explanation", err)
+	}
+
+	// A retry window that ends before the address frees up says so
+	if _, err := listenRetry("tcp", addr, 2*bindRetryInterval); err == nil || !strings.Contains(err.Error(), "is still in use after retrying for 500ms") {
+		t.Errorf("listenRetry with a short window = %v, want it to report the retry", err)
+	}
+
+	// The bind succeeds once a predecessor lets go within the window
+	time.AfterFunc(2*bindRetryInterval, func() { held.Close() })
+	l, err := listenRetry("tcp", addr, 10*time.Second)
+	if err != nil {
+		t.Fatalf("listenRetry while the address frees up: %v", err)
+	}
+	l.Close()
+	if out := logs.String(); !strings.Contains(out, "Address "+addr+" is in use, retrying for up to 10s") || !strings.Contains(out, "Bound "+addr+" after") {
+		t.Errorf("retry log:\n%s\nwant the wait and the eventual bind", out)
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"io"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// liveConn is a connection relaying to a backend, as listed by GET /connections
+type liveConn struct {
+	id       uint64
+	clientIP string
+	sni      string
+	backend  string
+	start    time.Time
+	up, down atomic.Int64 // Bytes relayed so far; live only with -live-stats
+}
+
+// liveConns tracks the connections currently relaying to a backend
+type liveConns struct {
+	mu    sync.Mutex
+	conns map[uint64]*liveConn
+}
+
+func newLiveConns() *liveConns {
+	return &liveConns{conns: make(map[uint64]*liveConn)}
+}
+
+// Add registers c until Remove is called with its id
+func (l *liveConns) Add(c *liveConn) {
+	l.mu.Lock()
+	l.conns[c.id] = c
+	l.mu.Unlock()
+}
+
+// Remove unregisters the connection with id
+func (l *liveConns) Remove(id uint64) {
+	l.mu.Lock()
+	delete(l.conns, id)
+	l.mu.Unlock()
+}
+
+// liveConnStatus is the JSON form of a liveConn
+type liveConnStatus struct {
+	ID              uint64    `json:"id"`
+	ClientIP        string    `json:"client_ip"`
+	SNI             string    `json:"sni"`
+	Backend         string    `json:"backend"`
+	Start           time.Time `json:"start"`
+	DurationSeconds float64   `json:"duration_seconds"`
+	BytesUpstream   int64     `json:"bytes_upstream"`
+	BytesDownstream int64     `json:"bytes_downstream"`
+}
+
+// Snapshot returns the status of every tracked connection, oldest first
+func (l *liveConns) Snapshot() []liveConnStatus {
+	l.mu.Lock()
+	statuses := make([]liveConnStatus, 0, len(l.conns))
+	for _, c := range l.conns {
+		statuses = append(statuses, liveConnStatus{
+			ID:              c.id,
+			ClientIP:        c.clientIP,
+			SNI:             c.sni,
+			Backend:         c.backend,
+			Start:           c.start,
+			DurationSeconds: clk.Since(c.start).Seconds(),
+			BytesUpstream:   c.up.Load(),
+			BytesDownstream: c.down.Load(),
+		})
+	}
+	l.mu.Unlock()
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].ID < statuses[j].ID })
+	return statuses
+}
+
+// liveWriter adds the length of every write to n as it happens, so other
+// goroutines can watch a copy in progress
+type liveWriter struct {
+	io.Writer
+	n *atomic.Int64
+}
+
+func (w liveWriter) Write(p []byte) (int, error) {
+	n, err := w.Writer.Write(p)
+	w.n.Add(int64(n))
+	return n, err
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// logLevel is the global log verbosity: "info" or "debug"
+var logLevel string
+
+// validateLogLevel checks that level is a supported log level
+func validateLogLevel(level string) error {
+	switch level {
+	case "info", "debug":
+		return nil
+	}
+	return fmt.Errorf("invalid log level '%s' (use info or debug)", level)
+}
+
+// debugf logs only when the log level is debug
+func debugf(format string, v ...any) {
+	if logLevel == "debug" {
+		log.Printf(format, v...)
+	}
+}
+
+// formatVersions renders TLS protocol versions as human-readable names
+func formatVersions(versions []uint16) string {
+	names := make([]string, len(versions))
+	for i, v := range versions {
+		names[i] = tls.VersionName(v)
+	}
+	return "[" + strings.Join(names, " ") + "]"
+}
+
+// sampler admits the first of every n events
+type sampler struct {
+	n     uint64
+	count atomic.Uint64
+}
+
+// parseSampleRate parses a sampling rate of the form 1/N
+func parseSampleRate(rate string) (*sampler, error) {
+	num, den, ok := strings.Cut(rate, "/")
+	if !ok || strings.TrimSpace(num) != "1" {
+		return nil, fmt.Errorf("invalid sample rate '%s' (use 1/N)", rate)
+	}
+	n, err := strconv.ParseUint(strings.TrimSpace(den), 10, 64)
+	if err != nil || n == 0 {
+		return nil, fmt.Errorf("invalid sample rate '%s' (use 1/N)", rate)
+	}
+	return &sampler{n: n}, nil
+}
+
+// Sample records an event and reports whether it should be logged
+func (s *sampler) Sample() bool {
+	return (s.count.Add(1)-1)%s.n == 0
+}
+
+// logSummaryInterval is how long a rate-limited route collects suppressed
+// lines before reporting them
+const logSummaryInterval = 10 * time.Second
+
+// rateLimiter admits up to limit lines per second for one route. Suppressed
+// lines are counted and reported in one summary line per logSummaryInterval.
+type rateLimiter struct {
+	host  string
+	limit int
+
+	mu         sync.Mutex
+	window     time.Time // Start of the current one-second window
+	admitted   int       // Lines admitted in the current window
+	suppressed int       // Lines suppressed since the last summary
+}
+
+// Allow records a line and reports whether it should be logged
+func (r *rateLimiter) Allow() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if now := clk.Now(); now.Sub(r.window) >= time.Second {
+		r.window = now
+		r.admitted = 0
+	}
+	if r.admitted < r.limit {
+		r.admitted++
+		return true
+	}
+	if r.suppressed == 0 {
+		clk.AfterFunc(logSummaryInterval, r.summarize)
+	}
+	r.suppressed++
+	return false
+}
+
+// summarize logs and resets the suppressed line count
+func (r *rateLimiter) summarize() {
+	r.mu.Lock()
+	n := r.suppressed
+	r.suppressed = 0
+	r.mu.Unlock()
+	log.Printf("Suppressed %d routing log lines for %s in the last %s (logratelimit=%d)", n, r.host, logSummaryInterval, r.limit)
+}
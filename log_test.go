@@ -0,0 +1,39 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseSampleRate(t *testing.T) {
+	for _, rate := range []string{"1/1", "1/10", " 1 / 100 "} {
+		if _, err := parseSampleRate(rate); err != nil {
+			t.Errorf("parseSampleRate(%q): %v", rate, err)
+		}
+	}
+	for _, rate := range []string{"", "10", "2/10", "1/0", "1/x", "1/-1"} {
+		if _, err := parseSampleRate(rate); err == nil {
+			t.Errorf("parseSampleRate(%q) succeeded, want an error", rate)
+		}
+	}
+}
+
+func TestRejectLogSampling(t *testing.T) {
+	logs := captureLog(t)
+	srv := newTestServer(t)
+	var err error
+	if srv.rejects, err = parseSampleRate("1/10"); err != nil {
+		t.Fatal(err)
+	}
+
+	before := connsRejected.with(rejectPolicy, "unconfigured").Load()
+	for range 100 {
+		srv.reject(rejectPolicy, "unconfigured", "connection to unconfigured host %s", "example.com")
+	}
+	if got := connsRejected.with(rejectPolicy, "unconfigured").Load() - before; got != 100 {
+		t.Errorf("connections_rejected_total rose by %d, want all 100 rejections", got)
+	}
+	if got := strings.Count(logs.String(), "Rejected [policy/unconfigured]"); got != 10 {
+		t.Errorf("%d of 100 rejections logged at 1/10, want 10", got)
+	}
+}
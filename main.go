@@ -1,289 +1,2317 @@
 package main
 
 import (
-	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
 	"encoding/binary"
+	"encoding/hex"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"log"
 	"net"
+	"net/netip"
+	"os"
+	"os/signal"
+	"regexp"
+	"runtime/debug"
+	"slices"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
-
-	"golang.org/x/net/proxy"
 )
 
-type routeFlags []string
+// listFlags collects the values of a flag that may be repeated
+type listFlags []string
 
-func (r *routeFlags) String() string {
+func (r *listFlags) String() string {
 	return strings.Join(*r, ",")
 }
 
-func (r *routeFlags) Set(value string) error {
+func (r *listFlags) Set(value string) error {
 	*r = append(*r, value)
 	return nil
 }
 
 // RouteConfig represents a single routing rule
 type RouteConfig struct {
-	Host        string // SNI hostname to match
-	Target      string // Backend target (empty for passthrough)
-	Passthrough bool   // If true, connect to Host:443
-	ProxyAddr   string // SOCKS5 proxy for this route (optional)
+	Host        string `json:"host"`                 // SNI hostname to match
+	Target      string `json:"target,omitempty"`     // Backend target (empty for passthrough)
+	Passthrough bool   `json:"passthrough"`          // If true, connect to Host:443 (or PassthroughPort)
+	ProxyAddr   string `json:"proxy_addr,omitempty"` // SOCKS5 proxy for this route (optional)
+	Log         string `json:"log"`                  // Per-connection logging: off, summary or full
+	Upstream    string `json:"upstream,omitempty"`   // Upstream pool to pick the backend from (optional)
+
+	FirstByteTimeout time.Duration `json:"first_byte_timeout,omitempty"`   // Max wait for the backend's first byte (0 disables)
+	MaxBytes         int64         `json:"max_bytes,omitempty"`            // Max bytes per connection, both directions (0 disables)
+	CopyBuffer       int           `json:"copy_buffer,omitempty"`          // Pooled copy buffer size (0 uses the default copy)
+	Fallbacks        []string      `json:"fallbacks,omitempty"`            // Targets dialed in order when Target fails
+	ProxyWindow      *timeWindow   `json:"proxy_window,omitempty"`         // Local time of day to use ProxyAddr; direct otherwise (nil: always)
+	MaxDials         int           `json:"max_dial_concurrency,omitempty"` // Max backend dials in progress at once (0 disables)
+	NoALPN           bool          `json:"no_alpn,omitempty"`              // Only match ClientHellos without an ALPN extension
+	NoReplay         bool          `json:"no_replay,omitempty"`            // Debugging: drop the ClientHello instead of replaying it
+	LogRateLimit     int           `json:"log_rate_limit,omitempty"`       // Max routing log lines per second (0 disables)
+	Reject           bool          `json:"reject,omitempty"`               // Explicitly blocked: connections are dropped
+	Priority         int           `json:"priority,omitempty"`             // Overrides match precedence; highest wins (default 0)
+	ExtraProxies     []string      `json:"extra_proxies,omitempty"`        // SOCKS5 proxies shared with ProxyAddr, picked per connection
+	ProxySelect      string        `json:"proxy_select,omitempty"`         // How to pick among several proxies: roundrobin or latency
+	DialTimeout      time.Duration `json:"dial_timeout,omitempty"`         // Overrides -dial-timeout for this route (0 uses the flag)
+	Dialer           string        `json:"dialer,omitempty"`               // Registered backend dialer to use instead of the network (optional)
+	PassthroughPort  int           `json:"passthrough_port,omitempty"`     // Port passthrough dials instead of 443 (0 uses 443)
+	Maintenance      string        `json:"maintenance,omitempty"`          // TLS alert answering every connection instead of the backend (empty: serving)
+
+	Pattern  *regexp.Regexp `json:"-"` // Compiled SNI pattern for ~regex routes (nil for exact hosts)
+	HashSalt string         `json:"-"` // Salt of a sha256: hashed host (empty for plaintext hosts)
+
+	dialSlots chan struct{}  // Semaphore of MaxDials slots (nil when unlimited)
+	logLimit  *rateLimiter   // Limiter for LogRateLimit (nil when unlimited)
+	proxyNext *atomic.Uint64 // Round-robin position over the proxies (nil with a single proxy)
 }
 
-// RouteMap stores all routing rules
+// routePatternPrefix marks a route host as a regular expression
+const routePatternPrefix = "~"
+
+// routeSuffixPrefix marks a route host as a domain suffix: .example.com
+// matches every subdomain of example.com, but not example.com itself
+const routeSuffixPrefix = "."
+
+// routeRejectTarget is the target of routes that block their host
+const routeRejectTarget = "reject"
+
+// routeDefaultHost is the host of the default route, used for SNIs no other
+// route matches
+const routeDefaultHost = "*"
+
+// routeHashPrefix marks a route host as a salted SHA-256 of the hostname,
+// written sha256:<salt>:<hex>
+const routeHashPrefix = "sha256:"
+
+// hashHost returns the hashed route host matching host under salt
+func hashHost(salt, host string) string {
+	sum := sha256.Sum256([]byte(salt + host))
+	return routeHashPrefix + salt + ":" + hex.EncodeToString(sum[:])
+}
+
+// templateRef matches capture group references ($1, ${1}, $name, ${name}) in a target
+var templateRef = regexp.MustCompile(`\$(\$|\w+|\{\w+\})`)
+
+// String renders the route in -route syntax; parsing the result yields an
+// identical route
+func (c *RouteConfig) String() string {
+	var b strings.Builder
+	b.WriteString(c.Host)
+	if c.Reject {
+		b.WriteString("=" + routeRejectTarget)
+	}
+	if c.Target != "" {
+		b.WriteString("=" + strings.Join(append([]string{c.Target}, c.Fallbacks...), "|"))
+	}
+	if c.ProxyAddr != "" {
+		b.WriteString("@" + strings.Join(c.proxies(), "|"))
+	}
+	if c.Log != routeLogFull {
+		b.WriteString(",log=" + c.Log)
+	}
+	if c.Upstream != "" {
+		b.WriteString(",upstream=" + c.Upstream)
+	}
+	if c.ProxyWindow != nil {
+		b.WriteString(",proxywindow=" + c.ProxyWindow.String())
+	}
+	if c.ProxySelect == proxySelectLatency {
+		b.WriteString(",proxyselect=" + c.ProxySelect)
+	}
+	if c.CopyBuffer > 0 {
+		fmt.Fprintf(&b, ",copybuf=%dk", c.CopyBuffer>>10)
+	}
+	if c.MaxDials > 0 {
+		fmt.Fprintf(&b, ",maxdialconcurrency=%d", c.MaxDials)
+	}
+	if c.NoALPN {
+		b.WriteString(",noalpn")
+	}
+	if c.NoReplay {
+		b.WriteString(",replay=false")
+	}
+	if c.LogRateLimit > 0 {
+		fmt.Fprintf(&b, ",logratelimit=%d", c.LogRateLimit)
+	}
+	if c.Priority != 0 {
+		fmt.Fprintf(&b, ",priority=%d", c.Priority)
+	}
+	if c.Dialer != "" {
+		b.WriteString(",dialer=" + c.Dialer)
+	}
+	if c.DialTimeout > 0 {
+		b.WriteString(",dialtimeout=" + c.DialTimeout.String())
+	}
+	if c.PassthroughPort > 0 {
+		fmt.Fprintf(&b, ",passthroughport=%d", c.PassthroughPort)
+	}
+	if c.Maintenance != "" {
+		b.WriteString(",maintenance=" + c.Maintenance)
+	}
+	if c.MaxBytes > 0 {
+		fmt.Fprintf(&b, ",maxbytes=%d", c.MaxBytes)
+	}
+	if c.FirstByteTimeout > 0 {
+		b.WriteString(",firstbyte=" + c.FirstByteTimeout.String())
+	}
+	return b.String()
+}
+
+// dialTimeout returns how long dials for the route may take
+func (c *RouteConfig) dialTimeout() time.Duration {
+	if c.DialTimeout > 0 {
+		return c.DialTimeout
+	}
+	return dialTimeout
+}
+
+// passthroughPort returns the port passthrough dials on the SNI host
+func (c *RouteConfig) passthroughPort() string {
+	if c.PassthroughPort > 0 {
+		return strconv.Itoa(c.PassthroughPort)
+	}
+	return "443"
+}
+
+// exactHost reports whether the route matches only the hostname in Host
+func (c *RouteConfig) exactHost() bool {
+	return c.Pattern == nil && c.HashSalt == "" && !strings.Contains(c.Host, "*") &&
+		!strings.HasPrefix(c.Host, routeSuffixPrefix)
+}
+
+// Matches reports whether the route applies to the normalized SNI host
+func (c *RouteConfig) Matches(host string) bool {
+	switch {
+	case c.Pattern != nil:
+		return c.Pattern.MatchString(host)
+	case c.HashSalt != "":
+		return hashHost(c.HashSalt, host) == c.Host
+	case c.Host == routeDefaultHost:
+		return true
+	case strings.HasPrefix(c.Host, routeSuffixPrefix):
+		return strings.HasSuffix(host, c.Host)
+	case strings.Contains(c.Host, "*"):
+		return matchWildcard(c.Host, host)
+	}
+	return c.Host == host
+}
+
+// matchWildcard reports whether host matches pattern label for label. A *
+// matches any run of characters within its own label, so *.example.com and
+// api-*.example.com both match api-1.example.com but not a.b.example.com.
+func matchWildcard(pattern, host string) bool {
+	want, got := strings.Split(pattern, "."), strings.Split(host, ".")
+	if len(want) != len(got) {
+		return false
+	}
+	for i, label := range want {
+		prefix, suffix, ok := strings.Cut(label, "*")
+		if !ok {
+			if label != got[i] {
+				return false
+			}
+			continue
+		}
+		if len(got[i]) < len(prefix)+len(suffix) || !strings.HasPrefix(got[i], prefix) || !strings.HasSuffix(got[i], suffix) {
+			return false
+		}
+	}
+	return true
+}
+
+// wildcardSpecificity counts the literal labels of a wildcard host and the
+// labels with a * inside them. Of two wildcards matching the same SNI, the
+// one with more literal labels wins, then the one with more partial labels.
+func wildcardSpecificity(pattern string) (literal, partial int) {
+	for _, label := range strings.Split(pattern, ".") {
+		switch {
+		case label == "*":
+		case strings.Contains(label, "*"):
+			partial++
+		default:
+			literal++
+		}
+	}
+	return literal, partial
+}
+
+// acquireDial takes one of the route's dial slots, waiting up to wait for one
+// to free up. Routes without maxdialconcurrency always succeed.
+func (c *RouteConfig) acquireDial(wait time.Duration) bool {
+	if c.dialSlots == nil {
+		return true
+	}
+	select {
+	case c.dialSlots <- struct{}{}:
+		return true
+	default:
+	}
+	select {
+	case c.dialSlots <- struct{}{}:
+		return true
+	case <-clk.After(wait):
+		return false
+	}
+}
+
+// releaseDial returns a slot taken by acquireDial
+func (c *RouteConfig) releaseDial() {
+	if c.dialSlots != nil {
+		<-c.dialSlots
+	}
+}
+
+// backendFor returns the dial target for sni, expanding capture group
+// references for pattern routes
+func (c *RouteConfig) backendFor(sni string) string {
+	return c.expand(c.Target, sni)
+}
+
+// fallbacksFor returns the fallback targets for sni, in dial order
+func (c *RouteConfig) fallbacksFor(sni string) []string {
+	if len(c.Fallbacks) == 0 {
+		return nil
+	}
+	targets := make([]string, len(c.Fallbacks))
+	for i, t := range c.Fallbacks {
+		targets[i] = c.expand(t, sni)
+	}
+	return targets
+}
+
+// expand fills capture group references in target from sni
+func (c *RouteConfig) expand(target, sni string) string {
+	if c.Pattern == nil {
+		return target
+	}
+	m := c.Pattern.FindStringSubmatchIndex(sni)
+	return string(c.Pattern.ExpandString(nil, target, sni, m))
+}
+
+// Per-route connection logging levels
+const (
+	routeLogOff     = "off"     // No per-connection lines
+	routeLogSummary = "summary" // Close summary only
+	routeLogFull    = "full"    // Routing decision and close summary
+)
+
+// RouteMap stores all routing rules. Lookups try, in order: exact hosts,
+// hashed hosts, the longest matching suffix, the most specific matching
+// wildcard, patterns in the order given, and finally the default route.
 type RouteMap struct {
-	rules map[string]*RouteConfig
+	rules     map[string]*RouteConfig
+	hashed    map[string]*RouteConfig // sha256: routes, keyed by host
+	salts     []string                // Distinct salts of the hashed routes
+	suffixes  map[string]*RouteConfig // .domain routes, keyed by host
+	wildcards []*RouteConfig          // *.domain routes, most literal labels first, then in the order given
+	patterns  []*RouteConfig          // ~regex routes, in the order given
+	fallback  *RouteConfig            // * route (nil rejects unmatched SNIs)
+	noALPN    *RouteMap               // noalpn routes, tried first for ClientHellos without ALPN (nil when none)
+
+	prioritized bool // Some route has a priority, so lookups must consider every match
+}
+
+// LookupHello returns the route for a ClientHello for host. Clients that send
+// no ALPN extension are matched against the noalpn routes first.
+func (rm *RouteMap) LookupHello(host string, hasALPN bool) (*RouteConfig, bool) {
+	if !hasALPN && rm.noALPN != nil {
+		if cfg, ok := rm.noALPN.Lookup(host); ok {
+			return cfg, true
+		}
+	}
+	return rm.Lookup(host)
 }
 
-// Lookup checks if a host is allowed and returns its route config
+// Lookup checks if a host is allowed and returns its route config. Among the
+// matching routes the one with the highest priority wins, ties going to the
+// first in precedence order; without priorities that is simply the first match.
 func (rm *RouteMap) Lookup(host string) (*RouteConfig, bool) {
-	cfg, ok := rm.rules[host]
-	return cfg, ok
+	var best *RouteConfig
+	rm.candidates(host, func(cfg *RouteConfig) bool {
+		if best == nil || cfg.Priority > best.Priority {
+			best = cfg
+		}
+		return rm.prioritized
+	})
+	return best, best != nil
+}
+
+// MatchBest returns the route for host as LookupHello does, along with a
+// human-readable reason for the choice, e.g. "longest suffix .example.com
+// (2 matching routes)". It is slower than LookupHello and meant for debugging.
+func (rm *RouteMap) MatchBest(host string, hasALPN bool) (*RouteConfig, string) {
+	if !hasALPN && rm.noALPN != nil {
+		if cfg, reason := rm.noALPN.MatchBest(host, true); cfg != nil {
+			return cfg, reason + ", noalpn route for a ClientHello without ALPN"
+		}
+	}
+
+	// Visiting every match picks the same route as Lookup: without
+	// priorities, all are equal and the first one stays best
+	var best *RouteConfig
+	matched := 0
+	rm.candidates(host, func(cfg *RouteConfig) bool {
+		matched++
+		if best == nil || cfg.Priority > best.Priority {
+			best = cfg
+		}
+		return true
+	})
+	if best == nil {
+		return nil, "no route matches"
+	}
+
+	var reason string
+	switch {
+	case best.Pattern != nil:
+		reason = "pattern " + best.Host
+	case best.HashSalt != "":
+		reason = "hashed host"
+	case best.Host == routeDefaultHost:
+		reason = "default route"
+	case strings.HasPrefix(best.Host, routeSuffixPrefix):
+		reason = "longest suffix " + best.Host
+	case strings.Contains(best.Host, "*"):
+		reason = "most specific wildcard " + best.Host
+	default:
+		reason = "exact match"
+	}
+	if matched == 1 {
+		return best, reason + " (1 matching route)"
+	}
+	if best.Priority != 0 {
+		reason += fmt.Sprintf(" with priority %d", best.Priority)
+	}
+	return best, fmt.Sprintf("%s (%d matching routes)", reason, matched)
+}
+
+// candidates calls fn with each route matching host in precedence order,
+// stopping when fn returns false
+func (rm *RouteMap) candidates(host string, fn func(*RouteConfig) bool) {
+	if cfg, ok := rm.rules[host]; ok && !fn(cfg) {
+		return
+	}
+	for _, salt := range rm.salts {
+		if cfg, ok := rm.hashed[hashHost(salt, host)]; ok && !fn(cfg) {
+			return
+		}
+	}
+	// Walk up the labels so the longest suffix is found first
+	for rest := host; len(rm.suffixes) > 0; {
+		i := strings.IndexByte(rest, '.')
+		if i < 0 {
+			break
+		}
+		rest = rest[i:]
+		if cfg, ok := rm.suffixes[rest]; ok && !fn(cfg) {
+			return
+		}
+		rest = rest[1:]
+	}
+	for _, cfg := range rm.wildcards {
+		if matchWildcard(cfg.Host, host) && !fn(cfg) {
+			return
+		}
+	}
+	for _, cfg := range rm.patterns {
+		if cfg.Pattern.MatchString(host) && !fn(cfg) {
+			return
+		}
+	}
+	if rm.fallback != nil {
+		fn(rm.fallback)
+	}
+}
+
+// len returns the number of routes in the map
+func (rm *RouteMap) len() int {
+	n := len(rm.rules) + len(rm.hashed) + len(rm.suffixes) + len(rm.wildcards) + len(rm.patterns)
+	if rm.fallback != nil {
+		n++
+	}
+	if rm.noALPN != nil {
+		n += rm.noALPN.len()
+	}
+	return n
+}
+
+// has reports whether the map holds a route for host, as written in a route
+func (rm *RouteMap) has(host string) bool {
+	_, exact := rm.rules[host]
+	_, suffix := rm.suffixes[host]
+	return exact || suffix || rm.hashed[host] != nil || routeIndex(rm.wildcards, host) >= 0 ||
+		routeIndex(rm.patterns, host) >= 0 || (host == routeDefaultHost && rm.fallback != nil)
+}
+
+// add inserts cfg, rejecting a second route for the same host or pattern.
+// A host may have one noalpn route in addition to its regular one.
+func (rm *RouteMap) add(cfg *RouteConfig) error {
+	if n := rm.len(); maxRoutes > 0 && n >= maxRoutes {
+		return fmt.Errorf("route limit of %d reached (raise -max-routes if this is intended)", maxRoutes)
+	}
+	if cfg.NoALPN {
+		if rm.noALPN == nil {
+			rm.noALPN = &RouteMap{rules: make(map[string]*RouteConfig)}
+		}
+		return rm.noALPN.insert(cfg)
+	}
+	return rm.insert(cfg)
+}
+
+// insert indexes cfg by its host kind, ignoring noalpn
+func (rm *RouteMap) insert(cfg *RouteConfig) error {
+	if rm.has(cfg.Host) {
+		return fmt.Errorf("duplicate route for host: %s", cfg.Host)
+	}
+	if cfg.Priority != 0 {
+		rm.prioritized = true
+	}
+	switch {
+	case cfg.Pattern != nil:
+		rm.patterns = append(rm.patterns, cfg)
+	case cfg.HashSalt != "":
+		if rm.hashed == nil {
+			rm.hashed = make(map[string]*RouteConfig)
+		}
+		rm.hashed[cfg.Host] = cfg
+		rm.updateSalts()
+	case cfg.Host == routeDefaultHost:
+		rm.fallback = cfg
+	case strings.HasPrefix(cfg.Host, routeSuffixPrefix):
+		if rm.suffixes == nil {
+			rm.suffixes = make(map[string]*RouteConfig)
+		}
+		rm.suffixes[cfg.Host] = cfg
+	case strings.Contains(cfg.Host, "*"):
+		rm.wildcards = append(rm.wildcards, cfg)
+		sort.SliceStable(rm.wildcards, func(i, j int) bool {
+			li, pi := wildcardSpecificity(rm.wildcards[i].Host)
+			lj, pj := wildcardSpecificity(rm.wildcards[j].Host)
+			return li > lj || (li == lj && pi > pj)
+		})
+	default:
+		rm.rules[cfg.Host] = cfg
+	}
+	return nil
+}
+
+// updateSalts recomputes the distinct salts of the hashed routes
+func (rm *RouteMap) updateSalts() {
+	seen := make(map[string]bool)
+	rm.salts = rm.salts[:0:0]
+	for _, cfg := range rm.hashed {
+		if !seen[cfg.HashSalt] {
+			seen[cfg.HashSalt] = true
+			rm.salts = append(rm.salts, cfg.HashSalt)
+		}
+	}
+	sort.Strings(rm.salts)
+}
+
+// routeIndex returns the position of the route for host in cfgs, or -1
+func routeIndex(cfgs []*RouteConfig, host string) int {
+	for i, cfg := range cfgs {
+		if cfg.Host == host {
+			return i
+		}
+	}
+	return -1
+}
+
+// clone returns a shallow copy that can be modified independently
+func (rm *RouteMap) clone() *RouteMap {
+	next := &RouteMap{
+		rules:     make(map[string]*RouteConfig, len(rm.rules)+1),
+		hashed:    make(map[string]*RouteConfig, len(rm.hashed)),
+		salts:     rm.salts,
+		suffixes:  make(map[string]*RouteConfig, len(rm.suffixes)),
+		wildcards: append([]*RouteConfig(nil), rm.wildcards...),
+		patterns:  append([]*RouteConfig(nil), rm.patterns...),
+		fallback:  rm.fallback,
+
+		prioritized: rm.prioritized,
+	}
+	if rm.noALPN != nil {
+		next.noALPN = rm.noALPN.clone()
+	}
+	for host, c := range rm.rules {
+		next.rules[host] = c
+	}
+	for host, c := range rm.hashed {
+		next.hashed[host] = c
+	}
+	for host, c := range rm.suffixes {
+		next.suffixes[host] = c
+	}
+	return next
+}
+
+// withRoute returns a copy of the map with cfg added
+func (rm *RouteMap) withRoute(cfg *RouteConfig) (*RouteMap, error) {
+	next := rm.clone()
+	if err := next.add(cfg); err != nil {
+		return nil, err
+	}
+	return next, nil
+}
+
+// withoutRoute returns a copy of the map with host removed
+func (rm *RouteMap) withoutRoute(host string) (*RouteMap, bool) {
+	next := rm.clone()
+	if _, exists := next.rules[host]; exists {
+		delete(next.rules, host)
+		return next, true
+	}
+	if _, exists := next.hashed[host]; exists {
+		delete(next.hashed, host)
+		next.updateSalts()
+		return next, true
+	}
+	if _, exists := next.suffixes[host]; exists {
+		delete(next.suffixes, host)
+		return next, true
+	}
+	if i := routeIndex(next.wildcards, host); i >= 0 {
+		next.wildcards = append(next.wildcards[:i], next.wildcards[i+1:]...)
+		return next, true
+	}
+	if i := routeIndex(next.patterns, host); i >= 0 {
+		next.patterns = append(next.patterns[:i], next.patterns[i+1:]...)
+		return next, true
+	}
+	if host == routeDefaultHost && next.fallback != nil {
+		next.fallback = nil
+		return next, true
+	}
+	if next.noALPN != nil {
+		if sub, ok := next.noALPN.withoutRoute(host); ok {
+			next.noALPN = sub
+			return next, true
+		}
+	}
+	return nil, false
+}
+
+// Routes returns the exact and hashed host route configs sorted by host,
+// followed by the other routes in match order
+func (rm *RouteMap) Routes() []*RouteConfig {
+	cfgs := make([]*RouteConfig, 0, rm.len())
+	for _, cfg := range rm.rules {
+		cfgs = append(cfgs, cfg)
+	}
+	for _, cfg := range rm.hashed {
+		cfgs = append(cfgs, cfg)
+	}
+	sort.Slice(cfgs, func(i, j int) bool { return cfgs[i].Host < cfgs[j].Host })
+
+	suffixes := make([]*RouteConfig, 0, len(rm.suffixes))
+	for _, cfg := range rm.suffixes {
+		suffixes = append(suffixes, cfg)
+	}
+	sort.Slice(suffixes, func(i, j int) bool {
+		if len(suffixes[i].Host) != len(suffixes[j].Host) {
+			return len(suffixes[i].Host) > len(suffixes[j].Host)
+		}
+		return suffixes[i].Host < suffixes[j].Host
+	})
+	cfgs = append(cfgs, suffixes...)
+	cfgs = append(cfgs, rm.wildcards...)
+	cfgs = append(cfgs, rm.patterns...)
+	if rm.fallback != nil {
+		cfgs = append(cfgs, rm.fallback)
+	}
+	if rm.noALPN != nil {
+		cfgs = append(cfgs, rm.noALPN.Routes()...)
+	}
+	return cfgs
+}
+
+var (
+	listen               string
+	listenNetwork        string
+	backendNetwork       string
+	adminAddr            string
+	shutdownTimeout      time.Duration
+	transparent          bool
+	resolverAddr         string
+	scanThreshold        int
+	scanWindow           time.Duration
+	scanBlock            time.Duration
+	rejectLogSample      string
+	maxInflight          int
+	replayTimeout        time.Duration
+	dumpCfg              bool
+	maxLeadingRecords    int
+	eventWebhookURL      string
+	eventQueueSize       int
+	pidFile              string
+	runAsUser            string
+	runAsGroup           string
+	expvarAddr           string
+	upstreamSpecs        listFlags
+	minTLSVersion        string
+	sniExtensionType     int
+	repeatThreshold      int
+	repeatWindow         time.Duration
+	repeatCacheSize      int
+	connLogPath          string
+	connLogMaxSize       int64
+	noForward            bool
+	rejectIPSNI          bool
+	configPath           string
+	exportPath           string
+	controlURL           string
+	controlCacheTTL      time.Duration
+	metricsPrefix        string
+	metricsLabels        listFlags
+	geoipDBPath          string
+	geoipLabel           string
+	otelTracePath        string
+	maxRoutes            int
+	adminTLSCert         string
+	adminTLSKey          string
+	adminClientCA        string
+	allowTargetSpecs     listFlags
+	coalesceReplay       time.Duration
+	helloTimeout         time.Duration
+	rulesPath            string
+	warnOnDefault        bool
+	dialQueueTimeout     time.Duration
+	maxConns             int
+	slowHandshakeRate    int
+	dropSlowHandshakes   bool
+	liveStats            bool
+	selfTest             bool
+	denyExtSpecs         listFlags
+	connLogCompress      string
+	bindRetry            time.Duration
+	handoffPath          string
+	connLogChainKey      string
+	connLogChainFrom     string
+	verifyConnLogs       bool
+	backendTFO           bool
+	summaryPath          string
+	passthroughAllowPath string
+	passthroughAllowFP   float64
+	dialTimeout          time.Duration
+	routes               listFlags
+)
+
+// server holds the state shared by all proxied connections
+type server struct {
+	routes    atomic.Pointer[RouteMap] // Swapped wholesale on runtime route changes
+	routesMu  sync.Mutex               // Serializes route updates
+	resolver  *net.Resolver            // Backend resolver (nil for the system resolver)
+	scans     *scanTracker             // SNI scan detector (nil when disabled)
+	repeats   *repeatTracker           // Repeated ClientHello detector (nil when disabled)
+	rejects   *sampler                 // Sampling of rejection log lines
+	events    *eventWebhook            // Connection event sink (nil when disabled)
+	connLog   *connLog                 // CSV connection log (nil when disabled)
+	control   *controlClient           // Route lookups for unconfigured SNIs (nil when disabled)
+	rules     *ruleSet                 // Rules tried before the routes (nil when disabled)
+	allowlist *bloomFilter             // SNIs passthrough routes may dial (nil allows any)
+	geo       geoDB                    // Client IP labels for -geoip-db metrics (nil when disabled)
+	tracer    connTracer               // Span per connection for -otel-trace-file (nil when disabled)
+	live      *liveConns               // Connections relaying to a backend, for GET /connections
+	active    sync.WaitGroup           // Tracks in-flight connections for graceful drain
+
+	minVersion uint16          // Lowest acceptable client TLS version (0 accepts any)
+	deniedExts map[uint16]bool // ClientHello extension types that get a connection rejected
+
+	flagRoutes      []string // Routes given outside -config, kept across reloads
+	configUpstreams []string // Upstreams loaded from -config, which reloads may not change
 }
 
 var (
-	listen string
-	routes routeFlags
+	connsAccepted      = newCounter("connections_accepted_total", "Connections accepted by the listener")
+	connsRejected      = newCounter("connections_rejected_total", "Connections rejected before reaching a backend", "class", "reason")
+	bytesTransferred   = newCounter("bytes_transferred_total", "Bytes relayed between clients and backends", "direction")
+	backendFallbacks   = newCounter("backend_fallbacks_total", "Backend dials that failed over to the next target in a route's fallback chain")
+	backendConns       = newCounter("backend_connections_total", "Backend connections established, by the path dialed through (direct or SOCKS5 proxy)", "proxy")
+	routeALPN          = newCounter("route_alpn_connections_total", "Connections routed, by route and the client's preferred ALPN protocol", "route", "alpn")
+	slowHandshakes     = newCounter("slow_handshakes_total", "ClientHellos delivered below -slow-handshake-rate")
+	configReloads      = newCounter("config_reloads_total", "Config reloads by result (success or error)", "result")
+	routeReloadChanges = newCounter("route_reload_changes_total", "Routes added, removed or changed by config reloads", "change")
+	defaultRouted      = newCounter("default_route_connections_total", "Connections routed by the default route because no other route matched")
+	connPanics         = newCounter("connection_panics_total", "Panics recovered while handling a connection")
+	connsClosed        = newCounter("connections_closed_total", "Proxied connections closed, by reason", "reason")
+
+	// activeConns counts in-flight connections, for metrics and drain progress
+	activeConns = newGauge("connections_active", "Connections currently being handled").with()
+)
+
+// Rejection classes, separating likely abuse from ordinary policy denials
+const (
+	rejectMalformed = "malformed" // Unreadable or unparseable handshake
+	rejectPolicy    = "policy"    // Well-formed handshake refused by configuration
 )
 
+// reject counts a rejected connection under class and reason and logs it,
+// subject to -reject-log-sample
+func (s *server) reject(class, reason, format string, v ...any) {
+	connsRejected.inc(class, reason)
+	if s.rejects.Sample() {
+		log.Printf("Rejected [%s/%s] %s", class, reason, fmt.Sprintf(format, v...))
+	}
+}
+
+// maxAcceptDelay caps the backoff between retries of a temporarily failing Accept
+const maxAcceptDelay = time.Second
+
+// drainLogInterval is how often drain progress is logged during shutdown
+const drainLogInterval = 5 * time.Second
+
 // parseRoutes parses route flags into RouteMap
 func parseRoutes(routes []string) (*RouteMap, error) {
+	// Fail before parsing anything when a generated config is far too large
+	if maxRoutes > 0 && len(routes) > maxRoutes {
+		return nil, fmt.Errorf("%d routes configured, more than -max-routes %d", len(routes), maxRoutes)
+	}
+
 	rm := &RouteMap{rules: make(map[string]*RouteConfig)}
 
-	for _, route := range routes {
-		cfg, err := parseRoute(route)
-		if err != nil {
-			return nil, err
+	for _, route := range routes {
+		cfg, err := parseRoute(route)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := rm.add(cfg); err != nil {
+			return nil, err
+		}
+	}
+
+	return rm, nil
+}
+
+// parseRoute parses a single route string, including any trailing options
+func parseRoute(route string) (*RouteConfig, error) {
+	spec, opts, hasOpts := splitRouteOptions(route)
+
+	cfg, err := parseRouteSpec(spec)
+	if err != nil {
+		return nil, err
+	}
+	cfg.Log = routeLogFull
+
+	if hasOpts {
+		if err := parseRouteOptions(cfg, opts); err != nil {
+			return nil, err
+		}
+	}
+	if err := checkRouteTargets(cfg); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// routeOptions names the options parseRouteOptions accepts
+var routeOptions = []string{
+	"log", "upstream", "maxbytes", "proxywindow", "proxyselect", "copybuf", "noalpn",
+	"dialtimeout", "dialer", "passthroughport", "maintenance", "priority",
+	"logratelimit", "replay", "maxdialconcurrency", "firstbyte",
+}
+
+// splitRouteOptions splits the comma-separated options off a route. A host
+// pattern may contain commas itself, as in ~^a{1,3}\.com$, so for pattern
+// routes only the trailing segments that name an option are taken as options.
+func splitRouteOptions(route string) (spec, opts string, hasOpts bool) {
+	if !strings.HasPrefix(strings.TrimSpace(route), routePatternPrefix) {
+		return strings.Cut(route, ",")
+	}
+	segments := strings.Split(route, ",")
+	n := len(segments)
+	for n > 1 {
+		key, _, _ := strings.Cut(strings.TrimSpace(segments[n-1]), "=")
+		if !slices.Contains(routeOptions, key) {
+			break
+		}
+		n--
+	}
+	return strings.Join(segments[:n], ","), strings.Join(segments[n:], ","), n < len(segments)
+}
+
+// normalizeHost puts a hostname in the form used as a route key. Hostnames are
+// case-insensitive, and a single trailing dot is stripped so fully-qualified
+// names match their dotless form. IP literals are put in canonical form without
+// brackets, so passthrough can re-bracket them. Every route source and the
+// incoming SNI must go through this so duplicate detection and lookups agree.
+func normalizeHost(host string) string {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if ip, err := netip.ParseAddr(strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")); err == nil {
+		return ip.String()
+	}
+	return host
+}
+
+// parseRouteOptions applies comma-separated key=value options to a route
+func parseRouteOptions(cfg *RouteConfig, opts string) error {
+	for _, opt := range strings.Split(opts, ",") {
+		key, value, _ := strings.Cut(strings.TrimSpace(opt), "=")
+		switch key {
+		case "log":
+			switch value {
+			case routeLogOff, routeLogSummary, routeLogFull:
+				cfg.Log = value
+			default:
+				return fmt.Errorf("invalid log option '%s' (use off, summary or full)", value)
+			}
+		case "upstream":
+			if _, ok := upstreams[value]; !ok {
+				return fmt.Errorf("unknown upstream '%s'", value)
+			}
+			if !cfg.Passthrough {
+				return fmt.Errorf("upstream '%s' cannot be combined with a target", value)
+			}
+			cfg.Upstream = value
+			cfg.Passthrough = false
+		case "maxbytes":
+			n, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || n <= 0 {
+				return fmt.Errorf("invalid maxbytes option '%s' (use a positive byte count)", value)
+			}
+			cfg.MaxBytes = n
+		case "proxywindow":
+			if cfg.ProxyAddr == "" {
+				return fmt.Errorf("proxywindow '%s' requires a SOCKS proxy (@proxy)", value)
+			}
+			w, err := parseTimeWindow(value)
+			if err != nil {
+				return err
+			}
+			cfg.ProxyWindow = w
+		case "proxyselect":
+			if len(cfg.ExtraProxies) == 0 {
+				return fmt.Errorf("proxyselect '%s' requires several SOCKS proxies (@proxy|proxy)", value)
+			}
+			switch value {
+			case proxySelectRoundRobin, proxySelectLatency:
+				cfg.ProxySelect = value
+			default:
+				return fmt.Errorf("invalid proxyselect option '%s' (use roundrobin or latency)", value)
+			}
+		case "copybuf":
+			size, err := parseCopyBufSize(value)
+			if err != nil {
+				return err
+			}
+			cfg.CopyBuffer = size
+		case "noalpn":
+			if value != "" && value != "true" {
+				return fmt.Errorf("invalid noalpn option '%s' (use noalpn or noalpn=true)", value)
+			}
+			cfg.NoALPN = true
+		case "dialtimeout":
+			d, err := time.ParseDuration(value)
+			if err != nil || d <= 0 {
+				return fmt.Errorf("invalid dialtimeout option '%s' (use a positive duration such as 30s)", value)
+			}
+			cfg.DialTimeout = d
+		case "dialer":
+			if _, ok := backendDialers[value]; !ok {
+				return fmt.Errorf("unknown dialer '%s'", value)
+			}
+			cfg.Dialer = value
+		case "passthroughport":
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 1 || n > 65535 {
+				return fmt.Errorf("invalid passthroughport option '%s' (use a port from 1 to 65535)", value)
+			}
+			cfg.PassthroughPort = n
+		case "maintenance":
+			if cfg.Reject {
+				return fmt.Errorf("maintenance cannot be combined with the reject target")
+			}
+			alert, err := parseMaintenance(value)
+			if err != nil {
+				return err
+			}
+			cfg.Maintenance = alert
+		case "priority":
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				return fmt.Errorf("invalid priority option '%s' (use an integer)", value)
+			}
+			cfg.Priority = n
+		case "logratelimit":
+			n, err := strconv.Atoi(value)
+			if err != nil || n <= 0 {
+				return fmt.Errorf("invalid logratelimit option '%s' (use a positive count of lines per second)", value)
+			}
+			cfg.LogRateLimit = n
+			cfg.logLimit = &rateLimiter{host: cfg.Host, limit: n}
+		case "replay":
+			switch value {
+			case "true":
+				cfg.NoReplay = false
+			case "false":
+				cfg.NoReplay = true
+			default:
+				return fmt.Errorf("invalid replay option '%s' (use true or false)", value)
+			}
+		case "maxdialconcurrency":
+			n, err := strconv.Atoi(value)
+			if err != nil || n <= 0 {
+				return fmt.Errorf("invalid maxdialconcurrency option '%s' (use a positive count)", value)
+			}
+			cfg.MaxDials = n
+			cfg.dialSlots = make(chan struct{}, n)
+		case "firstbyte":
+			d, err := time.ParseDuration(value)
+			if err != nil || d <= 0 {
+				return fmt.Errorf("invalid firstbyte option '%s' (use a positive duration such as 5s)", value)
+			}
+			cfg.FirstByteTimeout = d
+		default:
+			return fmt.Errorf("unknown route option '%s'", key)
+		}
+	}
+	if cfg.PassthroughPort > 0 && !cfg.Passthrough {
+		return fmt.Errorf("passthroughport requires a passthrough route (no target or upstream)")
+	}
+	return nil
+}
+
+// parseRouteSpec parses the hostname, target and proxy part of a route. A
+// host pattern may contain = and @ itself, so the target follows the last =,
+// and the proxy follows the last @ only when no = comes after it.
+func parseRouteSpec(route string) (*RouteConfig, error) {
+	var proxyAddr string
+	var extraProxies []string
+	remainder := route
+	pattern := strings.HasPrefix(strings.TrimSpace(route), routePatternPrefix)
+
+	// Extract SOCKS5 proxy if @ delimiter present; several proxies are
+	// separated by |
+	if idx := strings.LastIndex(route, "@"); idx != -1 && !strings.Contains(route[idx+1:], "=") {
+		proxyAddr = strings.TrimSpace(route[idx+1:])
+		remainder = strings.TrimSpace(route[:idx])
+
+		// Validate proxy address format (must be host:port)
+		if proxyAddr != "" {
+			proxies := strings.Split(proxyAddr, "|")
+			for i, proxy := range proxies {
+				proxies[i] = strings.TrimSpace(proxy)
+				if err := checkHostPort(proxies[i]); err != nil {
+					return nil, fmt.Errorf("invalid SOCKS proxy address '%s': %v", proxies[i], err)
+				}
+			}
+			proxyAddr, extraProxies = proxies[0], proxies[1:]
+		}
+	}
+
+	// Detect and reject old format (in the remainder), letting IPv6 literals through
+	if strings.Contains(remainder, ":") && !strings.Contains(remainder, "=") && !isIPv6Literal(remainder) &&
+		!strings.HasPrefix(strings.TrimSpace(remainder), routeHashPrefix) && !pattern {
+		return nil, fmt.Errorf("invalid route format '%s'\n"+
+			"Use: -route hostname=:port or -route hostname", route)
+	}
+
+	// Passthrough format: just hostname
+	if !strings.Contains(remainder, "=") {
+		cfg, err := parseRouteHost(remainder)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Passthrough = true
+		cfg.setProxies(proxyAddr, extraProxies)
+		return cfg, nil
+	}
+
+	// Route format: hostname=target
+	parts := strings.SplitN(remainder, "=", 2)
+	if pattern {
+		idx := strings.LastIndex(remainder, "=")
+		parts = []string{remainder[:idx], remainder[idx+1:]}
+	}
+	cfg, err := parseRouteHost(parts[0])
+	if err != nil {
+		return nil, err
+	}
+	if strings.TrimSpace(parts[1]) == routeRejectTarget {
+		if proxyAddr != "" {
+			return nil, fmt.Errorf("a SOCKS proxy cannot be combined with the reject target")
+		}
+		cfg.Reject = true
+		return cfg, nil
+	}
+
+	// A target may be followed by |-separated fallbacks, dialed in order
+	var targets []string
+	for _, target := range strings.Split(parts[1], "|") {
+		target = strings.TrimSpace(target)
+		if target == "" {
+			return nil, fmt.Errorf("target required when using '=' syntax")
+		}
+
+		target, err = parseTarget(target)
+		if err != nil {
+			return nil, err
+		}
+		if cfg.Pattern != nil {
+			if err := checkTemplate(cfg.Pattern, target); err != nil {
+				return nil, fmt.Errorf("invalid target '%s': %v", target, err)
+			}
+		}
+		targets = append(targets, target)
+	}
+
+	cfg.Target = targets[0]
+	cfg.Fallbacks = targets[1:]
+	cfg.setProxies(proxyAddr, extraProxies)
+	return cfg, nil
+}
+
+// parseRouteHost parses the host part of a route. A leading ~ makes it a
+// regular expression matched against the normalized SNI; the pattern itself
+// is kept verbatim since lowercasing would change escapes such as \S.
+// A sha256:<salt>:<hex> host matches hostnames whose salted hash is hex.
+// The result is a route config with only the host fields set.
+func parseRouteHost(raw string) (*RouteConfig, error) {
+	raw = strings.TrimSpace(raw)
+	if rest, ok := strings.CutPrefix(raw, routeHashPrefix); ok {
+		salt, digest, ok := strings.Cut(rest, ":")
+		digest = strings.ToLower(digest)
+		if b, err := hex.DecodeString(digest); !ok || salt == "" || err != nil || len(b) != sha256.Size {
+			return nil, fmt.Errorf("invalid hashed host '%s' (use sha256:<salt>:<64 hex digits>)", raw)
+		}
+		return &RouteConfig{Host: routeHashPrefix + salt + ":" + digest, HashSalt: salt}, nil
+	}
+	if expr, ok := strings.CutPrefix(raw, routePatternPrefix); ok {
+		if expr == "" {
+			return nil, fmt.Errorf("empty host pattern")
+		}
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid host pattern '%s': %v", expr, err)
+		}
+		return &RouteConfig{Host: raw, Pattern: re}, nil
+	}
+
+	host := normalizeHost(raw)
+	if host == "" {
+		return nil, fmt.Errorf("empty hostname")
+	}
+	if host == routeDefaultHost {
+		return &RouteConfig{Host: host}, nil
+	}
+	labels := strings.Split(strings.TrimPrefix(host, routeSuffixPrefix), ".")
+	for _, label := range labels {
+		if label == "" {
+			return nil, fmt.Errorf("invalid hostname '%s'", raw)
+		}
+		if strings.Count(label, "*") > 1 {
+			return nil, fmt.Errorf("invalid wildcard host '%s' (use at most one * per label, as in api-*.example.com)", raw)
+		}
+	}
+	if strings.HasPrefix(host, routeSuffixPrefix) && strings.Contains(host, "*") {
+		return nil, fmt.Errorf("invalid suffix host '%s' (a suffix cannot contain *)", raw)
+	}
+	return &RouteConfig{Host: host}, nil
+}
+
+// checkTemplate verifies that every capture group referenced by target
+// exists in re
+func checkTemplate(re *regexp.Regexp, target string) error {
+	for _, m := range templateRef.FindAllStringSubmatch(target, -1) {
+		ref := strings.Trim(m[1], "{}")
+		if ref == "$" {
+			continue
+		}
+		if n, err := strconv.Atoi(ref); err == nil {
+			if n > re.NumSubexp() {
+				return fmt.Errorf("reference $%s but the pattern has %d capture groups", ref, re.NumSubexp())
+			}
+			continue
+		}
+		if re.SubexpIndex(ref) < 0 {
+			return fmt.Errorf("reference $%s to an unknown capture group", ref)
+		}
+	}
+	return nil
+}
+
+// isIPv6Literal reports whether host is an IPv6 address, with or without brackets
+func isIPv6Literal(host string) bool {
+	ip, err := netip.ParseAddr(strings.TrimSuffix(strings.TrimPrefix(strings.TrimSpace(host), "["), "]"))
+	return err == nil && ip.Is6()
+}
+
+// parseTarget validates a backend target, normalizing :port to localhost:port
+func parseTarget(target string) (string, error) {
+	if strings.HasPrefix(target, ":") && !isIPv6Literal(target[:strings.LastIndex(target, ":")]) {
+		port := target[1:]
+		if _, err := strconv.Atoi(port); err != nil {
+			return "", fmt.Errorf("invalid port '%s': %v", port, err)
+		}
+		return net.JoinHostPort("localhost", port), nil
+	}
+
+	// Validate host:port format
+	if err := checkHostPort(target); err != nil {
+		return "", fmt.Errorf("invalid target '%s': %v", target, err)
+	}
+	return target, nil
+}
+
+// parseTLSVersion parses a TLS version such as 1.2 into its protocol number
+func parseTLSVersion(version string) (uint16, error) {
+	switch version {
+	case "1.0":
+		return tls.VersionTLS10, nil
+	case "1.1":
+		return tls.VersionTLS11, nil
+	case "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	}
+	return 0, fmt.Errorf("unsupported TLS version '%s' (use 1.0, 1.1, 1.2 or 1.3)", version)
+}
+
+// parseExtensionTypes parses -deny-tls-extension values, each a
+// comma-separated list of numeric TLS extension types
+func parseExtensionTypes(specs []string) (map[uint16]bool, error) {
+	types := make(map[uint16]bool)
+	for _, spec := range specs {
+		for _, v := range strings.Split(spec, ",") {
+			n, err := strconv.ParseUint(strings.TrimSpace(v), 10, 16)
+			if err != nil {
+				return nil, fmt.Errorf("invalid TLS extension type '%s' (use a number from 0 to 65535)", v)
+			}
+			types[uint16(n)] = true
+		}
+	}
+	return types, nil
+}
+
+// validateNetwork checks that network is a TCP network name accepted by net.Dial
+func validateNetwork(network string) error {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+		return nil
+	}
+	return fmt.Errorf("unsupported network '%s' (use tcp, tcp4 or tcp6)", network)
+}
+
+// checkHostPort validates a host:port address, hinting at brackets for bare IPv6 literals
+func checkHostPort(addr string) error {
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		if strings.Count(addr, ":") > 1 && !strings.HasPrefix(addr, "[") {
+			return fmt.Errorf("%v (IPv6 addresses must be bracketed, e.g. [::1]:443)", err)
+		}
+		return err
+	}
+	return nil
+}
+
+// newResolver creates a resolver that sends all DNS queries to server
+func newResolver(server string) (*net.Resolver, error) {
+	if err := checkHostPort(server); err != nil {
+		return nil, fmt.Errorf("invalid resolver address '%s': %v", server, err)
+	}
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, server)
+		},
+	}, nil
+}
+
+func main() {
+	// `proxys test [flags]` checks the configuration instead of serving it, and
+	// `proxys verify-conn-log [flags] <file>...` checks chained connection logs
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "test":
+			selfTest = true
+		case "verify-conn-log":
+			verifyConnLogs = true
+		}
+		if selfTest || verifyConnLogs {
+			os.Args = append(os.Args[:1], os.Args[2:]...)
+		}
+	}
+
+	flag.StringVar(&listen, "listen", ":443", "Listen address")
+	flag.DurationVar(&bindRetry, "bind-retry", 0, "Keep retrying for this long when the listen address is in use, e.g. by an exiting predecessor (0 fails at once)")
+	flag.StringVar(&listenNetwork, "listen-network", "tcp", "Listen address family (tcp, tcp4 or tcp6)")
+	flag.StringVar(&backendNetwork, "backend-network", "tcp", "Backend dial address family (tcp, tcp4 or tcp6)")
+	flag.StringVar(&adminAddr, "admin", "", "Admin HTTP listen address for health probes (disabled if empty)")
+	flag.StringVar(&adminTLSCert, "admin-tls-cert", "", "Certificate file to serve the admin and expvar servers over HTTPS")
+	flag.StringVar(&adminTLSKey, "admin-tls-key", "", "Private key file for -admin-tls-cert")
+	flag.StringVar(&adminClientCA, "admin-client-ca", "", "CA bundle that admin and expvar clients must present a certificate from (requires -admin-tls-cert)")
+	flag.StringVar(&expvarAddr, "expvar", "", "Listen address for metrics via expvar at /debug/vars (disabled if empty)")
+	flag.BoolVar(&transparent, "transparent", false, "Dial passthrough routes at the connection's original destination (Linux only)")
+	flag.BoolVar(&backendTFO, "backend-tfo", false, "Dial backends with TCP Fast Open, sending the ClientHello in the SYN where possible (Linux only)")
+	flag.StringVar(&resolverAddr, "resolver", "", "DNS server (host:port) for resolving backend hostnames (default: system resolver)")
+	flag.IntVar(&scanThreshold, "sni-scan-threshold", 0, "Distinct SNIs from one client IP within -sni-scan-window that trigger a scan alert (0 disables)")
+	flag.DurationVar(&scanWindow, "sni-scan-window", time.Minute, "Sliding window for SNI scan detection")
+	flag.DurationVar(&scanBlock, "sni-scan-block", 0, "How long to block a client IP after a scan alert (0 disables blocking)")
+	flag.IntVar(&repeatThreshold, "hello-repeat-threshold", 0, "Distinct client IPs sending an identical ClientHello within -hello-repeat-window that trigger an alert (0 disables)")
+	flag.DurationVar(&repeatWindow, "hello-repeat-window", time.Minute, "How long a ClientHello is remembered for repeat detection")
+	flag.IntVar(&repeatCacheSize, "hello-repeat-cache", 10000, "Maximum distinct ClientHellos tracked for repeat detection")
+	flag.StringVar(&rejectLogSample, "reject-log-sample", "1/1", "Fraction of rejected connections to log (format: 1/N)")
+	flag.IntVar(&maxConns, "max-conns", 0, "Close new connections immediately while this many are active (0 disables)")
+	flag.IntVar(&slowHandshakeRate, "slow-handshake-rate", 0, "Flag ClientHellos that take over a second and arrive below this many bytes per second (0 disables)")
+	flag.BoolVar(&dropSlowHandshakes, "drop-slow-handshakes", false, "Reject ClientHellos flagged by -slow-handshake-rate instead of only logging them")
+	flag.BoolVar(&liveStats, "live-stats", false, "Update the byte counts of GET /connections while data flows, at the cost of zero-copy relaying")
+	flag.IntVar(&maxInflight, "max-inflight", 0, "Maximum bytes buffered per copy direction before applying backpressure (0 uses the defaults)")
+	flag.IntVar(&maxLeadingRecords, "max-leading-records", 0, "Number of change_cipher_spec records tolerated before the ClientHello")
+	flag.DurationVar(&coalesceReplay, "coalesce-replay", 0, "Wait up to this long for more client bytes to send with the ClientHello in a single write (0 disables)")
+	flag.DurationVar(&helloTimeout, "hello-timeout", 10*time.Second, "Maximum time to receive the complete ClientHello from a client")
+	flag.DurationVar(&dialTimeout, "dial-timeout", 10*time.Second, "Maximum time to connect to a backend, including through a SOCKS proxy")
+	flag.DurationVar(&dialQueueTimeout, "dial-queue-timeout", 5*time.Second, "How long a connection waits for a dial slot on routes with maxdialconcurrency before it is shed")
+	flag.DurationVar(&replayTimeout, "replay-timeout", 10*time.Second, "Maximum time for the backend to take the buffered ClientHello and start answering it")
+	flag.BoolVar(&rejectIPSNI, "reject-ip-sni", false, "Reject ClientHellos whose SNI is an IPv4 or IPv6 literal")
+	flag.BoolVar(&noForward, "no-forward", false, "Log the routing decision for each connection and close it without dialing the backend")
+	flag.StringVar(&controlURL, "control-url", "", "HTTP control service queried for SNIs without a route (disabled if empty)")
+	flag.DurationVar(&controlCacheTTL, "control-cache-ttl", time.Minute, "How long control service answers, including unknown SNIs, are cached")
+	flag.StringVar(&metricsPrefix, "metrics-prefix", "proxys_", "Prefix for all exported metric names")
+	flag.Var(&metricsLabels, "metrics-label", "Constant label added to every metric series (format: name=value, can be repeated)")
+	flag.StringVar(&geoipDBPath, "geoip-db", "", "MaxMind database labeling connection and byte metrics by client country or ASN (needs a build with -tags geoip; disabled if empty)")
+	flag.StringVar(&geoipLabel, "geoip-label", geoLabelCountry, "Client attribute -geoip-db labels metrics by (country or asn)")
+	flag.StringVar(&otelTracePath, "otel-trace-file", "", "Write an OpenTelemetry span per connection as JSON to this file, - for stdout (needs a build with -tags otel; disabled if empty)")
+	flag.IntVar(&maxRoutes, "max-routes", 100000, "Maximum number of routes, as a guard against runaway generated configs (0 disables)")
+	flag.BoolVar(&warnOnDefault, "warn-on-default", false, "Log a warning for every connection served by the default route")
+	flag.StringVar(&passthroughAllowPath, "passthrough-allowlist", "", "File of hostnames, one per line, that passthrough routes may dial; others are rejected (disabled if empty)")
+	flag.Float64Var(&passthroughAllowFP, "passthrough-allowlist-fp", 0.001, "False positive rate of the -passthrough-allowlist Bloom filter")
+	flag.StringVar(&rulesPath, "rules", "", "File of allow/deny rules tried in order before the routes")
+	flag.StringVar(&configPath, "config", "", "JSON file with additional upstreams and routes, in flag syntax")
+	flag.StringVar(&exportPath, "export-config", "", "Write the upstreams and routes as a -config file to this path and exit")
+	flag.BoolVar(&dumpCfg, "dump-config", false, "Print the effective configuration as JSON to stdout at startup")
+	flag.StringVar(&eventWebhookURL, "event-webhook", "", "URL to POST connection open/close events to as JSON (disabled if empty)")
+	flag.IntVar(&eventQueueSize, "event-queue-size", 1024, "Maximum connection events queued for the webhook before dropping")
+	flag.StringVar(&connLogPath, "conn-log", "", "Append a CSV row per closed connection to this file (disabled if empty)")
+	flag.Int64Var(&connLogMaxSize, "conn-log-max-size", 100<<20, "Rotate the -conn-log file once it reaches this many bytes (0 disables rotation)")
+	flag.StringVar(&connLogCompress, "conn-log-compress", connLogCompressNone, "Compress rotated -conn-log files (none or gzip)")
+	flag.StringVar(&handoffPath, "handoff-socket", "", "Unix socket for handing the listener over to a new process on upgrade (disabled if empty)")
+	flag.StringVar(&connLogChainKey, "conn-log-chain-key", "", "File with an HMAC key chaining -conn-log rows for tamper evidence (disabled if empty)")
+	flag.StringVar(&connLogChainFrom, "conn-log-chain-from", "", "For verify-conn-log: chain value, from a checkpoint, that the first file continues from (empty if it starts the chain)")
+	flag.StringVar(&summaryPath, "summary-file", "", "Also write the shutdown summary of connections, bytes, rejections and routes to this file")
+	flag.StringVar(&pidFile, "pidfile", "", "Write the process ID to this file")
+	flag.StringVar(&runAsUser, "user", "", "Drop privileges to this user after binding")
+	flag.StringVar(&runAsGroup, "group", "", "Drop privileges to this group after binding (default: the user's primary group)")
+	flag.Var(&denyExtSpecs, "deny-tls-extension", "Reject ClientHellos carrying this numeric extension type (comma-separated, can be repeated)")
+	flag.StringVar(&minTLSVersion, "min-tls-version", "", "Reject clients whose highest offered TLS version is below this (1.0, 1.1, 1.2 or 1.3; disabled if empty)")
+	flag.IntVar(&sniExtensionType, "sni-extension-type", 0, "Route on the contents of this ClientHello extension type when present, instead of the SNI (0 disables)")
+	flag.StringVar(&logLevel, "log-level", "info", "Log level (info or debug)")
+	flag.DurationVar(&shutdownTimeout, "shutdown-timeout", 30*time.Second, "Maximum time to wait for active connections on shutdown")
+	flag.Var(&allowTargetSpecs, "allow-target", "Backend CIDRs, IPs or hostnames proxys may dial, comma-separated (can be repeated; default: any)")
+	flag.Var(&upstreamSpecs, "upstream", "Named backend pool for consistent hashing on SNI (format: name=target,target,...)")
+	flag.Var(&routes, "route", "SNI route mapping (format: hostname[@proxy][,options] or hostname=target[@proxy][,options])")
+	flag.Parse()
+	if dsn := os.Getenv(dsnEnv); dsn != "" {
+		if err := applyDSN(dsn); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if verifyConnLogs {
+		os.Exit(runVerifyConnLogs(os.Stdout, connLogChainKey, connLogChainFrom, flag.Args()))
+	}
+
+	if err := validateLogLevel(logLevel); err != nil {
+		log.Fatal(err)
+	}
+	if err := configureMetrics(metricsPrefix, metricsLabels); err != nil {
+		log.Fatal(err)
+	}
+	for name, network := range map[string]string{"listen-network": listenNetwork, "backend-network": backendNetwork} {
+		if err := validateNetwork(network); err != nil {
+			log.Fatalf("Invalid -%s: %v", name, err)
+		}
+	}
+	if transparent && !transparentSupported {
+		log.Fatal("-transparent is only supported on Linux")
+	}
+	if geoipDBPath != "" && !geoipSupported {
+		log.Fatal("-geoip-db needs a build with -tags geoip")
+	}
+	if otelTracePath != "" && !otelSupported {
+		log.Fatal("-otel-trace-file needs a build with -tags otel")
+	}
+	if backendTFO && !tfoSupported {
+		log.Println("Warning: -backend-tfo is only supported on Linux, dialing backends without it")
+		backendTFO = false
+	}
+
+	if bindRetry < 0 {
+		log.Fatal("-bind-retry must not be negative")
+	}
+	if maxConns < 0 {
+		log.Fatal("-max-conns must not be negative")
+	}
+	if dialTimeout <= 0 {
+		log.Fatal("-dial-timeout must be positive")
+	}
+	if dialQueueTimeout <= 0 {
+		log.Fatal("-dial-queue-timeout must be positive")
+	}
+	if maxRoutes < 0 {
+		log.Fatal("-max-routes must not be negative")
+	}
+	flagRoutes := append([]string(nil), routes...)
+	var configUpstreams []string
+	if configPath != "" {
+		fc, err := loadConfig(configPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		upstreamSpecs = append(upstreamSpecs, fc.Upstreams...)
+		routes = append(routes, fc.Routes...)
+		configUpstreams = fc.Upstreams
+	}
+
+	if len(allowTargetSpecs) > 0 {
+		allowlist, err := parseTargetAllowlist(allowTargetSpecs)
+		if err != nil {
+			log.Fatal(err)
+		}
+		allowedTargets = allowlist
+	}
+
+	for _, spec := range upstreamSpecs {
+		pool, err := parseUpstream(spec)
+		if err != nil {
+			log.Fatalf("Failed to parse upstreams: %v", err)
+		}
+		for _, b := range pool.backends {
+			if !allowedTargets.Allows(b) {
+				log.Fatalf("Failed to parse upstreams: upstream %s: target '%s' is not allowed by -allow-target", pool.name, b)
+			}
+		}
+		if _, exists := upstreams[pool.name]; exists {
+			log.Fatalf("Failed to parse upstreams: duplicate upstream: %s", pool.name)
+		}
+		upstreams[pool.name] = pool
+	}
+
+	// Parse routes with new logic
+	routeMap, err := parseRoutes(routes)
+	if err != nil {
+		log.Fatalf("Failed to parse routes: %v", err)
+	}
+
+	var resolver *net.Resolver
+	if resolverAddr != "" {
+		if resolver, err = newResolver(resolverAddr); err != nil {
+			log.Fatal(err)
 		}
+		log.Printf("Resolving backends via %s", resolverAddr)
+	}
 
-		if _, exists := rm.rules[cfg.Host]; exists {
-			return nil, fmt.Errorf("duplicate route for host: %s", cfg.Host)
-		}
+	if maxLeadingRecords < 0 {
+		log.Fatal("-max-leading-records must not be negative")
+	}
+	if maxInflight < 0 {
+		log.Fatal("-max-inflight must not be negative")
+	}
 
-		rm.rules[cfg.Host] = cfg
+	rejects, err := parseSampleRate(rejectLogSample)
+	if err != nil {
+		log.Fatal(err)
 	}
 
-	return rm, nil
-}
+	if sniExtensionType < 0 || sniExtensionType > 0xffff {
+		log.Fatal("-sni-extension-type must be between 0 and 65535")
+	}
 
-// parseRoute parses a single route string
-func parseRoute(route string) (*RouteConfig, error) {
-	var proxyAddr string
-	remainder := route
+	var minVersion uint16
+	if minTLSVersion != "" {
+		if minVersion, err = parseTLSVersion(minTLSVersion); err != nil {
+			log.Fatalf("Invalid -min-tls-version: %v", err)
+		}
+	}
 
-	// Extract SOCKS5 proxy if @ delimiter present
-	if idx := strings.LastIndex(route, "@"); idx != -1 {
-		proxyAddr = strings.TrimSpace(route[idx+1:])
-		remainder = strings.TrimSpace(route[:idx])
+	deniedExts, err := parseExtensionTypes(denyExtSpecs)
+	if err != nil {
+		log.Fatalf("Invalid -deny-tls-extension: %v", err)
+	}
 
-		// Validate proxy address format (must be host:port)
-		if proxyAddr != "" {
-			if _, _, err := net.SplitHostPort(proxyAddr); err != nil {
-				return nil, fmt.Errorf("invalid SOCKS proxy address '%s': %v", proxyAddr, err)
-			}
+	if exportPath != "" {
+		if err := exportConfig(exportPath, routeMap); err != nil {
+			log.Fatal(err)
 		}
+		log.Printf("Exported %d upstreams and %d routes to %s", len(upstreams), len(routeMap.Routes()), exportPath)
+		return
 	}
 
-	// Detect and reject old format (in the remainder)
-	if strings.Contains(remainder, ":") && !strings.Contains(remainder, "=") {
-		return nil, fmt.Errorf("invalid route format '%s'\n"+
-			"Use: -route hostname=:port or -route hostname", route)
+	if selfTest {
+		if !runSelfTest(os.Stdout, routeMap, resolver) {
+			os.Exit(1)
+		}
+		return
 	}
 
-	// Passthrough format: just hostname
-	if !strings.Contains(remainder, "=") {
-		host := strings.TrimSpace(remainder)
-		if host == "" {
-			return nil, fmt.Errorf("empty hostname")
+	if dumpCfg {
+		if err := dumpConfig(os.Stdout, routeMap); err != nil {
+			log.Fatalf("Failed to dump config: %v", err)
 		}
-		return &RouteConfig{Host: host, Passthrough: true, ProxyAddr: proxyAddr}, nil
 	}
 
-	// Route format: hostname=target
-	parts := strings.SplitN(remainder, "=", 2)
-	host := strings.TrimSpace(parts[0])
-	target := strings.TrimSpace(parts[1])
-
-	if host == "" {
-		return nil, fmt.Errorf("empty hostname")
+	srv := &server{resolver: resolver, rejects: rejects, minVersion: minVersion, deniedExts: deniedExts, flagRoutes: flagRoutes, configUpstreams: configUpstreams}
+	srv.routes.Store(routeMap)
+	srv.live = newLiveConns()
+	if eventWebhookURL != "" {
+		if eventQueueSize <= 0 {
+			log.Fatal("-event-queue-size must be positive")
+		}
+		srv.events = newEventWebhook(eventWebhookURL, eventQueueSize)
 	}
-	if target == "" {
-		return nil, fmt.Errorf("target required when using '=' syntax")
+	if controlURL != "" {
+		if controlCacheTTL <= 0 {
+			log.Fatal("-control-cache-ttl must be positive")
+		}
+		if srv.control, err = newControlClient(controlURL, controlCacheTTL); err != nil {
+			log.Fatal(err)
+		}
 	}
-
-	// Normalize :port to localhost:port
-	if strings.HasPrefix(target, ":") {
-		port := target[1:]
-		if _, err := strconv.Atoi(port); err != nil {
-			return nil, fmt.Errorf("invalid port '%s': %v", port, err)
+	if connLogPath != "" {
+		if connLogMaxSize < 0 {
+			log.Fatal("-conn-log-max-size must not be negative")
 		}
-		target = "localhost" + target
-	} else {
-		// Validate host:port format
-		if _, _, err := net.SplitHostPort(target); err != nil {
-			return nil, fmt.Errorf("invalid target '%s': %v", target, err)
+		if err := validateConnLogCompress(connLogCompress); err != nil {
+			log.Fatalf("Invalid -conn-log-compress: %v", err)
+		}
+		var chainKey []byte
+		if connLogChainKey != "" {
+			if chainKey, err = loadChainKey(connLogChainKey); err != nil {
+				log.Fatal(err)
+			}
+		}
+		if srv.connLog, err = newConnLog(connLogPath, connLogMaxSize, connLogCompress, chainKey); err != nil {
+			log.Fatal(err)
 		}
 	}
-
-	return &RouteConfig{Host: host, Target: target, Passthrough: false, ProxyAddr: proxyAddr}, nil
-}
-
-// createDialer creates a dialer function that optionally uses a SOCKS proxy
-func createDialer(socksAddr string, timeout time.Duration) (func(network, addr string) (net.Conn, error), error) {
-	if socksAddr == "" {
-		d := &net.Dialer{Timeout: timeout}
-		return d.Dial, nil
+	if rulesPath != "" {
+		if srv.rules, err = loadRules(rulesPath); err != nil {
+			log.Fatal(err)
+		}
 	}
-	if _, _, err := net.SplitHostPort(socksAddr); err != nil {
-		return nil, fmt.Errorf("invalid SOCKS proxy address '%s': %v", socksAddr, err)
+	var allowlistHosts int
+	if passthroughAllowPath != "" {
+		if passthroughAllowFP <= 0 || passthroughAllowFP >= 1 {
+			log.Fatal("-passthrough-allowlist-fp must be between 0 and 1")
+		}
+		if srv.allowlist, allowlistHosts, err = loadAllowlist(passthroughAllowPath, passthroughAllowFP); err != nil {
+			log.Fatal(err)
+		}
 	}
-	socksDialer, err := proxy.SOCKS5("tcp", socksAddr, nil, &net.Dialer{Timeout: timeout})
-	if err != nil {
-		return nil, fmt.Errorf("failed to create SOCKS5 dialer: %v", err)
+	if geoipDBPath != "" {
+		if err := validateGeoLabel(geoipLabel); err != nil {
+			log.Fatalf("Invalid -geoip-label: %v", err)
+		}
+		if srv.geo, err = openGeoDB(geoipDBPath, geoipLabel); err != nil {
+			log.Fatal(err)
+		}
 	}
-	return socksDialer.Dial, nil
-}
-
-func main() {
-	flag.StringVar(&listen, "listen", ":443", "Listen address")
-	flag.Var(&routes, "route", "SNI route mapping (format: hostname[@proxy] or hostname=target[@proxy])")
-	flag.Parse()
-
-	// Parse routes with new logic
-	routeMap, err := parseRoutes(routes)
-	if err != nil {
-		log.Fatalf("Failed to parse routes: %v", err)
+	var stopTracing func() error
+	if otelTracePath != "" {
+		if srv.tracer, stopTracing, err = openTracer(otelTracePath); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if scanThreshold > 0 {
+		srv.scans = newScanTracker(scanWindow, scanThreshold, scanBlock)
+	}
+	if repeatThreshold > 0 {
+		if repeatCacheSize <= 0 {
+			log.Fatal("-hello-repeat-cache must be positive")
+		}
+		srv.repeats = newRepeatTracker(repeatWindow, repeatThreshold, repeatCacheSize)
 	}
 
 	// Log configuration
 	log.Printf("Starting SNI proxy on %s", listen)
-	if len(routeMap.rules) > 0 {
+	if noForward {
+		log.Println("Running with -no-forward: connections are routed and logged but never forwarded")
+	}
+	if srv.rules != nil {
+		log.Printf("Loaded %d rules from %s, tried before routes", len(srv.rules.rules), rulesPath)
+	}
+	if srv.geo != nil {
+		log.Printf("Labeling connection and byte metrics by client %s from %s", geoipLabel, geoipDBPath)
+	}
+	if srv.tracer != nil {
+		log.Printf("Writing a trace span per connection to %s", otelTracePath)
+	}
+	if srv.allowlist != nil {
+		log.Printf("Passthrough limited to %d hostnames from %s (%d KiB Bloom filter, %g false positive rate)",
+			allowlistHosts, passthroughAllowPath, (srv.allowlist.Size()+1023)>>10, passthroughAllowFP)
+	}
+	if len(routeMap.Routes()) > 0 {
 		log.Println("Configured routes:")
-		for host, cfg := range routeMap.rules {
+		for _, cfg := range routeMap.Routes() {
+			host := cfg.Host
+			if cfg.NoALPN {
+				host += " (noalpn)"
+			}
+			if cfg.NoReplay {
+				log.Printf("Warning: route %s has replay=false; its backend never sees the ClientHello. Use for debugging only", cfg.Host)
+			}
+			if maxInflight > 0 && cfg.CopyBuffer > maxInflight {
+				log.Printf("Warning: route %s has copybuf=%dk, larger than -max-inflight %d; copying through the -max-inflight window instead", cfg.Host, cfg.CopyBuffer>>10, maxInflight)
+			}
 			proxyInfo := ""
 			if cfg.ProxyAddr != "" {
-				proxyInfo = fmt.Sprintf(" via SOCKS5 %s", cfg.ProxyAddr)
+				proxyInfo = fmt.Sprintf(" via SOCKS5 %s", strings.Join(cfg.proxies(), "|"))
+				if len(cfg.ExtraProxies) > 0 {
+					proxyInfo += fmt.Sprintf(" (%s)", cfg.ProxySelect)
+				}
+				if cfg.ProxyWindow != nil {
+					proxyInfo += fmt.Sprintf(" during %s", cfg.ProxyWindow)
+				}
+			}
+			if cfg.Dialer != "" {
+				proxyInfo += " over dialer " + cfg.Dialer
 			}
 
-			if cfg.Passthrough {
-				log.Printf("  %s -> %s:443 (passthrough)%s", host, host, proxyInfo)
+			if cfg.Reject {
+				log.Printf("  %s -> reject (blocked)", host)
+			} else if cfg.Maintenance != "" {
+				log.Printf("  %s -> %s alert (maintenance)", host, cfg.Maintenance)
+			} else if cfg.Upstream != "" {
+				log.Printf("  %s -> upstream %s (consistent hash)%s", host, cfg.Upstream, proxyInfo)
+			} else if cfg.Passthrough && transparent {
+				log.Printf("  %s -> original destination (transparent)%s", host, proxyInfo)
+			} else if cfg.Passthrough && !cfg.exactHost() {
+				log.Printf("  %s -> <sni>:%s (passthrough)%s", host, cfg.passthroughPort(), proxyInfo)
+			} else if cfg.Passthrough {
+				log.Printf("  %s -> %s (passthrough)%s", host, net.JoinHostPort(cfg.Host, cfg.passthroughPort()), proxyInfo)
 			} else {
-				log.Printf("  %s -> %s (routed)%s", host, cfg.Target, proxyInfo)
+				targets := append([]string{cfg.Target}, cfg.Fallbacks...)
+				log.Printf("  %s -> %s (routed)%s", host, strings.Join(targets, " | "), proxyInfo)
 			}
 		}
-	} else {
+	} else if srv.control == nil && srv.rules == nil {
 		log.Println("Warning: No routes configured - all connections will be rejected")
 	}
 
-	l, err := net.Listen("tcp", listen)
+	adminTLS, err := adminTLSConfig(adminTLSCert, adminTLSKey, adminClientCA)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if adminAddr != "" {
+		if err := startAdmin(adminAddr, srv, adminTLS); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if expvarAddr != "" {
+		if err := startExpvar(expvarAddr, adminTLS); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	// Prefer a socket inherited from systemd or handed over by a previous
+	// process, falling back to binding ourselves
+	l, err := systemdListener()
 	if err != nil {
 		log.Fatal(err)
 	}
+	if l != nil {
+		log.Printf("Using socket-activated listener on %s", l.Addr())
+	} else if handoffPath != "" {
+		if l, err = receiveListener(handoffPath); err != nil {
+			log.Fatal(err)
+		}
+		if l != nil {
+			log.Printf("Took over listener on %s from the previous process", l.Addr())
+		}
+	}
+	if l == nil {
+		if l, err = listenRetry(listenNetwork, listen, bindRetry); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if pidFile != "" {
+		if err := writePIDFile(pidFile); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	// Let a successor take over the listener; this process then drains
+	if handoffPath != "" {
+		err := serveHandoff(handoffPath, l, func() {
+			draining.Store(true)
+			l.Close()
+		})
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	// Drop privileges once all sockets are bound, before accepting connections
+	if runAsUser != "" || runAsGroup != "" {
+		if err := dropPrivileges(runAsUser, runAsGroup); err != nil {
+			log.Fatalf("Failed to drop privileges: %v", err)
+		}
+		log.Printf("Dropped privileges to uid %d, gid %d", os.Getuid(), os.Getgid())
+	}
+	ready.Store(true)
+	started := clk.Now()
+
+	// Stop accepting on SIGINT/SIGTERM and let active connections drain
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+		s := <-sig
+		log.Printf("Received %s, draining connections", s)
+		draining.Store(true)
+		l.Close()
+	}()
+
+	// Reload the routes from -config on SIGHUP
+	if configPath != "" {
+		go func() {
+			hup := make(chan os.Signal, 1)
+			signal.Notify(hup, syscall.SIGHUP)
+			for range hup {
+				if rm, err := srv.reload(); err != nil {
+					log.Printf("Failed to reload %s, keeping the current routes: %v", configPath, err)
+				} else {
+					log.Printf("Reloaded %d routes from %s on SIGHUP", rm.len(), configPath)
+				}
+			}
+		}()
+	}
+
+	srv.serve(l)
+
+	srv.waitForDrain(shutdownTimeout)
+
+	if srv.events != nil {
+		srv.events.Close()
+	}
+	if srv.connLog != nil {
+		srv.connLog.Close()
+	}
+	if stopTracing != nil {
+		if err := stopTracing(); err != nil {
+			log.Printf("Failed to flush trace spans: %v", err)
+		}
+	}
+
+	// Account for the process lifetime
+	var summary strings.Builder
+	writeSummary(&summary, clk.Since(started), summaryLogRoutes)
+	for _, line := range strings.Split(strings.TrimSuffix(summary.String(), "\n"), "\n") {
+		log.Print(line)
+	}
+	if summaryPath != "" {
+		summary.Reset()
+		writeSummary(&summary, clk.Since(started), 0)
+		if err := os.WriteFile(summaryPath, []byte(summary.String()), 0o644); err != nil {
+			log.Printf("Failed to write summary to %s: %v", summaryPath, err)
+		}
+	}
+
+	if pidFile != "" {
+		if err := removePIDFile(pidFile); err != nil {
+			log.Print(err)
+		}
+	}
+}
+
+// waitForDrain blocks until all active connections close or timeout elapses,
+// periodically logging how many connections remain
+func (s *server) waitForDrain(timeout time.Duration) {
+	done := make(chan struct{})
+	go func() {
+		s.active.Wait()
+		close(done)
+	}()
+
+	deadline := clk.After(timeout)
+	ticker := clk.NewTicker(drainLogInterval)
+	defer ticker.Stop()
+
+	log.Printf("Waiting up to %s for %d active connections", timeout, activeConns.Load())
+	for {
+		select {
+		case <-done:
+			log.Println("All connections closed, exiting")
+			return
+		case <-ticker.C():
+			log.Printf("Draining: %d active connections remaining", activeConns.Load())
+		case <-deadline:
+			log.Printf("Shutdown timeout of %s reached, exiting with %d active connections", timeout, activeConns.Load())
+			return
+		}
+	}
+}
 
+// serve accepts connections on l until it is closed, handling each on its
+// own goroutine. A panic while handling one only closes that connection.
+func (s *server) serve(l net.Listener) {
+	var tempDelay time.Duration // Backoff after temporary accept errors, e.g. fd exhaustion
 	for {
 		conn, err := l.Accept()
 		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				break
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				if tempDelay == 0 {
+					tempDelay = 5 * time.Millisecond
+				} else {
+					tempDelay *= 2
+				}
+				if tempDelay > maxAcceptDelay {
+					tempDelay = maxAcceptDelay
+				}
+				log.Printf("Accept error: %v; retrying in %s", err, tempDelay)
+				time.Sleep(tempDelay)
+				continue
+			}
 			log.Printf("Accept error: %v", err)
 			continue
 		}
-		go handleConn(conn, routeMap)
+		tempDelay = 0
+		connsAccepted.inc()
+		// Last-resort shedding: beyond -max-conns, close without reading
+		if maxConns > 0 && activeConns.Load() >= int64(maxConns) {
+			s.reject(rejectPolicy, "overloaded", "closed connection from %s: %d active connections reached -max-conns", clientIP(conn), maxConns)
+			conn.Close()
+			continue
+		}
+		s.active.Add(1)
+		activeConns.Add(1)
+		id := nextConnID.Add(1)
+		go func() {
+			defer s.active.Done()
+			defer activeConns.Add(-1)
+			defer recoverConn(id, conn)
+			s.handleConn(id, conn)
+		}()
+	}
+}
+
+// nextConnID numbers accepted connections, to tell them apart in panic reports
+var nextConnID atomic.Uint64
+
+// recoverConn stops a panic while handling connection id from taking down
+// the process, logging it with a stack trace and closing the connection
+func recoverConn(id uint64, conn net.Conn) {
+	r := recover()
+	if r == nil {
+		return
 	}
+	connPanics.inc()
+	log.Printf("Panic handling connection %d from %s: %v\n%s", id, conn.RemoteAddr(), r, debug.Stack())
+	conn.Close()
 }
 
-func handleConn(conn net.Conn, routes *RouteMap) {
+func (s *server) handleConn(id uint64, conn net.Conn) {
 	defer conn.Close()
-	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
 
-	// Read ClientHello
-	var buf bytes.Buffer
-	if _, err := io.CopyN(&buf, conn, 5); err != nil {
-		log.Printf("Failed to read TLS record header: %v", err)
+	ip := clientIP(conn)
+	span := s.startSpan(id, ip)
+	defer span.End()
+	var geo, geoField string
+	if s.geo != nil {
+		geo = s.geo.Label(ip)
+		geoField = ", client in " + geo
+		geoConns.inc(geo)
+	}
+	if s.scans != nil && s.scans.Blocked(ip) {
+		connsRejected.inc(rejectPolicy, "scan_blocked")
+		debugf("Dropped connection from %s blocked for SNI scanning", ip)
 		return
 	}
 
-	length := binary.BigEndian.Uint16(buf.Bytes()[3:5])
-	if _, err := io.CopyN(&buf, conn, int64(length)); err != nil {
-		log.Printf("Failed to read TLS record: %v", err)
+	conn.SetReadDeadline(time.Now().Add(helloTimeout))
+	helloStart := clk.Now()
+
+	// Read ClientHello, dropping up to -max-leading-records change_cipher_spec
+	// records first. Backends would reject them before a ClientHello, so they
+	// are not replayed.
+	peek := &peeker{conn: conn}
+	for skipped := 0; ; skipped++ {
+		peek.Discard()
+		hdr, err := peek.Peek(5)
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			s.reject(rejectMalformed, "hello_timeout", "timed out waiting for TLS record header from %s", ip)
+			return
+		}
+		if err != nil {
+			s.reject(rejectMalformed, "read_header", "failed to read TLS record header from %s: %v", ip, err)
+			return
+		}
+		if !plausibleRecordHeader(hdr) {
+			s.reject(rejectMalformed, "not_tls", "connection from %s is not TLS, starts with %+q", ip, hdr)
+			return
+		}
+
+		length := binary.BigEndian.Uint16(hdr[3:5])
+		if int(length) < minRecordLength(hdr[0]) {
+			s.reject(rejectMalformed, "short_record", "TLS record from %s advertises only %d bytes", ip, length)
+			return
+		}
+		// Peek keeps reading until the whole body arrives, however the client
+		// segments it, so only the deadline or a failed read ends it early
+		if _, err := peek.Peek(int(length)); errors.Is(err, os.ErrDeadlineExceeded) {
+			s.reject(rejectMalformed, "hello_timeout", "timed out after %d of %d bytes of TLS record from %s", len(peek.Bytes())-5, length, ip)
+			return
+		} else if err != nil {
+			s.reject(rejectMalformed, "read_record", "failed to read TLS record from %s: %v", ip, err)
+			return
+		}
+
+		if hdr[0] != recordTypeChangeCipherSpec || skipped == maxLeadingRecords {
+			break
+		}
+		debugf("Skipping leading change_cipher_spec record from %s", ip)
+	}
+	if peek.Bytes()[0] == recordTypeChangeCipherSpec {
+		s.reject(rejectMalformed, "no_handshake", "no handshake from %s after %d change_cipher_spec records", ip, maxLeadingRecords+1)
 		return
 	}
 
+	// Judge the delivery rate only for ClientHellos that took a while, since
+	// network latency alone makes any short read look slow
+	if elapsed := clk.Since(helloStart); slowHandshakeRate > 0 && elapsed >= slowHandshakeMinTime {
+		if rate := float64(len(peek.Bytes())) / elapsed.Seconds(); rate < float64(slowHandshakeRate) {
+			slowHandshakes.inc()
+			if dropSlowHandshakes {
+				s.reject(rejectMalformed, "slow_handshake", "ClientHello from %s arrived at %.0f bytes/s over %s", ip, rate, elapsed.Round(time.Millisecond))
+				return
+			}
+			log.Printf("Warning: slow ClientHello from %s, %.0f bytes/s over %s", ip, rate, elapsed.Round(time.Millisecond))
+		}
+	}
+
 	// Parse SNI
-	ch, ok := ParseClientHello(buf.Bytes())
-	if !ok || ch.SNI == "" {
-		log.Println("Failed to extract SNI")
+	ch, err := ParseClientHello(peek.Bytes())
+	if err != nil {
+		s.reject(rejectMalformed, "parse_error", "failed to parse ClientHello from %s: %v", ip, err)
+		return
+	}
+	if v := ch.MaxVersion(); v < s.minVersion {
+		s.reject(rejectPolicy, "tls_version", "client %s offers at most %s, below -min-tls-version", ip, tls.VersionName(v))
+		return
+	}
+	for _, t := range ch.Extensions {
+		if s.deniedExts[t] {
+			s.reject(rejectPolicy, "denied_extension", "ClientHello from %s carries denied extension type %d", ip, t)
+			return
+		}
+	}
+	if sniExtensionType > 0 {
+		if name, ok := ch.Extension(uint16(sniExtensionType)); ok {
+			debugf("Routing %s on extension %d %q instead of SNI %q", ip, sniExtensionType, name, ch.SNI)
+			ch.SNI = string(name)
+		}
+	}
+	if ch.SNI == "" {
+		s.reject(rejectPolicy, "no_sni", "ClientHello from %s has no SNI", ip)
 		return
 	}
+	ch.SNI = normalizeHost(ch.SNI)
+	if rejectIPSNI {
+		if _, err := netip.ParseAddr(ch.SNI); err == nil {
+			s.reject(rejectPolicy, "ip_sni", "ClientHello from %s has an IP literal SNI %s", ip, ch.SNI)
+			return
+		}
+	}
+	debugf("ClientHello from %s: sni=%q alpn=%q record_version=%s version=%s supported_versions=%s effective_version=%s extensions=%v",
+		conn.RemoteAddr(), ch.SNI, ch.ALPN, tls.VersionName(ch.RecordVersion), tls.VersionName(ch.Version),
+		formatVersions(ch.SupportedVersions), tls.VersionName(ch.MaxVersion()), ch.Extensions)
+
+	if s.repeats != nil {
+		if alert, distinct := s.repeats.Observe(ip, peek.Bytes()); alert {
+			helloRepeatAlert.inc()
+			log.Printf("Warning: identical ClientHello for %s seen from %d client IPs within %s, possible replay", ch.SNI, distinct, s.repeats.window)
+		}
+	}
+	if s.scans != nil {
+		if alert, distinct := s.scans.Observe(ip, ch.SNI); alert {
+			scanAlerts.inc()
+			log.Printf("Warning: %s probed %d distinct SNIs within %s, possible scanner", ip, distinct, s.scans.window)
+		}
+	}
+
+	// Rules take precedence over routes, which are only consulted when no
+	// rule matches
+	var cfg *RouteConfig
+	var allowed bool
+	if s.rules != nil {
+		if r := s.rules.Match(ch.SNI, ch.HasALPN, ip, clk.Now()); r != nil {
+			if r.deny {
+				s.reject(rejectPolicy, "rule_denied", "connection to %s from %s denied by rule on line %d: %s", ch.SNI, ip, r.line, r.text)
+				return
+			}
+			debugf("%s from %s matched rule on line %d: %s", ch.SNI, ip, r.line, r.text)
+			cfg, allowed = r.route, true
+		}
+	}
 
 	// Lookup host in route map (filtering happens here)
-	cfg, allowed := routes.Lookup(ch.SNI)
 	if !allowed {
-		log.Printf("Rejected connection to unconfigured host: %s", ch.SNI)
+		if logLevel == "debug" {
+			var reason string
+			cfg, reason = s.routes.Load().MatchBest(ch.SNI, ch.HasALPN)
+			allowed = cfg != nil
+			debugf("Route for %s: %s", ch.SNI, reason)
+		} else {
+			cfg, allowed = s.routes.Load().LookupHello(ch.SNI, ch.HasALPN)
+		}
+		if allowed && cfg.Host == routeDefaultHost {
+			defaultRouted.inc()
+			if warnOnDefault {
+				log.Printf("Warning: SNI %s from %s served by default route", ch.SNI, ip)
+			}
+		}
+	}
+	routeLabel := ""
+	if !allowed && s.control != nil {
+		cfg, allowed = s.control.Lookup(ch.SNI)
+		routeLabel = "control" // Control answers are per SNI, too many for a label
+	}
+	if allowed && cfg.Reject {
+		s.reject(rejectPolicy, "blocked", "connection to explicitly blocked host %s from %s", ch.SNI, ip)
+		return
+	}
+	if allowed && cfg.Maintenance != "" {
+		// Tell the client the route is down instead of dialing its backend
+		if err := writeAlert(conn, cfg.Maintenance); err != nil {
+			debugf("Failed to send %s alert to %s: %v", cfg.Maintenance, ip, err)
+		}
+		s.reject(rejectPolicy, "maintenance", "connection to %s from %s during maintenance, sent %s alert", ch.SNI, ip, cfg.Maintenance)
+		return
+	}
+	if !allowed {
+		s.reject(rejectPolicy, "unconfigured", "connection to unconfigured host %s from %s", ch.SNI, ip)
+		return
+	}
+	if cfg.Passthrough && s.allowlist != nil && !s.allowlist.Has(ch.SNI) {
+		s.reject(rejectPolicy, "not_allowlisted", "passthrough to %s from %s is not in -passthrough-allowlist", ch.SNI, ip)
 		return
 	}
 
 	// Determine backend based on RouteConfig
 	var backend string
+	var fallbacks []string
 	var routeType string
 
-	if cfg.Passthrough {
-		backend = ch.SNI + ":443"
+	if cfg.Upstream != "" {
+		backend = upstreams[cfg.Upstream].Pick(ch.SNI)
+		routeType = "upstream " + cfg.Upstream
+	} else if cfg.Passthrough && transparent {
+		dst, err := getOriginalDst(conn)
+		if err != nil {
+			log.Printf("Failed to get original destination for %s: %v", ch.SNI, err)
+			return
+		}
+		backend = dst
+		routeType = "transparent"
+	} else if cfg.Passthrough {
+		backend = net.JoinHostPort(ch.SNI, cfg.passthroughPort())
 		routeType = "passthrough"
 	} else {
-		backend = cfg.Target
+		backend = cfg.backendFor(ch.SNI)
+		fallbacks = cfg.fallbacksFor(ch.SNI)
 		routeType = "routed"
 	}
+	if cfg.Host != ch.SNI {
+		routeType += ", route " + cfg.Host
+	}
+	if cfg.NoALPN {
+		routeType += ", noalpn"
+	}
+
+	// Backends computed per connection may not have been checked at parse time
+	if !allowedTargets.Allows(backend) {
+		s.reject(rejectPolicy, "target_denied", "backend %s for %s from %s is not allowed by -allow-target", backend, ch.SNI, ip)
+		return
+	}
+	allowedFallbacks := fallbacks[:0]
+	for _, fb := range fallbacks {
+		if allowedTargets.Allows(fb) {
+			allowedFallbacks = append(allowedFallbacks, fb)
+		} else {
+			log.Printf("Skipping fallback %s for %s: not allowed by -allow-target", fb, ch.SNI)
+		}
+	}
+	fallbacks = allowedFallbacks
+
+	// Use the route's SOCKS proxy, dialing direct outside its proxy window.
+	// The path actually taken is logged whenever the route has a proxy.
+	proxyAddr := cfg.pickProxy()
+	if cfg.ProxyWindow != nil && !cfg.ProxyWindow.Contains(clk.Now()) {
+		debugf("Dialing %s directly, outside proxy window %s", backend, cfg.ProxyWindow)
+		proxyAddr = ""
+	}
+	proxyPath := "direct"
+	if proxyAddr != "" {
+		proxyPath = "SOCKS5 " + proxyAddr
+	}
+	if cfg.ProxyAddr != "" {
+		routeType += ", " + proxyPath
+	}
+	if cfg.Dialer != "" {
+		routeType += ", dialer " + cfg.Dialer
+	}
+
+	if routeLabel == "" {
+		routeLabel = cfg.Host
+	}
+	routeALPN.inc(routeLabel, alpnLabel(ch))
+	span.SetString("proxys.sni", ch.SNI)
+	span.SetString("proxys.route_type", routeType)
+	span.SetString("proxys.backend", backend)
+
+	// Shadow-test mode: report the decision without touching the backend
+	if noForward {
+		if len(fallbacks) > 0 {
+			backend = strings.Join(append([]string{backend}, fallbacks...), " | ")
+		}
+		log.Printf("%s -> %s (%s, not forwarded)", ch.SNI, backend, routeType)
+		return
+	}
 
-	log.Printf("%s -> %s (%s)", ch.SNI, backend, routeType)
+	if cfg.Log == routeLogFull && (cfg.logLimit == nil || cfg.logLimit.Allow()) {
+		log.Printf("%s -> %s (%s)", ch.SNI, backend, routeType)
+	}
 
-	// Create dialer based on route's SOCKS proxy setting
-	dialer, err := createDialer(cfg.ProxyAddr, 10*time.Second)
+	dialer, err := createDialer(proxyAddr, cfg.baseDialer(s.resolver), cfg.dialTimeout())
 	if err != nil {
 		log.Printf("Failed to create dialer for %s: %v", ch.SNI, err)
 		return
 	}
 
-	// Connect to backend
+	// Connect to backend, waiting for a dial slot on routes that limit
+	// concurrent dials
 	conn.SetReadDeadline(time.Time{})
-	backendConn, err := dialer("tcp", backend)
+	if !cfg.acquireDial(dialQueueTimeout) {
+		s.reject(rejectPolicy, "dial_shed", "no dial slot for %s from %s within %s (maxdialconcurrency=%d)", ch.SNI, ip, dialQueueTimeout, cfg.MaxDials)
+		return
+	}
+	dialStart := clk.Now()
+	backendConn, err := dialer(backendNetwork, backend)
+	if proxyAddr != "" {
+		// A failed dial counts as a full timeout against the proxy's latency
+		took := clk.Since(dialStart)
+		if err != nil {
+			took = cfg.dialTimeout()
+		}
+		est := proxyLatency.Observe(proxyAddr, took)
+		debugf("Dial via SOCKS5 %s took %s (estimate %s)", proxyAddr, took.Round(time.Millisecond), est.Round(time.Millisecond))
+	}
+	for _, next := range fallbacks {
+		if err == nil {
+			break
+		}
+		backendFallbacks.inc()
+		log.Printf("Failed to connect to backend %s: %v, falling back to %s", backend, err, next)
+		backend = next
+		backendConn, err = dialer(backendNetwork, backend)
+	}
+	cfg.releaseDial()
 	if err != nil {
 		log.Printf("Failed to connect to backend %s: %v", backend, err)
+		span.Event("dial_failed", spanAttr{"backend", backend}, spanAttr{"error", err.Error()})
+		span.Fail("dial failed")
 		return
 	}
+	span.SetString("proxys.backend", backend)
+	span.Event("dial", spanAttr{"backend", backend}, spanAttr{"path", proxyPath}, durationAttr("took", clk.Since(dialStart)))
 	defer backendConn.Close()
+	backendLocal := backendConn.LocalAddr().String()
+	backendConns.inc(proxyPath)
+	debugf("%s connected to backend %s from %s, %s", ch.SNI, backend, backendLocal, proxyPath)
+
+	if s.events != nil {
+		s.events.Send(connEvent{Type: "open", Time: clk.Now(), SNI: ch.SNI, ClientIP: ip, Backend: backend, BackendLocal: backendLocal})
+	}
+
+	// Replay ClientHello to backend, bounded separately from the copy so a
+	// backend that accepts but never reads cannot hold the client forever.
+	// replay=false drops it instead, so the backend only sees what the
+	// client sends next.
+	var replayed int
+	if cfg.NoReplay {
+		debugf("Dropping %d byte ClientHello for %s instead of replaying it (replay=false)", len(peek.Bytes()), backend)
+		peek.Discard()
+	} else {
+		if coalesceReplay > 0 {
+			if n := peek.Coalesce(maxCoalesceBytes, coalesceReplay); n > 0 {
+				debugf("Coalesced %d client bytes into the replay to %s", n, backend)
+			}
+		}
+		backendConn.SetWriteDeadline(time.Now().Add(replayTimeout))
+		if replayed, err = peek.Replay(backendConn); err != nil {
+			log.Printf("Failed to replay ClientHello to backend %s: %v", backend, err)
+			return
+		}
+		backendConn.SetWriteDeadline(time.Time{})
+	}
+
+	// The extension bodies alias the handshake buffer the peeker just let
+	// go of, and ch is kept for the close log
+	ch.ExtensionData = nil
 
-	// Replay ClientHello to backend
-	c := &prefixConn{
-		Conn:   conn,
-		Reader: io.MultiReader(&buf, conn),
+	if maxInflight > 0 {
+		limitSocketBuffers(conn, maxInflight)
+		limitSocketBuffers(backendConn, maxInflight)
 	}
+	copyFn := cfg.copyFunc()
 
-	// Bidirectional copy
+	// Catch backends that accept the connection but never respond
+	firstByte := cfg.FirstByteTimeout
+
+	// Enforce the route's byte quota across both directions
+	var toBackend, toClient io.Writer = backendConn, conn
+	if cfg.MaxBytes > 0 {
+		q := &byteQuota{limit: cfg.MaxBytes}
+		q.used.Store(int64(replayed))
+		toBackend = &quotaWriter{Writer: backendConn, q: q}
+		toClient = &quotaWriter{Writer: conn, q: q}
+	}
+
+	// List the connection on GET /connections while it relays, with byte
+	// counts updated as they flow when -live-stats is set. Counting every
+	// write rules out the kernel's zero-copy path, so it is opt-in.
+	lc := &liveConn{id: id, clientIP: ip, sni: ch.SNI, backend: backend, start: clk.Now()}
+	lc.up.Store(int64(replayed))
+	if liveStats {
+		toBackend = liveWriter{Writer: toBackend, n: &lc.up}
+		toClient = liveWriter{Writer: toClient, n: &lc.down}
+	}
+	s.live.Add(lc)
+	defer s.live.Remove(id)
+
+	// Bidirectional copy. Each goroutine owns one byte count, which is read
+	// only after both have reported on errCh.
+	start := clk.Now()
+	span.Event("copy_start")
+	upstream := int64(replayed) // Client to backend, including the replayed ClientHello
+	var downstream int64        // Backend to client
 	errCh := make(chan error, 2)
 	go func() {
-		_, err := io.Copy(backendConn, c)
+		n, err := copyFn(toBackend, conn)
+		upstream += n
 		errCh <- err
 	}()
 	go func() {
-		_, err := io.Copy(c, backendConn)
+		var n int64
+		var err error
+		if firstByte > 0 {
+			n, err = copyFirstRead(toClient, backendConn, firstByte)
+		}
+		if err == nil {
+			var m int64
+			m, err = copyFn(toClient, backendConn)
+			n += m
+		}
+		downstream = n
+		if n == 0 && errors.Is(err, os.ErrDeadlineExceeded) {
+			err = fmt.Errorf("backend %s sent no data within %s", backend, firstByte)
+		}
 		errCh <- err
 	}()
 
-	// Wait for one side to close
+	// Wait for one side to close, then tear down the other
+	reason := "eof"
 	err = <-errCh
-	if err != nil && err != io.EOF {
+	if errors.Is(err, errQuotaExceeded) {
+		log.Printf("Closing %s: byte quota of %d exceeded", ch.SNI, cfg.MaxBytes)
+		reason = "quota_exceeded"
+	} else if err != nil && err != io.EOF {
 		log.Printf("Copy error for %s: %v", ch.SNI, err)
+		reason = "error"
+	}
+	conn.Close()
+	backendConn.Close()
+	<-errCh
+
+	duration := clk.Since(start)
+	connsClosed.inc(reason)
+	span.Event("copy_end", spanAttr{"reason", reason}, durationAttr("took", duration))
+	span.SetInt("proxys.bytes_up", upstream)
+	span.SetInt("proxys.bytes_down", downstream)
+	span.SetInt("proxys.duration_ms", duration.Milliseconds())
+	span.SetString("proxys.close_reason", reason)
+	if reason != "eof" {
+		span.Fail(reason)
+	}
+	bytesTransferred.add(upstream, "upstream")
+	bytesTransferred.add(downstream, "downstream")
+	if geo != "" {
+		geoBytes.add(upstream, geo, "upstream")
+		geoBytes.add(downstream, geo, "downstream")
+	}
+	if cfg.Log != routeLogOff {
+		log.Printf("%s closed after %s, %d bytes up, %d bytes down, backend %s from %s, %s%s",
+			ch.SNI, duration.Round(time.Millisecond), upstream, downstream, backend, backendLocal, proxyPath, geoField)
+	}
+	closed := connEvent{
+		Type:         "close",
+		Time:         clk.Now(),
+		SNI:          ch.SNI,
+		ClientIP:     ip,
+		Backend:      backend,
+		BackendLocal: backendLocal,
+		BytesUp:      upstream,
+		BytesDown:    downstream,
+		Duration:     duration.Seconds(),
+		Reason:       reason,
+	}
+	if reason == "error" {
+		closed.Error = errString(err)
+	}
+	if s.events != nil {
+		s.events.Send(closed)
+	}
+	if s.connLog != nil {
+		s.connLog.Send(closed)
 	}
 }
 
-type prefixConn struct {
-	net.Conn
-	io.Reader
+// errString returns err's message, or "" for nil and io.EOF
+func errString(err error) string {
+	if err == nil || err == io.EOF {
+		return ""
+	}
+	return err.Error()
+}
+
+// alpnLabel returns the client's most preferred ALPN protocol as a metric
+// label: none without ALPN, and other for protocols outside a known set, so
+// clients cannot inflate the label's cardinality
+func alpnLabel(ch *ClientHello) string {
+	if len(ch.ALPN) == 0 {
+		return "none"
+	}
+	switch proto := ch.ALPN[0]; proto {
+	case "h2", "http/1.1", "http/1.0", "acme-tls/1", "dot", "imap", "pop3", "smtp", "xmpp-client":
+		return proto
+	}
+	return "other"
 }
 
-func (c *prefixConn) Read(p []byte) (int, error) {
-	return c.Reader.Read(p)
+// slowHandshakeMinTime is how long a ClientHello must take to arrive before
+// its rate is compared with -slow-handshake-rate
+const slowHandshakeMinTime = time.Second
+
+// clientIP returns the IP address of the connection's remote peer
+func clientIP(conn net.Conn) string {
+	host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		return conn.RemoteAddr().String()
+	}
+	return host
 }
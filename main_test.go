@@ -0,0 +1,1853 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestMain(m *testing.M) {
+	// Flags are registered in main, so set the defaults the code relies on
+	helloTimeout = 10 * time.Second
+	dialTimeout = 10 * time.Second
+	dialQueueTimeout = 5 * time.Second
+	replayTimeout = 10 * time.Second
+	backendNetwork = "tcp"
+	logLevel = "info"
+	os.Exit(m.Run())
+}
+
+// clientHello returns the first TLS record a crypto/tls client with config
+// sends, which holds its ClientHello
+func clientHello(t testing.TB, config *tls.Config) []byte {
+	t.Helper()
+	c, s := net.Pipe()
+	defer s.Close()
+	go func() {
+		tls.Client(c, config).Handshake()
+		c.Close()
+	}()
+
+	hdr := make([]byte, 5)
+	if _, err := io.ReadFull(s, hdr); err != nil {
+		t.Fatal(err)
+	}
+	record := make([]byte, 5+(int(hdr[3])<<8|int(hdr[4])))
+	copy(record, hdr)
+	if _, err := io.ReadFull(s, record[5:]); err != nil {
+		t.Fatal(err)
+	}
+	return record
+}
+
+// helloFor returns a ClientHello record for sni offering the ALPN protocols
+func helloFor(t testing.TB, sni string, alpn ...string) []byte {
+	return clientHello(t, &tls.Config{ServerName: sni, NextProtos: alpn})
+}
+
+// newTestServer returns a server for the routes, configured as with no flags
+func newTestServer(t testing.TB, routes ...string) *server {
+	t.Helper()
+	rm, err := parseRoutes(routes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &server{rejects: &sampler{n: 1}, live: newLiveConns()}
+	srv.routes.Store(rm)
+	return srv
+}
+
+// serveTest runs srv on a loopback listener until the test ends and returns
+// the listener's address
+func serveTest(t testing.TB, srv *server) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go srv.serve(l)
+	return l.Addr().String()
+}
+
+// startBackend runs handle for every connection to a loopback listener until
+// the test ends and returns the listener's address
+func startBackend(t testing.TB, handle func(net.Conn)) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go handle(conn)
+		}
+	}()
+	return l.Addr().String()
+}
+
+// dialHello connects to addr and sends hello
+func dialHello(t testing.TB, addr string, hello []byte) net.Conn {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	if _, err := conn.Write(hello); err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+// waitClosed waits up to timeout for the peer of conn to close or reset it,
+// reporting whether it did
+func waitClosed(conn net.Conn, timeout time.Duration) bool {
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	_, err := io.Copy(io.Discard, conn)
+	return !errors.Is(err, os.ErrDeadlineExceeded)
+}
+
+// waitFor polls cond until it holds or timeout elapses, reporting whether it
+// held
+func waitFor(timeout time.Duration, cond func() bool) bool {
+	for deadline := time.Now().Add(timeout); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+		if cond() {
+			return true
+		}
+	}
+	return cond()
+}
+
+// waitIdle waits for connections left over from earlier tests to finish, so
+// activeConns counts only the test's own
+func waitIdle(t *testing.T) {
+	t.Helper()
+	if !waitFor(2*time.Second, func() bool { return activeConns.Load() == 0 }) {
+		t.Fatalf("%d connections from earlier tests still active", activeConns.Load())
+	}
+}
+
+// stallDialer is a backend dialer returning in-memory connections to a
+// backend that never reads, so every write to it blocks
+type stallDialer struct{}
+
+func (stallDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	c, s := net.Pipe()
+	go func() {
+		time.Sleep(5 * time.Second)
+		s.Close()
+	}()
+	return c, nil
+}
+
+func init() {
+	registerBackendDialer("stall", stallDialer{})
+}
+
+func TestReplayTimeoutTearsDownNonReadingBackend(t *testing.T) {
+	defer func(d time.Duration) { replayTimeout = d }(replayTimeout)
+	replayTimeout = 200 * time.Millisecond
+	logs := captureLog(t)
+	addr := serveTest(t, newTestServer(t, "example.com=127.0.0.1:8443,dialer=stall"))
+
+	start := time.Now()
+	conn := dialHello(t, addr, helloFor(t, "example.com"))
+	if !waitClosed(conn, 2*time.Second) {
+		t.Fatal("connection to a backend that never reads was not torn down")
+	}
+	if took := time.Since(start); took < replayTimeout {
+		t.Errorf("torn down after %s, before -replay-timeout of %s", took, replayTimeout)
+	}
+	if want := "Failed to replay ClientHello to backend 127.0.0.1:8443"; !waitFor(time.Second, func() bool { return strings.Contains(logs.String(), want) }) {
+		t.Errorf("no %q log line:\n%s", want, logs.String())
+	}
+	waitIdle(t) // Before replayTimeout is restored
+}
+
+func TestReplayTimeoutSparesSilentBackend(t *testing.T) {
+	defer func(d time.Duration) { replayTimeout = d }(replayTimeout)
+	replayTimeout = 100 * time.Millisecond
+
+	// Take the ClientHello, then stay silent for longer than the timeout;
+	// only a route's firstbyte bounds the wait for an answer
+	hello := helloFor(t, "example.com")
+	backend := startBackend(t, func(c net.Conn) {
+		defer c.Close()
+		io.ReadFull(c, make([]byte, len(hello)))
+		time.Sleep(3 * replayTimeout)
+		io.WriteString(c, "late")
+	})
+	addr := serveTest(t, newTestServer(t, "example.com="+backend))
+
+	conn := dialHello(t, addr, hello)
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if got, err := io.ReadAll(conn); string(got) != "late" {
+		t.Errorf("read %q, %v; want the answer of a backend slower than -replay-timeout", got, err)
+	}
+	waitIdle(t) // Before replayTimeout is restored
+}
+
+func TestFirstByteDeadline(t *testing.T) {
+	logs := captureLog(t)
+	hello, slowHello := helloFor(t, "example.com"), helloFor(t, "slow.example.com")
+	stalled := make(chan struct{})
+	defer close(stalled)
+	silent := startBackend(t, func(c net.Conn) {
+		io.Copy(io.Discard, c)
+		<-stalled
+	})
+	// Answers at once, then pauses longer than firstbyte before the rest
+	slow := startBackend(t, func(c net.Conn) {
+		defer c.Close()
+		io.ReadFull(c, make([]byte, len(slowHello)))
+		io.WriteString(c, "first")
+		time.Sleep(300 * time.Millisecond)
+		io.WriteString(c, " rest")
+	})
+	addr := serveTest(t, newTestServer(t, "example.com="+silent+",firstbyte=100ms", "slow.example.com="+slow+",firstbyte=100ms"))
+
+	conn := dialHello(t, addr, hello)
+	if !waitClosed(conn, 2*time.Second) {
+		t.Fatal("connection to a silent backend outlived firstbyte")
+	}
+	if want := "backend " + silent + " sent no data within 100ms"; !waitFor(time.Second, func() bool { return strings.Contains(logs.String(), want) }) {
+		t.Errorf("no %q log line:\n%s", want, logs.String())
+	}
+
+	// The deadline only covers the first bytes, not the rest of the session
+	conn = dialHello(t, addr, slowHello)
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if got, err := io.ReadAll(conn); string(got) != "first rest" {
+		t.Errorf("read %q, %v; want the whole answer of a backend that started in time", got, err)
+	}
+}
+
+func TestReplayTimeoutSparesAnsweringBackend(t *testing.T) {
+	defer func(d time.Duration) { replayTimeout = d }(replayTimeout)
+	replayTimeout = 100 * time.Millisecond
+
+	// Answer the ClientHello, then echo for longer than the timeout
+	hello := helloFor(t, "example.com")
+	backend := startBackend(t, func(c net.Conn) {
+		defer c.Close()
+		io.ReadFull(c, make([]byte, len(hello)))
+		c.Write([]byte("hello"))
+		io.Copy(c, c)
+	})
+	addr := serveTest(t, newTestServer(t, "example.com="+backend))
+
+	conn := dialHello(t, addr, hello)
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(3 * replayTimeout)
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := io.ReadFull(conn, buf[:4]); err != nil || string(buf[:4]) != "ping" {
+		t.Errorf("echo after the first byte = %q, %v; want ping", buf[:4], err)
+	}
+}
+
+func TestParseRoutePatternSeparators(t *testing.T) {
+	tests := []struct {
+		route   string
+		host    string
+		target  string
+		proxy   string
+		log     string
+		matches string
+	}{
+		{`~^a{1,3}\.com$=:8080`, `~^a{1,3}\.com$`, "localhost:8080", "", routeLogFull, "aa.com"},
+		{`~^a{1,3}\.com$=:8080,log=off,priority=2`, `~^a{1,3}\.com$`, "localhost:8080", "", routeLogOff, "aaa.com"},
+		{`~^x=y\.com$=:8080`, `~^x=y\.com$`, "localhost:8080", "", routeLogFull, "x=y.com"},
+		{`~^a@b\.com$=:8080@127.0.0.1:1080`, `~^a@b\.com$`, "localhost:8080", "127.0.0.1:1080", routeLogFull, "a@b.com"},
+		{`~^(?:a|b)\.com$`, `~^(?:a|b)\.com$`, "", "", routeLogFull, "b.com"},
+		{`~^a{1,3}\.com$,log=summary`, `~^a{1,3}\.com$`, "", "", routeLogSummary, "a.com"},
+	}
+	for _, tt := range tests {
+		cfg, err := parseRoute(tt.route)
+		if err != nil {
+			t.Errorf("parseRoute(%q): %v", tt.route, err)
+			continue
+		}
+		if cfg.Host != tt.host || cfg.Target != tt.target || cfg.ProxyAddr != tt.proxy || cfg.Log != tt.log {
+			t.Errorf("parseRoute(%q) = host %q, target %q, proxy %q, log %s; want %q, %q, %q, %s",
+				tt.route, cfg.Host, cfg.Target, cfg.ProxyAddr, cfg.Log, tt.host, tt.target, tt.proxy, tt.log)
+		}
+		if !cfg.Matches(tt.matches) {
+			t.Errorf("route %q does not match %s", tt.route, tt.matches)
+		}
+		if again, err := parseRoute(cfg.String()); err != nil || again.String() != cfg.String() {
+			t.Errorf("route %q does not round-trip through %q: %v", tt.route, cfg.String(), err)
+		}
+	}
+}
+
+func TestParseRouteUnknownOption(t *testing.T) {
+	_, err := parseRoute("example.com=:8080,lgo=off")
+	if err == nil || err.Error() != "unknown route option 'lgo'" {
+		t.Errorf("parseRoute with a misspelled option: %v", err)
+	}
+}
+
+func TestPatternRouteComputesBackends(t *testing.T) {
+	cfg, err := parseRoute(`~^(\w+)\.svc\.local$=$1.internal:8080`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for sni, want := range map[string]string{
+		"api.svc.local": "api.internal:8080",
+		"web.svc.local": "web.internal:8080",
+	} {
+		if got := cfg.backendFor(sni); got != want {
+			t.Errorf("backendFor(%s) = %s, want %s", sni, got, want)
+		}
+	}
+}
+
+func TestMaxBytesTerminatesAtLimit(t *testing.T) {
+	hello := helloFor(t, "example.com")
+	got := make(chan int64, 1)
+	backend := startBackend(t, func(c net.Conn) {
+		defer c.Close()
+		c.Write([]byte("ok"))
+		n, _ := io.Copy(io.Discard, c)
+		got <- n
+	})
+	limit := len(hello) + 2 + 100
+	addr := serveTest(t, newTestServer(t, fmt.Sprintf("example.com=%s,maxbytes=%d", backend, limit)))
+
+	conn := dialHello(t, addr, hello)
+	io.ReadFull(conn, make([]byte, 2))
+	conn.Write(make([]byte, 1000))
+	if !waitClosed(conn, 2*time.Second) {
+		t.Fatal("connection past its byte quota was not closed")
+	}
+	select {
+	case n := <-got:
+		if want := int64(len(hello) + 100); n != want {
+			t.Errorf("backend received %d bytes, want %d: the hello and what was left of the quota", n, want)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("backend connection was not closed")
+	}
+}
+
+func TestDebugLogsClientHello(t *testing.T) {
+	defer func(l string) { logLevel = l }(logLevel)
+	for _, level := range []string{"debug", "info"} {
+		logLevel = level
+		logs := captureLog(t)
+		addr := serveTest(t, newTestServer(t))
+
+		conn := dialHello(t, addr, helloFor(t, "example.com", "h2", "http/1.1"))
+		if !waitClosed(conn, 2*time.Second) {
+			t.Fatal("connection for an unconfigured SNI was not closed")
+		}
+		const want = `sni="example.com" alpn=["h2" "http/1.1"]`
+		if got := strings.Contains(logs.String(), want); got != (level == "debug") {
+			t.Errorf("at %s level, ClientHello dump with %s logged: %v\n%s", level, want, got, logs.String())
+		}
+	}
+}
+
+func TestRejectionClasses(t *testing.T) {
+	logs := captureLog(t)
+	addr := serveTest(t, newTestServer(t, "example.com=:8080"))
+	tests := []struct {
+		name          string
+		data          []byte
+		class, reason string
+	}{
+		{"plain HTTP", []byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"), rejectMalformed, "not_tls"},
+		{"random bytes", []byte{0x8f, 0x3a, 0xc1, 0x07, 0x55, 0xe2, 0x19, 0x4d}, rejectMalformed, "not_tls"},
+		{"handshake with implausible version", []byte{recordTypeHandshake, 0x07, 0x01, 0x00, 0x40}, rejectMalformed, "not_tls"},
+		{"zero-length record", []byte{recordTypeHandshake, 3, 1, 0, 0}, rejectMalformed, "short_record"},
+		{"record shorter than a handshake header", []byte{recordTypeHandshake, 3, 1, 0, 3, 1, 0, 0}, rejectMalformed, "short_record"},
+		{"bad server_name", buildHello(testExt{0, sniExt(1, "example.com")}), rejectMalformed, "parse_error"},
+		{"unconfigured SNI", helloFor(t, "other.example.com"), rejectPolicy, "unconfigured"},
+	}
+	for _, tt := range tests {
+		before := connsRejected.with(tt.class, tt.reason).Load()
+		conn := dialHello(t, addr, tt.data)
+		if !waitClosed(conn, 2*time.Second) {
+			t.Fatalf("%s: connection was not closed", tt.name)
+		}
+		if got := connsRejected.with(tt.class, tt.reason).Load() - before; got != 1 {
+			t.Errorf("%s: connections_rejected_total{class=%q,reason=%q} rose by %d, want 1", tt.name, tt.class, tt.reason, got)
+		}
+		if want := fmt.Sprintf("Rejected [%s/%s]", tt.class, tt.reason); !strings.Contains(logs.String(), want) {
+			t.Errorf("%s: no %q log line:\n%s", tt.name, want, logs.String())
+		}
+	}
+}
+
+// closedAddr returns a loopback address nothing listens on
+func closedAddr(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+	return l.Addr().String()
+}
+
+func TestFallbackChain(t *testing.T) {
+	logs := captureLog(t)
+	hello := helloFor(t, "example.com")
+	b := startBackend(t, func(c net.Conn) {
+		defer c.Close()
+		io.ReadFull(c, make([]byte, len(hello)))
+		c.Write([]byte("from b"))
+	})
+	a := closedAddr(t)
+
+	// A is down, so B serves the connection
+	before := backendFallbacks.with().Load()
+	addr := serveTest(t, newTestServer(t, "example.com="+a+"|"+b))
+	conn := dialHello(t, addr, hello)
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if got, err := io.ReadAll(conn); string(got) != "from b" {
+		t.Errorf("read %q, %v through the chain; want the fallback's answer", got, err)
+	}
+	if got := backendFallbacks.with().Load() - before; got != 1 {
+		t.Errorf("backend_fallbacks_total rose by %d, want 1", got)
+	}
+
+	// Both down, so the client is turned away
+	c := closedAddr(t)
+	addr = serveTest(t, newTestServer(t, "example.com="+a+"|"+c))
+	conn = dialHello(t, addr, hello)
+	if !waitClosed(conn, 2*time.Second) {
+		t.Fatal("connection with every target down was not closed")
+	}
+	if want := "Failed to connect to backend " + c; !strings.Contains(logs.String(), want) {
+		t.Errorf("no %q log line:\n%s", want, logs.String())
+	}
+}
+
+func TestForwardedBytesMatchPeeked(t *testing.T) {
+	hello := helloFor(t, "example.com", "h2")
+	payload := []byte("application data after the ClientHello")
+	want := append(slices.Clone(hello), payload...)
+	got := make(chan []byte, 1)
+	backend := startBackend(t, func(c net.Conn) {
+		defer c.Close()
+		buf := make([]byte, len(want))
+		n, _ := io.ReadFull(c, buf)
+		got <- buf[:n]
+	})
+	addr := serveTest(t, newTestServer(t, "example.com="+backend))
+
+	// Deliver the record in pieces, splitting its header, so the peek has to
+	// join several reads
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	for _, part := range [][]byte{hello[:3], hello[3:40], hello[40:], payload} {
+		if _, err := conn.Write(part); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	select {
+	case b := <-got:
+		if !bytes.Equal(b, want) {
+			t.Errorf("backend received %d bytes differing from the %d the client sent", len(b), len(want))
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("backend did not receive the forwarded bytes")
+	}
+}
+
+// panicDialer is a backend dialer that panics, standing in for a faulty
+// plugin
+type panicDialer struct{}
+
+func (panicDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	panic("dialer plugin bug")
+}
+
+func init() {
+	registerBackendDialer("panic", panicDialer{})
+}
+
+func TestPanicClosesOnlyItsConnection(t *testing.T) {
+	logs := captureLog(t)
+	hello := helloFor(t, "ok.example.com")
+	backend := startBackend(t, func(c net.Conn) {
+		defer c.Close()
+		io.ReadFull(c, make([]byte, len(hello)))
+		c.Write([]byte("ok"))
+	})
+	addr := serveTest(t, newTestServer(t, "ok.example.com="+backend, "bad.example.com="+backend+",dialer=panic"))
+
+	before := connPanics.with().Load()
+	conn := dialHello(t, addr, helloFor(t, "bad.example.com"))
+	if !waitClosed(conn, 2*time.Second) {
+		t.Fatal("connection whose handler panicked was not closed")
+	}
+	if got := connPanics.with().Load() - before; got != 1 {
+		t.Errorf("connection_panics_total rose by %d, want 1", got)
+	}
+	if out := logs.String(); !strings.Contains(out, "dialer plugin bug") || !strings.Contains(out, "goroutine ") {
+		t.Errorf("panic not logged with a stack trace:\n%s", out)
+	}
+
+	// The server keeps serving other connections
+	conn = dialHello(t, addr, hello)
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if got, err := io.ReadAll(conn); string(got) != "ok" {
+		t.Errorf("read %q, %v after the panic; want the backend's answer", got, err)
+	}
+}
+
+func TestMatchBestOverlappingRoutes(t *testing.T) {
+	hashed := hashHost("salt", "secret.example.com")
+	rm, err := parseRoutes([]string{
+		"www.example.com=:1",
+		hashed + "=:2",
+		".example.com=:3",
+		".eu.example.com=:4",
+		"*.*.test=:5",
+		"api.*.test=:6",
+		"api-*.test=:7",
+		"*.test=:8",
+		`~^api\.=:9`,
+		`~\.example\.com$=:10`,
+		"*=:11",
+		"legacy.example.com=:12,noalpn",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		host    string
+		hasALPN bool
+		target  string
+		reason  string
+	}{
+		{"www.example.com", true, "localhost:1", "exact match (4 matching routes)"},
+		{"secret.example.com", true, "localhost:2", "hashed host (4 matching routes)"},
+		{"a.eu.example.com", true, "localhost:4", "longest suffix .eu.example.com (4 matching routes)"},
+		{"api.example.com", true, "localhost:3", "longest suffix .example.com (4 matching routes)"},
+		{"api.x.test", true, "localhost:6", "most specific wildcard api.*.test (4 matching routes)"},
+		{"api-1.test", true, "localhost:7", "most specific wildcard api-*.test (3 matching routes)"},
+		{"b.c.test", true, "localhost:5", "most specific wildcard *.*.test (2 matching routes)"},
+		{"api.example.org", true, "localhost:9", `pattern ~^api\. (2 matching routes)`},
+		{"example.org", true, "localhost:11", "default route (1 matching route)"},
+		{"legacy.example.com", false, "localhost:12", "exact match (1 matching route), noalpn route for a ClientHello without ALPN"},
+		{"legacy.example.com", true, "localhost:3", "longest suffix .example.com (3 matching routes)"},
+		{"www.example.com", false, "localhost:1", "exact match (4 matching routes)"},
+	}
+	for _, tt := range tests {
+		cfg, reason := rm.MatchBest(tt.host, tt.hasALPN)
+		if cfg == nil || cfg.Target != tt.target || reason != tt.reason {
+			t.Errorf("MatchBest(%s, alpn %v) = %v, %q; want %s, %q", tt.host, tt.hasALPN, cfg, reason, tt.target, tt.reason)
+			continue
+		}
+		if looked, _ := rm.LookupHello(tt.host, tt.hasALPN); looked != cfg {
+			t.Errorf("LookupHello(%s, alpn %v) = %v, MatchBest chose %v", tt.host, tt.hasALPN, looked, cfg)
+		}
+	}
+}
+
+func TestPatternRoutesMatchInConfigOrder(t *testing.T) {
+	tests := []struct {
+		routes []string
+		target string
+	}{
+		{[]string{`~^api\.=:1`, `~\.test$=:2`}, "localhost:1"},
+		{[]string{`~\.test$=:2`, `~^api\.=:1`}, "localhost:2"},
+	}
+	for _, tt := range tests {
+		rm, err := parseRoutes(tt.routes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cfg, ok := rm.Lookup("api.test"); !ok || cfg.Target != tt.target {
+			t.Errorf("routes %q: Lookup(api.test) = %v, want the first pattern's %s", tt.routes, cfg, tt.target)
+		}
+	}
+}
+
+func TestMatchedRuleLogged(t *testing.T) {
+	defer func(l string) { logLevel = l }(logLevel)
+	logLevel = "debug"
+	logs := captureLog(t)
+	hello := helloFor(t, "api.example.com")
+	backend := startAnswerBackend(t, len(hello), "ok")
+	addr := serveTest(t, newTestServer(t, ".example.com="+backend, `~^api\.=:1`, "*=:2"))
+
+	conn := dialHello(t, addr, hello)
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if got, err := io.ReadAll(conn); string(got) != "ok" {
+		t.Errorf("read %q, %v; want the suffix route's backend", got, err)
+	}
+	waitIdle(t) // Before logLevel is restored
+	if want := "Route for api.example.com: longest suffix .example.com (3 matching routes)"; !strings.Contains(logs.String(), want) {
+		t.Errorf("no %q log line:\n%s", want, logs.String())
+	}
+}
+
+func TestMatchBestPriority(t *testing.T) {
+	rm, err := parseRoutes([]string{"api.example.com=:1", ".example.com=:2", `~^api\.=:3,priority=10`, "*=:4,priority=5"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		host   string
+		target string
+		reason string
+	}{
+		{"api.example.com", "localhost:3", `pattern ~^api\. with priority 10 (4 matching routes)`},
+		{"www.example.com", "localhost:4", "default route with priority 5 (2 matching routes)"},
+		{"example.com", "localhost:4", "default route (1 matching route)"},
+	}
+	for _, tt := range tests {
+		cfg, reason := rm.MatchBest(tt.host, true)
+		if cfg == nil || cfg.Target != tt.target || reason != tt.reason {
+			t.Errorf("MatchBest(%s) = %v, %q; want %s, %q", tt.host, cfg, reason, tt.target, tt.reason)
+			continue
+		}
+		if looked, _ := rm.Lookup(tt.host); looked != cfg {
+			t.Errorf("Lookup(%s) = %v, MatchBest chose %v", tt.host, looked, cfg)
+		}
+	}
+}
+
+func TestPriorityTiesAndNegatives(t *testing.T) {
+	tests := []struct {
+		routes []string
+		target string
+	}{
+		// Equal priorities fall back to specificity
+		{[]string{".example.com=:2,priority=5", "api.example.com=:1,priority=5"}, "localhost:1"},
+		{[]string{`~^api\.=:2,priority=5`, ".example.com=:1,priority=5"}, "localhost:1"},
+		// A negative priority loses even to the default route
+		{[]string{"api.example.com=:1,priority=-1", "*=:2"}, "localhost:2"},
+		{[]string{"api.example.com=:1,priority=-1", ".example.com=:2,priority=-2"}, "localhost:1"},
+	}
+	for _, tt := range tests {
+		rm, err := parseRoutes(tt.routes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cfg, ok := rm.Lookup("api.example.com"); !ok || cfg.Target != tt.target {
+			t.Errorf("routes %q: Lookup(api.example.com) = %v, want %s", tt.routes, cfg, tt.target)
+		}
+	}
+
+	if _, err := parseRoute("api.example.com=:1,priority=high"); err == nil {
+		t.Error("a non-numeric priority was accepted")
+	}
+}
+
+func TestWaitForDrainLogsProgress(t *testing.T) {
+	fc := useFakeClock(t)
+	logs := captureLog(t)
+	srv := newTestServer(t)
+	srv.active.Add(1)
+	activeConns.Add(1)
+
+	done := make(chan struct{})
+	go func() {
+		srv.waitForDrain(time.Hour)
+		close(done)
+	}()
+	if !waitFor(time.Second, func() bool { return fc.pending() == 2 }) {
+		t.Fatalf("waitForDrain registered %d timers, want 2", fc.pending())
+	}
+
+	// Progress is logged every interval while the connection stays open
+	for i := 1; i <= 2; i++ {
+		fc.Advance(drainLogInterval)
+		if !waitFor(time.Second, func() bool {
+			return strings.Count(logs.String(), "Draining: 1 active connections remaining") == i
+		}) {
+			t.Fatalf("after %d intervals, drain progress logged:\n%s", i, logs.String())
+		}
+	}
+
+	// The drain ends as soon as the connection closes
+	activeConns.Add(-1)
+	srv.active.Done()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("waitForDrain did not return once the last connection closed")
+	}
+	if out := logs.String(); !strings.Contains(out, "All connections closed, exiting") {
+		t.Errorf("drain log does not report completion:\n%s", out)
+	}
+}
+
+func TestTransparentDialsOriginalDestination(t *testing.T) {
+	defer func(tr bool, f func(net.Conn) (string, error)) { transparent, getOriginalDst = tr, f }(transparent, getOriginalDst)
+	transparent = true
+	hello := helloFor(t, "example.com")
+	backend := startBackend(t, func(c net.Conn) {
+		defer c.Close()
+		io.ReadFull(c, make([]byte, len(hello)))
+		c.Write([]byte("original"))
+	})
+	getOriginalDst = func(net.Conn) (string, error) { return backend, nil }
+	addr := serveTest(t, newTestServer(t, "example.com"))
+
+	conn := dialHello(t, addr, hello)
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if got, err := io.ReadAll(conn); string(got) != "original" {
+		t.Errorf("read %q, %v; want the answer of the original destination", got, err)
+	}
+
+	// Unconfigured SNIs are still rejected before the destination is looked up
+	getOriginalDst = func(net.Conn) (string, error) {
+		t.Error("original destination looked up for an unconfigured SNI")
+		return backend, nil
+	}
+	conn = dialHello(t, addr, helloFor(t, "other.example.com"))
+	if !waitClosed(conn, 2*time.Second) {
+		t.Fatal("connection for an unconfigured SNI was not closed")
+	}
+}
+
+// startAnswerBackend runs a backend that reads a ClientHello of helloLen
+// bytes, answers with reply and closes
+func startAnswerBackend(t testing.TB, helloLen int, reply string) string {
+	return startBackend(t, func(c net.Conn) {
+		defer c.Close()
+		io.ReadFull(c, make([]byte, helloLen))
+		io.WriteString(c, reply)
+	})
+}
+
+func TestRouteLogLevels(t *testing.T) {
+	tests := []struct {
+		log        string
+		routed     bool
+		closedLine bool
+	}{
+		{"", true, true},
+		{",log=full", true, true},
+		{",log=summary", false, true},
+		{",log=off", false, false},
+	}
+	for _, tt := range tests {
+		logs := captureLog(t)
+		hello := helloFor(t, "example.com")
+		backend := startAnswerBackend(t, len(hello), "ok")
+		addr := serveTest(t, newTestServer(t, "example.com="+backend+tt.log))
+
+		conn := dialHello(t, addr, hello)
+		if !waitClosed(conn, 2*time.Second) {
+			t.Fatal("connection was not closed after the backend closed")
+		}
+		waitFor(200*time.Millisecond, func() bool { return strings.Contains(logs.String(), "closed after") })
+		out := logs.String()
+		if got := strings.Contains(out, "example.com -> "); got != tt.routed {
+			t.Errorf("route %q: routing line logged %v, want %v:\n%s", tt.log, got, tt.routed, out)
+		}
+		if got := strings.Contains(out, "example.com closed after"); got != tt.closedLine {
+			t.Errorf("route %q: close line logged %v, want %v:\n%s", tt.log, got, tt.closedLine, out)
+		}
+	}
+}
+
+// startStubDNS runs a UDP DNS server answering A queries for every name with
+// 127.0.0.1, and returns its address and the names it was asked about
+func startStubDNS(t *testing.T) (string, func() []string) {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+
+	var mu sync.Mutex
+	var asked []string
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, from, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			var p dnsmessage.Parser
+			hdr, err := p.Start(buf[:n])
+			if err != nil {
+				continue
+			}
+			q, err := p.Question()
+			if err != nil {
+				continue
+			}
+			mu.Lock()
+			asked = append(asked, q.Name.String())
+			mu.Unlock()
+
+			b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: hdr.ID, Response: true, Authoritative: true})
+			b.StartQuestions()
+			b.Question(q)
+			b.StartAnswers()
+			if q.Type == dnsmessage.TypeA {
+				b.AResource(dnsmessage.ResourceHeader{Name: q.Name, Class: dnsmessage.ClassINET, TTL: 60}, dnsmessage.AResource{A: [4]byte{127, 0, 0, 1}})
+			}
+			msg, err := b.Finish()
+			if err == nil {
+				pc.WriteTo(msg, from)
+			}
+		}
+	}()
+	return pc.LocalAddr().String(), func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return slices.Clone(asked)
+	}
+}
+
+func TestResolverResolvesBackends(t *testing.T) {
+	dns, asked := startStubDNS(t)
+	hello := helloFor(t, "example.com")
+	_, port, _ := net.SplitHostPort(startAnswerBackend(t, len(hello), "resolved"))
+
+	srv := newTestServer(t, "example.com=backend.proxys.test:"+port)
+	var err error
+	if srv.resolver, err = newResolver(dns); err != nil {
+		t.Fatal(err)
+	}
+	addr := serveTest(t, srv)
+
+	conn := dialHello(t, addr, hello)
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if got, err := io.ReadAll(conn); string(got) != "resolved" {
+		t.Errorf("read %q, %v; want the answer of the backend the stub resolver pointed at", got, err)
+	}
+	if !slices.Contains(asked(), "backend.proxys.test.") {
+		t.Errorf("stub resolver was asked about %q, want backend.proxys.test.", asked())
+	}
+}
+
+func TestParseRouteIPv6(t *testing.T) {
+	tests := []struct {
+		route  string
+		host   string
+		target string
+		proxy  string
+		err    string
+	}{
+		{route: "example.com=[::1]:8443", host: "example.com", target: "[::1]:8443"},
+		{route: "example.com=[2001:db8::1]:443|[2001:db8::2]:443", host: "example.com", target: "[2001:db8::1]:443"},
+		{route: "example.com=:8080@[::1]:1080", host: "example.com", target: "localhost:8080", proxy: "[::1]:1080"},
+		{route: "example.com@[2001:db8::5]:1080", host: "example.com", proxy: "[2001:db8::5]:1080"},
+		{route: "2001:db8::1", host: "2001:db8::1"},
+		{route: "[2001:DB8::1]", host: "2001:db8::1"},
+		{route: "example.com=::1:8443", err: "IPv6 addresses must be bracketed"},
+		{route: "example.com@::1:1080", err: "IPv6 addresses must be bracketed"},
+	}
+	for _, tt := range tests {
+		cfg, err := parseRoute(tt.route)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("parseRoute(%q) = %v, want an error mentioning %q", tt.route, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseRoute(%q): %v", tt.route, err)
+			continue
+		}
+		if cfg.Host != tt.host || cfg.Target != tt.target || cfg.ProxyAddr != tt.proxy {
+			t.Errorf("parseRoute(%q) = host %q, target %q, proxy %q; want %q, %q, %q",
+				tt.route, cfg.Host, cfg.Target, cfg.ProxyAddr, tt.host, tt.target, tt.proxy)
+		}
+	}
+}
+
+func TestPassthroughBracketsIPv6SNI(t *testing.T) {
+	l, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		t.Skipf("no IPv6 loopback: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	// crypto/tls sends no SNI for IP addresses, so build the ClientHello
+	hello := buildHello(testExt{0, sniExt(0, "::1")})
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		io.ReadFull(c, make([]byte, len(hello)))
+		io.WriteString(c, "v6")
+	}()
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+	addr := serveTest(t, newTestServer(t, "::1,passthroughport="+port))
+
+	conn := dialHello(t, addr, hello)
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if got, err := io.ReadAll(conn); string(got) != "v6" {
+		t.Errorf("read %q, %v; want the answer of [::1]:%s", got, err, port)
+	}
+}
+
+func TestPassthroughPort(t *testing.T) {
+	hello := buildHello(testExt{0, sniExt(0, "127.0.0.1")})
+	backend := startAnswerBackend(t, len(hello), "alt")
+	_, port, _ := net.SplitHostPort(backend)
+	addr := serveTest(t, newTestServer(t, "127.0.0.1,passthroughport="+port))
+
+	conn := dialHello(t, addr, hello)
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if got, err := io.ReadAll(conn); string(got) != "alt" {
+		t.Errorf("read %q, %v; want the answer of the SNI host on port %s", got, err, port)
+	}
+
+	for _, v := range []string{"0", "65536", "https"} {
+		if _, err := parseRoute("example.com,passthroughport=" + v); err == nil {
+			t.Errorf("parseRoute with passthroughport=%s succeeded, want an error", v)
+		}
+	}
+}
+
+func TestRejectIPSNI(t *testing.T) {
+	defer func(v bool) { rejectIPSNI = v }(rejectIPSNI)
+	rejectIPSNI = true
+	addr := serveTest(t, newTestServer(t, "192.0.2.1=:8080", "2001:db8::1=:8080", "example.com=:8080"))
+
+	for _, sni := range []string{"192.0.2.1", "2001:db8::1", "[2001:db8::1]"} {
+		before := connsRejected.with(rejectPolicy, "ip_sni").Load()
+		conn := dialHello(t, addr, buildHello(testExt{0, sniExt(0, sni)}))
+		if !waitClosed(conn, 2*time.Second) {
+			t.Fatalf("SNI %s: connection was not closed", sni)
+		}
+		if got := connsRejected.with(rejectPolicy, "ip_sni").Load() - before; got != 1 {
+			t.Errorf("SNI %s: ip_sni rejections rose by %d, want 1", sni, got)
+		}
+	}
+
+	// A hostname that starts with digits is no IP literal
+	before := connsRejected.with(rejectPolicy, "ip_sni").Load()
+	conn := dialHello(t, addr, buildHello(testExt{0, sniExt(0, "192.0.2.1.example.com")}))
+	waitClosed(conn, 2*time.Second)
+	waitIdle(t) // Before rejectIPSNI is restored
+	if got := connsRejected.with(rejectPolicy, "ip_sni").Load() - before; got != 0 {
+		t.Errorf("SNI 192.0.2.1.example.com: ip_sni rejections rose by %d, want 0", got)
+	}
+}
+
+func TestNormalizeHost(t *testing.T) {
+	for in, want := range map[string]string{
+		"example.com":      "example.com",
+		"example.com.":     "example.com",
+		"Example.COM.":     "example.com",
+		"[2001:DB8::1]":    "2001:db8::1",
+		"2001:0db8:0:0::1": "2001:db8::1",
+		"192.0.2.1":        "192.0.2.1",
+		"":                 "",
+		"example.com..":    "example.com.",
+	} {
+		if got := normalizeHost(in); got != want {
+			t.Errorf("normalizeHost(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestTrailingDotSNIMatchesRoute(t *testing.T) {
+	// crypto/tls strips the trailing dot itself, so build the ClientHello
+	hello := buildHello(testExt{0, sniExt(0, "example.com.")})
+	backend := startAnswerBackend(t, len(hello), "dotless")
+	for _, route := range []string{"example.com=" + backend, "Example.COM.=" + backend} {
+		addr := serveTest(t, newTestServer(t, route))
+		conn := dialHello(t, addr, hello)
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		if got, err := io.ReadAll(conn); string(got) != "dotless" {
+			t.Errorf("route %s: read %q, %v for SNI example.com.; want the route's backend", route, got, err)
+		}
+	}
+}
+
+// recordingDialer is a backend dialer that records the networks it is asked
+// to dial and dials them on the host network
+type recordingDialer struct {
+	mu       sync.Mutex
+	networks []string
+}
+
+func (d *recordingDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	d.mu.Lock()
+	d.networks = append(d.networks, network)
+	d.mu.Unlock()
+	var nd net.Dialer
+	return nd.DialContext(ctx, network, addr)
+}
+
+func (d *recordingDialer) dialed() []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return slices.Clone(d.networks)
+}
+
+var testRecordingDialer = &recordingDialer{}
+
+func init() {
+	registerBackendDialer("record", testRecordingDialer)
+}
+
+func TestBackendNetworkPropagates(t *testing.T) {
+	defer func(n string) { backendNetwork = n }(backendNetwork)
+	hello := helloFor(t, "example.com")
+	backend := startAnswerBackend(t, len(hello), "ok")
+	addr := serveTest(t, newTestServer(t, "example.com="+backend+",dialer=record"))
+
+	for _, network := range []string{"tcp4", "tcp"} {
+		backendNetwork = network
+		before := len(testRecordingDialer.dialed())
+		conn := dialHello(t, addr, hello)
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		if got, err := io.ReadAll(conn); string(got) != "ok" {
+			t.Errorf("-backend-network %s: read %q, %v; want the backend's answer", network, got, err)
+		}
+		if got := testRecordingDialer.dialed()[before:]; !slices.Equal(got, []string{network}) {
+			t.Errorf("-backend-network %s: dialed %q", network, got)
+		}
+	}
+}
+
+func TestLeadingChangeCipherSpec(t *testing.T) {
+	defer func(n int) { maxLeadingRecords = n }(maxLeadingRecords)
+	maxLeadingRecords = 1
+	ccs := []byte{recordTypeChangeCipherSpec, 3, 3, 0, 1, 1}
+	hello := helloFor(t, "example.com")
+	got := make(chan []byte, 1)
+	backend := startBackend(t, func(c net.Conn) {
+		defer c.Close()
+		buf := make([]byte, len(hello))
+		n, _ := io.ReadFull(c, buf)
+		got <- buf[:n]
+	})
+	addr := serveTest(t, newTestServer(t, "example.com="+backend))
+
+	// One leading record is skipped and not replayed
+	dialHello(t, addr, append(slices.Clone(ccs), hello...))
+	select {
+	case b := <-got:
+		if !bytes.Equal(b, hello) {
+			t.Errorf("backend received %d bytes starting %x, want only the ClientHello", len(b), b[:min(len(b), 6)])
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("ClientHello after a change_cipher_spec record was not forwarded")
+	}
+
+	// One more than -max-leading-records is rejected
+	before := connsRejected.with(rejectMalformed, "no_handshake").Load()
+	conn := dialHello(t, addr, append(append(slices.Clone(ccs), ccs...), hello...))
+	if !waitClosed(conn, 2*time.Second) {
+		t.Fatal("connection with too many leading records was not closed")
+	}
+	if n := connsRejected.with(rejectMalformed, "no_handshake").Load() - before; n != 1 {
+		t.Errorf("connections_rejected_total{reason=\"no_handshake\"} rose by %d, want 1", n)
+	}
+}
+
+// temporaryError is an Accept error that asks for a retry
+type temporaryError struct{}
+
+func (temporaryError) Error() string   { return "too many open files" }
+func (temporaryError) Timeout() bool   { return false }
+func (temporaryError) Temporary() bool { return true }
+
+// failingListener fails Accept with a temporary error n times, then reports
+// itself closed
+type failingListener struct {
+	net.Listener
+	n int
+}
+
+func (l *failingListener) Accept() (net.Conn, error) {
+	if l.n == 0 {
+		return nil, net.ErrClosed
+	}
+	l.n--
+	return nil, temporaryError{}
+}
+
+func TestAcceptBacksOffOnTemporaryErrors(t *testing.T) {
+	logs := captureLog(t)
+	start := time.Now()
+	newTestServer(t).serve(&failingListener{n: 4})
+
+	// 5ms, doubling per consecutive error
+	if took := time.Since(start); took < 75*time.Millisecond {
+		t.Errorf("serve returned after %s, want at least the 75ms of backoff", took)
+	}
+	for _, delay := range []string{"5ms", "10ms", "20ms", "40ms"} {
+		if want := "Accept error: too many open files; retrying in " + delay; !strings.Contains(logs.String(), want) {
+			t.Errorf("no %q log line:\n%s", want, logs.String())
+		}
+	}
+}
+
+func TestBytesCountedPerDirection(t *testing.T) {
+	logs := captureLog(t)
+	hello := helloFor(t, "example.com")
+	request := bytes.Repeat([]byte("u"), 1000)
+	reply := strings.Repeat("d", 300)
+	backend := startAnswerBackend(t, len(hello)+len(request), reply)
+	addr := serveTest(t, newTestServer(t, "example.com="+backend))
+	waitIdle(t)
+	up := bytesTransferred.with("upstream").Load()
+	down := bytesTransferred.with("downstream").Load()
+
+	conn := dialHello(t, addr, hello)
+	if _, err := conn.Write(request); err != nil {
+		t.Fatal(err)
+	}
+	if !waitClosed(conn, 2*time.Second) {
+		t.Fatal("connection was not closed")
+	}
+	waitIdle(t)
+
+	wantUp, wantDown := int64(len(hello)+len(request)), int64(len(reply))
+	if got := bytesTransferred.with("upstream").Load() - up; got != wantUp {
+		t.Errorf("upstream bytes metric grew by %d, want %d", got, wantUp)
+	}
+	if got := bytesTransferred.with("downstream").Load() - down; got != wantDown {
+		t.Errorf("downstream bytes metric grew by %d, want %d", got, wantDown)
+	}
+	if want := fmt.Sprintf("%d bytes up, %d bytes down", wantUp, wantDown); !strings.Contains(logs.String(), want) {
+		t.Errorf("close log does not report %q:\n%s", want, logs.String())
+	}
+}
+
+func TestMinTLSVersion(t *testing.T) {
+	modern := helloFor(t, "example.com")
+	old := clientHello(t, &tls.Config{ServerName: "example.com", MinVersion: tls.VersionTLS10, MaxVersion: tls.VersionTLS11})
+	backend := startAnswerBackend(t, len(modern), "ok")
+	srv := newTestServer(t, "example.com="+backend)
+	minVersion, err := parseTLSVersion("1.2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.minVersion = minVersion
+	addr := serveTest(t, srv)
+
+	before := connsRejected.with(rejectPolicy, "tls_version").Load()
+	conn := dialHello(t, addr, old)
+	if !waitClosed(conn, 2*time.Second) {
+		t.Fatal("TLS 1.1 client was not closed")
+	}
+	if got := connsRejected.with(rejectPolicy, "tls_version").Load() - before; got != 1 {
+		t.Errorf("TLS 1.1 client: tls_version rejections rose by %d, want 1", got)
+	}
+
+	conn = dialHello(t, addr, modern)
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if b, _ := io.ReadAll(conn); string(b) != "ok" {
+		t.Errorf("TLS 1.3 client got %q from the backend, want %q", b, "ok")
+	}
+
+	if _, err := parseTLSVersion("1.4"); err == nil {
+		t.Error("parseTLSVersion(1.4) succeeded, want an error")
+	}
+}
+
+func TestDenyTLSExtension(t *testing.T) {
+	denied := buildHello(testExt{0, sniExt(0, "example.com")}, testExt{0xfe01, []byte("tool")})
+	plain := buildHello(testExt{0, sniExt(0, "example.com")})
+	srv := newTestServer(t, "example.com="+startAnswerBackend(t, len(plain), "ok"))
+	deniedExts, err := parseExtensionTypes([]string{"65025, 13172"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.deniedExts = deniedExts
+	addr := serveTest(t, srv)
+
+	before := connsRejected.with(rejectPolicy, "denied_extension").Load()
+	conn := dialHello(t, addr, denied)
+	if !waitClosed(conn, 2*time.Second) {
+		t.Fatal("ClientHello with a denied extension was not closed")
+	}
+	if got := connsRejected.with(rejectPolicy, "denied_extension").Load() - before; got != 1 {
+		t.Errorf("denied extension: denied_extension rejections rose by %d, want 1", got)
+	}
+
+	conn = dialHello(t, addr, plain)
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if b, _ := io.ReadAll(conn); string(b) != "ok" {
+		t.Errorf("ClientHello without a denied extension got %q from the backend, want %q", b, "ok")
+	}
+
+	if _, err := parseExtensionTypes([]string{"0xfe01"}); err == nil {
+		t.Error("parseExtensionTypes(0xfe01) succeeded, want an error")
+	}
+}
+
+func TestSNIExtensionTypeRoutes(t *testing.T) {
+	defer func(typ int) { sniExtensionType = typ }(sniExtensionType)
+	sniExtensionType = 0xfe00
+
+	fronted := buildHello(testExt{0, sniExt(0, "front.example.com")}, testExt{0xfe00, []byte("Real.Example.com")})
+	plain := buildHello(testExt{0, sniExt(0, "front.example.com")})
+	addr := serveTest(t, newTestServer(t,
+		"front.example.com="+startAnswerBackend(t, len(plain), "front"),
+		"real.example.com="+startAnswerBackend(t, len(fronted), "real"),
+	))
+
+	tests := []struct {
+		name  string
+		hello []byte
+		want  string
+	}{
+		{"custom extension", fronted, "real"},
+		{"no custom extension", plain, "front"},
+	}
+	for _, tt := range tests {
+		conn := dialHello(t, addr, tt.hello)
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		if b, _ := io.ReadAll(conn); string(b) != tt.want {
+			t.Errorf("%s: routed to the %q backend, want %q", tt.name, b, tt.want)
+		}
+	}
+	waitIdle(t) // Before sniExtensionType is restored
+}
+
+func TestNoForwardLogsWithoutDialing(t *testing.T) {
+	defer func(v bool) { noForward = v }(noForward)
+	noForward = true
+	logs := captureLog(t)
+
+	dialed := make(chan struct{}, 1)
+	backend := startBackend(t, func(c net.Conn) {
+		c.Close()
+		dialed <- struct{}{}
+	})
+	addr := serveTest(t, newTestServer(t, "example.com="+backend))
+
+	conn := dialHello(t, addr, helloFor(t, "example.com"))
+	if !waitClosed(conn, 2*time.Second) {
+		t.Fatal("connection was not closed")
+	}
+	waitIdle(t) // Before noForward is restored
+
+	if want := "example.com -> " + backend + " (routed, not forwarded)"; !strings.Contains(logs.String(), want) {
+		t.Errorf("no %q log line:\n%s", want, logs.String())
+	}
+	select {
+	case <-dialed:
+		t.Error("the backend was dialed")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+// pipeDialer is a backend dialer returning in-memory connections, which have
+// no socket options, to a backend that reads a TLS record and answers "ok"
+type pipeDialer struct{}
+
+func (pipeDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	c, s := net.Pipe()
+	go func() {
+		defer s.Close()
+		hdr := make([]byte, 5)
+		io.ReadFull(s, hdr)
+		io.ReadFull(s, make([]byte, int(hdr[3])<<8|int(hdr[4])))
+		io.WriteString(s, "ok")
+	}()
+	return c, nil
+}
+
+func init() {
+	registerBackendDialer("pipe", pipeDialer{})
+}
+
+func TestSocketTuningSkipsNonTCPBackend(t *testing.T) {
+	defer func(n int, l string) { maxInflight, logLevel = n, l }(maxInflight, logLevel)
+	maxInflight, logLevel = 4096, "debug"
+	logs := captureLog(t)
+	hello := helloFor(t, "example.com")
+	addr := serveTest(t, newTestServer(t, "example.com=127.0.0.1:8443,dialer=pipe"))
+
+	conn := dialHello(t, addr, hello)
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if got, err := io.ReadAll(conn); string(got) != "ok" {
+		t.Errorf("read %q, %v; want the in-memory backend's answer", got, err)
+	}
+	waitIdle(t) // Before maxInflight and logLevel are restored
+	if want := "Skipped socket buffer tuning for pipe: *net.pipe does not expose socket options"; !strings.Contains(logs.String(), want) {
+		t.Errorf("no %q debug line:\n%s", want, logs.String())
+	}
+}
+
+func TestHashedHostRoutes(t *testing.T) {
+	rm, err := parseRoutes([]string{
+		hashHost("s1", "secret.example.com") + "=:8080",
+		hashHost("s2", "other.example.com") + "=:8081",
+		"plain.example.com=:8082",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for host, want := range map[string]string{
+		"secret.example.com": "localhost:8080",
+		"other.example.com":  "localhost:8081",
+		"plain.example.com":  "localhost:8082",
+		"nope.example.com":   "",
+	} {
+		var got string
+		if cfg, ok := rm.Lookup(host); ok {
+			got = cfg.Target
+		}
+		if got != want {
+			t.Errorf("Lookup(%s) routes to %q, want %q", host, got, want)
+		}
+	}
+
+	for _, route := range []string{
+		"sha256:s1:" + strings.Repeat("0", 63) + "=:8080",
+		"sha256:" + strings.Repeat("0", 64) + "=:8080",
+		"sha256:s1:" + strings.Repeat("g", 64) + "=:8080",
+	} {
+		if _, err := parseRoute(route); err == nil {
+			t.Errorf("parseRoute(%q) succeeded, want an error", route)
+		}
+	}
+}
+
+func TestMaxRoutes(t *testing.T) {
+	defer func(n int) { maxRoutes = n }(maxRoutes)
+	maxRoutes = 3
+	routes := []string{"a.example.com=:8080", ".example.org", "~^c\\.example\\.com$=:8080"}
+
+	rm, err := parseRoutes(routes)
+	if err != nil {
+		t.Fatalf("%d routes under -max-routes %d: %v", len(routes), maxRoutes, err)
+	}
+	_, err = parseRoutes(append(routes, "d.example.com=:8080"))
+	if want := "4 routes configured, more than -max-routes 3"; err == nil || err.Error() != want {
+		t.Errorf("parseRoutes over the limit: %v, want %q", err, want)
+	}
+
+	// Routes added at runtime count against the limit too
+	cfg, err := parseRoute("d.example.com=:8080")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := rm.clone().add(cfg); err == nil || !strings.Contains(err.Error(), "route limit of 3 reached") {
+		t.Errorf("adding a route at the limit: %v, want a route limit error", err)
+	}
+}
+
+func TestCloseLogShowsBackendLocalAddr(t *testing.T) {
+	logs := captureLog(t)
+	hello := helloFor(t, "example.com")
+	source := make(chan string, 1)
+	backend := startBackend(t, func(c net.Conn) {
+		defer c.Close()
+		source <- c.RemoteAddr().String()
+		io.ReadFull(c, make([]byte, len(hello)))
+	})
+	addr := serveTest(t, newTestServer(t, "example.com="+backend))
+
+	conn := dialHello(t, addr, hello)
+	if !waitClosed(conn, 2*time.Second) {
+		t.Fatal("connection was not closed")
+	}
+	waitIdle(t)
+	if want := "backend " + backend + " from " + <-source + ","; !strings.Contains(logs.String(), want) {
+		t.Errorf("close log does not name the backend connection's source %q:\n%s", want, logs.String())
+	}
+}
+
+func TestSlowHelloBodyParses(t *testing.T) {
+	defer func(d time.Duration) { helloTimeout = d }(helloTimeout)
+	helloTimeout = time.Second
+	logs := captureLog(t)
+	hello := helloFor(t, "example.com")
+	backend := startAnswerBackend(t, len(hello), "ok")
+	addr := serveTest(t, newTestServer(t, "example.com="+backend))
+
+	// The body trickles in well within the deadline
+	conn := dialHello(t, addr, hello[:5])
+	for body := hello[5:]; len(body) > 0; {
+		n := min(len(body), len(hello)/8)
+		time.Sleep(20 * time.Millisecond)
+		if _, err := conn.Write(body[:n]); err != nil {
+			t.Fatal(err)
+		}
+		body = body[n:]
+	}
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if got, err := io.ReadAll(conn); string(got) != "ok" {
+		t.Errorf("slow ClientHello: read %q, %v; want the backend's answer", got, err)
+	}
+
+	// A body that stops short times out rather than failing to parse. The
+	// shorter timeout gets a server of its own, started after setting it.
+	waitIdle(t)
+	helloTimeout = 100 * time.Millisecond
+	addr = serveTest(t, newTestServer(t, "example.com="+backend))
+	before := connsRejected.with(rejectMalformed, "hello_timeout").Load()
+	conn = dialHello(t, addr, hello[:len(hello)/2])
+	if !waitClosed(conn, 2*time.Second) {
+		t.Fatal("stalled ClientHello was not closed")
+	}
+	waitIdle(t) // Before helloTimeout is restored
+	if got := connsRejected.with(rejectMalformed, "hello_timeout").Load() - before; got != 1 {
+		t.Errorf("hello_timeout rejections rose by %d, want 1", got)
+	}
+	if want := fmt.Sprintf("timed out after %d of %d bytes of TLS record", len(hello)/2-5, len(hello)-5); !strings.Contains(logs.String(), want) {
+		t.Errorf("no %q log line:\n%s", want, logs.String())
+	}
+}
+
+func TestWarnOnDefault(t *testing.T) {
+	defer func(v bool) { warnOnDefault = v }(warnOnDefault)
+	warnOnDefault = true
+	logs := captureLog(t)
+	explicit := helloFor(t, "example.com")
+	other := helloFor(t, "other.example.org")
+	addr := serveTest(t, newTestServer(t,
+		"example.com="+startAnswerBackend(t, len(explicit), "ok"),
+		"*="+startAnswerBackend(t, len(other), "ok"),
+	))
+	before := defaultRouted.with().Load()
+
+	for _, hello := range [][]byte{explicit, other} {
+		conn := dialHello(t, addr, hello)
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		io.ReadAll(conn)
+	}
+	waitIdle(t) // Before warnOnDefault is restored
+
+	if got := defaultRouted.with().Load() - before; got != 1 {
+		t.Errorf("default_route_connections_total rose by %d, want 1", got)
+	}
+	if n := strings.Count(logs.String(), "served by default route"); n != 1 || !strings.Contains(logs.String(), "Warning: SNI other.example.org from 127.0.0.1 served by default route") {
+		t.Errorf("want exactly one default route warning, for other.example.org:\n%s", logs.String())
+	}
+}
+
+// gateDialer is a backend dialer that holds every dial until its gate is
+// opened, tracking how many dials were in progress at once
+type gateDialer struct {
+	gate chan struct{}
+
+	mu             sync.Mutex
+	inflight, most int
+}
+
+func (d *gateDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	d.mu.Lock()
+	d.inflight++
+	d.most = max(d.most, d.inflight)
+	gate := d.gate
+	d.mu.Unlock()
+	defer func() {
+		d.mu.Lock()
+		d.inflight--
+		d.mu.Unlock()
+	}()
+	<-gate
+	var nd net.Dialer
+	return nd.DialContext(ctx, network, addr)
+}
+
+// reset closes the gate again and forgets earlier dials
+func (d *gateDialer) reset() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.gate = make(chan struct{})
+	d.most = 0
+}
+
+func (d *gateDialer) open() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	close(d.gate)
+}
+
+func (d *gateDialer) mostInflight() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.most
+}
+
+var testGateDialer = &gateDialer{}
+
+func init() {
+	registerBackendDialer("gate", testGateDialer)
+}
+
+func TestMaxDialConcurrencySheds(t *testing.T) {
+	defer func(d time.Duration) { dialQueueTimeout = d }(dialQueueTimeout)
+	dialQueueTimeout = 100 * time.Millisecond
+	testGateDialer.reset()
+	hello := helloFor(t, "example.com")
+	backend := startAnswerBackend(t, len(hello), "ok")
+	addr := serveTest(t, newTestServer(t, "example.com="+backend+",dialer=gate,maxdialconcurrency=1"))
+	before := connsRejected.with(rejectPolicy, "dial_shed").Load()
+
+	// The first connection holds the only dial slot until the gate opens
+	first := dialHello(t, addr, hello)
+	if !waitFor(2*time.Second, func() bool { return testGateDialer.mostInflight() == 1 }) {
+		t.Fatal("first connection did not start dialing")
+	}
+	second := dialHello(t, addr, hello)
+	if !waitClosed(second, 2*time.Second) {
+		t.Fatal("connection waiting for a dial slot was not shed")
+	}
+	if got := connsRejected.with(rejectPolicy, "dial_shed").Load() - before; got != 1 {
+		t.Errorf("dial_shed rejections rose by %d, want 1", got)
+	}
+
+	testGateDialer.open()
+	first.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if got, err := io.ReadAll(first); string(got) != "ok" {
+		t.Errorf("connection holding the dial slot: read %q, %v; want the backend's answer", got, err)
+	}
+	third := dialHello(t, addr, hello)
+	third.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if got, err := io.ReadAll(third); string(got) != "ok" {
+		t.Errorf("connection after the slot was freed: read %q, %v; want the backend's answer", got, err)
+	}
+	waitIdle(t) // Before dialQueueTimeout is restored
+	if n := testGateDialer.mostInflight(); n != 1 {
+		t.Errorf("%d dials were in progress at once, want 1", n)
+	}
+}
+
+func TestDirectFallbackLogged(t *testing.T) {
+	useFakeClock(t) // 12:00, outside the proxy window
+	logs := captureLog(t)
+	hello := helloFor(t, "example.com")
+	backend := startAnswerBackend(t, len(hello), "ok")
+	addr := serveTest(t, newTestServer(t, "example.com="+backend+"@"+closedAddr(t)+",proxywindow=22:00-06:00"))
+	before := backendConns.with("direct").Load()
+
+	conn := dialHello(t, addr, hello)
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if got, err := io.ReadAll(conn); string(got) != "ok" {
+		t.Errorf("read %q, %v; want the backend's answer over a direct dial", got, err)
+	}
+	waitIdle(t) // Before the fake clock is removed
+
+	for _, want := range []string{
+		"example.com -> " + backend + " (routed, direct)",
+		", direct\n",
+	} {
+		if !strings.Contains(logs.String(), want) {
+			t.Errorf("no %q in the logs:\n%s", want, logs.String())
+		}
+	}
+	if got := backendConns.with("direct").Load() - before; got != 1 {
+		t.Errorf("backend_connections_total{proxy=\"direct\"} rose by %d, want 1", got)
+	}
+}
+
+func TestNoALPNRoute(t *testing.T) {
+	legacy := helloFor(t, "example.com")
+	modern := helloFor(t, "example.com", "h2")
+	addr := serveTest(t, newTestServer(t,
+		"example.com="+startAnswerBackend(t, len(legacy), "compat")+",noalpn",
+		"example.com="+startAnswerBackend(t, len(modern), "main"),
+	))
+
+	tests := []struct {
+		name  string
+		hello []byte
+		want  string
+	}{
+		{"no ALPN", legacy, "compat"},
+		{"ALPN h2", modern, "main"},
+	}
+	for _, tt := range tests {
+		conn := dialHello(t, addr, tt.hello)
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		if got, _ := io.ReadAll(conn); string(got) != tt.want {
+			t.Errorf("%s: routed to the %q backend, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestMaxConnsShedsOverload(t *testing.T) {
+	defer func(n int) { maxConns = n }(maxConns)
+	maxConns = 1
+	waitIdle(t)
+	hello := helloFor(t, "example.com")
+	release := make(chan struct{})
+	backend := startBackend(t, func(c net.Conn) {
+		defer c.Close()
+		<-release
+	})
+	addr := serveTest(t, newTestServer(t, "example.com="+backend))
+	before := connsRejected.with(rejectPolicy, "overloaded").Load()
+
+	held := dialHello(t, addr, hello)
+	if !waitFor(2*time.Second, func() bool { return activeConns.Load() == 1 }) {
+		t.Fatalf("connections_active = %d with one connection open, want 1", activeConns.Load())
+	}
+	shed := dialHello(t, addr, hello)
+	if !waitClosed(shed, 2*time.Second) {
+		t.Fatal("connection beyond -max-conns was not closed")
+	}
+	if got := connsRejected.with(rejectPolicy, "overloaded").Load() - before; got != 1 {
+		t.Errorf("overloaded rejections rose by %d, want 1", got)
+	}
+	if got := metricsSnapshot()["connections_active"]; got != int64(1) {
+		t.Errorf("connections_active gauge = %v, want 1", got)
+	}
+
+	close(release)
+	if !waitClosed(held, 2*time.Second) {
+		t.Fatal("held connection was not closed")
+	}
+	waitIdle(t) // Before maxConns is restored
+}
+
+func TestReplayDisabledSendsNoHello(t *testing.T) {
+	hello := helloFor(t, "example.com")
+	payload := []byte("after the handshake")
+	got := make(chan []byte, 1)
+	backend := startBackend(t, func(c net.Conn) {
+		defer c.Close()
+		b, _ := io.ReadAll(c)
+		got <- b
+	})
+	addr := serveTest(t, newTestServer(t, "example.com="+backend+",replay=false"))
+
+	// The payload arrives with the ClientHello, so only the peek tells them apart
+	conn := dialHello(t, addr, append(slices.Clone(hello), payload...))
+	conn.(*net.TCPConn).CloseWrite()
+	select {
+	case b := <-got:
+		if !bytes.Equal(b, payload) {
+			t.Errorf("backend received %q, want only the bytes after the ClientHello", b)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("backend did not see the client finish")
+	}
+}
+
+func TestRouteALPNCounts(t *testing.T) {
+	addr := serveTest(t, newTestServer(t, ".example.com=127.0.0.1:8443,dialer=pipe", "x.test=127.0.0.1:8443,dialer=pipe"))
+	type key struct{ route, alpn string }
+	want := map[key]int64{
+		{".example.com", "h2"}:       2,
+		{".example.com", "http/1.1"}: 1,
+		{".example.com", "none"}:     1,
+		{".example.com", "other"}:    1,
+		{"x.test", "h2"}:             1,
+	}
+	before := make(map[key]int64)
+	for k := range want {
+		before[k] = routeALPN.with(k.route, k.alpn).Load()
+	}
+
+	for _, c := range []struct {
+		sni  string
+		alpn []string
+	}{
+		{"a.example.com", []string{"h2"}},
+		{"b.example.com", []string{"h2", "http/1.1"}},
+		{"c.example.com", []string{"http/1.1", "h2"}},
+		{"d.example.com", nil},
+		{"e.example.com", []string{"spdy/3"}},
+		{"x.test", []string{"h2"}},
+	} {
+		conn := dialHello(t, addr, helloFor(t, c.sni, c.alpn...))
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		io.ReadAll(conn)
+	}
+	waitIdle(t)
+
+	for k, n := range want {
+		if got := routeALPN.with(k.route, k.alpn).Load() - before[k]; got != n {
+			t.Errorf("route_alpn_connections_total{route=%q,alpn=%q} rose by %d, want %d", k.route, k.alpn, got, n)
+		}
+	}
+}
+
+func TestMidLabelWildcard(t *testing.T) {
+	rm, err := parseRoutes([]string{"api-*.example.com=:1", "*.example.com=:2", "api-prod.example.com=:3"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for host, want := range map[string]string{
+		"api-1.example.com":      "localhost:1",
+		"api-canary.example.com": "localhost:1",
+		"api-prod.example.com":   "localhost:3", // Exact beats the wildcard
+		"api-.example.com":       "localhost:1", // * may match nothing
+		"api.example.com":        "localhost:2",
+		"xapi-1.example.com":     "localhost:2",
+		"api-1.eu.example.com":   "", // * stays within its label
+		"api-1.example.org":      "",
+	} {
+		var got string
+		if cfg, ok := rm.Lookup(host); ok {
+			got = cfg.Target
+		}
+		if got != want {
+			t.Errorf("Lookup(%s) routes to %q, want %q", host, got, want)
+		}
+	}
+
+	for _, route := range []string{"api-**.example.com=:1", "a*b*.example.com=:1"} {
+		if _, err := parseRoute(route); err == nil {
+			t.Errorf("parseRoute(%q) succeeded, want an error for more than one * in a label", route)
+		}
+	}
+}
+
+func TestRouteLogRateLimit(t *testing.T) {
+	fc := useFakeClock(t)
+	logs := captureLog(t)
+	addr := serveTest(t, newTestServer(t, "example.com=127.0.0.1:8443,dialer=pipe,logratelimit=2"))
+
+	for range 5 {
+		conn := dialHello(t, addr, helloFor(t, "example.com"))
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		io.ReadAll(conn)
+	}
+	waitIdle(t)
+	if n := strings.Count(logs.String(), "example.com -> "); n != 2 {
+		t.Errorf("logged %d routing lines within a second, want 2:\n%s", n, logs.String())
+	}
+
+	// The rest are summed up once the summary interval passes
+	fc.Advance(logSummaryInterval)
+	if want := "Suppressed 3 routing log lines for example.com"; strings.Count(logs.String(), want) != 1 {
+		t.Errorf("want one %q summary:\n%s", want, logs.String())
+	}
+}
+
+func TestRejectTargetBlocksHost(t *testing.T) {
+	logs := captureLog(t)
+	addr := serveTest(t, newTestServer(t, "tracker.example.com=reject", ".example.com=127.0.0.1:8443,dialer=pipe"))
+	tests := []struct {
+		sni, reason, log string
+	}{
+		{"tracker.example.com", "blocked", "connection to explicitly blocked host tracker.example.com"},
+		{"typo.example.org", "unconfigured", "connection to unconfigured host typo.example.org"},
+	}
+	for _, tt := range tests {
+		before := connsRejected.with(rejectPolicy, tt.reason).Load()
+		conn := dialHello(t, addr, helloFor(t, tt.sni))
+		if !waitClosed(conn, 2*time.Second) {
+			t.Fatalf("%s: connection was not closed", tt.sni)
+		}
+		if got := connsRejected.with(rejectPolicy, tt.reason).Load() - before; got != 1 {
+			t.Errorf("%s: %s rejections rose by %d, want 1", tt.sni, tt.reason, got)
+		}
+		if !strings.Contains(logs.String(), tt.log) {
+			t.Errorf("%s: no %q log line:\n%s", tt.sni, tt.log, logs.String())
+		}
+	}
+
+	for _, route := range []string{"tracker.example.com=reject@127.0.0.1:1080", "tracker.example.com=reject|:8080"} {
+		if _, err := parseRoute(route); err == nil {
+			t.Errorf("parseRoute(%q) succeeded, want an error", route)
+		}
+	}
+}
+
+func TestMaintenanceSendsAlert(t *testing.T) {
+	var dials atomic.Int32
+	backend := startBackend(t, func(c net.Conn) {
+		dials.Add(1)
+		c.Close()
+	})
+	addr := serveTest(t, newTestServer(t,
+		"down.example.com="+backend+",maintenance=true",
+		"gone.example.com="+backend+",maintenance=unrecognized_name",
+	))
+	tests := []struct {
+		sni   string
+		alert byte
+	}{
+		{"down.example.com", 80},
+		{"gone.example.com", 112},
+	}
+	for _, tt := range tests {
+		before := connsRejected.with(rejectPolicy, "maintenance").Load()
+		conn := dialHello(t, addr, helloFor(t, tt.sni))
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		got, _ := io.ReadAll(conn)
+		if want := []byte{recordTypeAlert, 3, 3, 0, 2, 2, tt.alert}; !bytes.Equal(got, want) {
+			t.Errorf("%s: client got %x, want the fatal alert %x", tt.sni, got, want)
+		}
+		if got := connsRejected.with(rejectPolicy, "maintenance").Load() - before; got != 1 {
+			t.Errorf("%s: maintenance rejections rose by %d, want 1", tt.sni, got)
+		}
+	}
+	if n := dials.Load(); n != 0 {
+		t.Errorf("maintenance routes dialed their backend %d times, want 0", n)
+	}
+
+	if _, err := parseRoute("down.example.com=:8080,maintenance=bad_alert"); err == nil {
+		t.Error("parseRoute with an unknown maintenance alert succeeded, want an error")
+	}
+}
+
+func TestSlowHandshakeFlagged(t *testing.T) {
+	defer func(rate int, drop bool) { slowHandshakeRate, dropSlowHandshakes = rate, drop }(slowHandshakeRate, dropSlowHandshakes)
+	slowHandshakeRate, dropSlowHandshakes = 1<<20, true
+	logs := captureLog(t)
+	hello := helloFor(t, "example.com")
+	addr := serveTest(t, newTestServer(t, "example.com=127.0.0.1:8443,dialer=pipe"))
+	flagged := slowHandshakes.with().Load()
+	dropped := connsRejected.with(rejectMalformed, "slow_handshake").Load()
+
+	// A ClientHello sent at once is too quick to judge
+	conn := dialHello(t, addr, hello)
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if got, err := io.ReadAll(conn); string(got) != "ok" {
+		t.Errorf("fast ClientHello: read %q, %v; want the backend's answer", got, err)
+	}
+
+	// One trickling in over more than slowHandshakeMinTime is flagged
+	conn = dialHello(t, addr, hello[:len(hello)/2])
+	time.Sleep(slowHandshakeMinTime + 100*time.Millisecond)
+	if _, err := conn.Write(hello[len(hello)/2:]); err != nil {
+		t.Fatal(err)
+	}
+	if !waitClosed(conn, 2*time.Second) {
+		t.Fatal("slow ClientHello was not dropped")
+	}
+	waitIdle(t) // Before the flags are restored
+
+	if got := slowHandshakes.with().Load() - flagged; got != 1 {
+		t.Errorf("slow_handshakes_total rose by %d, want 1", got)
+	}
+	if got := connsRejected.with(rejectMalformed, "slow_handshake").Load() - dropped; got != 1 {
+		t.Errorf("slow_handshake rejections rose by %d, want 1", got)
+	}
+	if !strings.Contains(logs.String(), "Rejected [malformed/slow_handshake] ClientHello from 127.0.0.1 arrived at") {
+		t.Errorf("no slow handshake rejection logged:\n%s", logs.String())
+	}
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"crypto/tls"
+	"expvar"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// metricVec is a counter or gauge partitioned by a fixed set of labels
+type metricVec struct {
+	name   string
+	help   string
+	kind   string // "counter" or "gauge"
+	labels []string
+
+	mu     sync.Mutex
+	series map[string]*metricSeries // Keyed by joined label values
+}
+
+type metricSeries struct {
+	labelValues []string
+	value       atomic.Int64
+}
+
+// registry holds every metric in registration order
+var registry []*metricVec
+
+// Exposition settings applied by configureMetrics
+var (
+	metricNamePrefix = "proxys_"
+	constLabelNames  []string // Labels attached to every series, in flag order
+	constLabelValues []string
+)
+
+// metricNameRE matches valid metric name prefixes and label names
+var metricNameRE = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// configureMetrics sets the metric name prefix and the constant labels, given
+// as name=value, attached to every exported series
+func configureMetrics(prefix string, labels []string) error {
+	if prefix != "" && !metricNameRE.MatchString(prefix) {
+		return fmt.Errorf("invalid metrics prefix '%s' (use letters, digits and underscores)", prefix)
+	}
+	metricNamePrefix = prefix
+
+	reserved := make(map[string]bool)
+	for _, m := range registry {
+		for _, l := range m.labels {
+			reserved[l] = true
+		}
+	}
+	for _, spec := range labels {
+		name, value, ok := strings.Cut(spec, "=")
+		if !ok || !metricNameRE.MatchString(name) {
+			return fmt.Errorf("invalid metrics label '%s' (use name=value)", spec)
+		}
+		if reserved[name] {
+			return fmt.Errorf("metrics label '%s' clashes with a built-in label", name)
+		}
+		reserved[name] = true
+		constLabelNames = append(constLabelNames, name)
+		constLabelValues = append(constLabelValues, value)
+	}
+	return nil
+}
+
+func newCounter(name, help string, labels ...string) *metricVec {
+	return register(name, help, "counter", labels)
+}
+
+func newGauge(name, help string, labels ...string) *metricVec {
+	return register(name, help, "gauge", labels)
+}
+
+func register(name, help, kind string, labels []string) *metricVec {
+	m := &metricVec{
+		name:   name,
+		help:   help,
+		kind:   kind,
+		labels: labels,
+		series: make(map[string]*metricSeries),
+	}
+	if len(labels) == 0 {
+		m.with() // Export unlabelled metrics as zero before the first update
+	}
+	registry = append(registry, m)
+	return m
+}
+
+// with returns the series for the given label values, creating it if needed
+func (m *metricVec) with(labelValues ...string) *atomic.Int64 {
+	if len(labelValues) != len(m.labels) {
+		panic(fmt.Sprintf("metric %s: got %d label values, want %d", m.name, len(labelValues), len(m.labels)))
+	}
+	key := strings.Join(labelValues, "\x00")
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, ok := m.series[key]
+	if !ok {
+		s = &metricSeries{labelValues: labelValues}
+		m.series[key] = s
+	}
+	return &s.value
+}
+
+func (m *metricVec) inc(labelValues ...string) {
+	m.with(labelValues...).Add(1)
+}
+
+func (m *metricVec) add(n int64, labelValues ...string) {
+	m.with(labelValues...).Add(n)
+}
+
+// sumBy returns the metric's series summed by the values of the given labels,
+// joined with "/"; with no labels everything is summed under ""
+func (m *metricVec) sumBy(labels ...string) map[string]int64 {
+	idx := make([]int, len(labels))
+	for i, l := range labels {
+		idx[i] = slices.Index(m.labels, l)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	sums := make(map[string]int64)
+	values := make([]string, len(labels))
+	for _, s := range m.series {
+		for i, j := range idx {
+			values[i] = s.labelValues[j]
+		}
+		sums[strings.Join(values, "/")] += s.value.Load()
+	}
+	return sums
+}
+
+// writeMetrics writes all metrics in the Prometheus text exposition format
+func writeMetrics(w io.Writer) {
+	for _, m := range registry {
+		name := metricNamePrefix + m.name
+		fmt.Fprintf(w, "# HELP %s %s\n", name, m.help)
+		fmt.Fprintf(w, "# TYPE %s %s\n", name, m.kind)
+
+		m.mu.Lock()
+		keys := make([]string, 0, len(m.series))
+		for k := range m.series {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			s := m.series[k]
+			names := append(constLabelNames[:len(constLabelNames):len(constLabelNames)], m.labels...)
+			values := append(constLabelValues[:len(constLabelValues):len(constLabelValues)], s.labelValues...)
+			fmt.Fprintf(w, "%s%s %d\n", name, formatLabels(names, values), s.value.Load())
+		}
+		m.mu.Unlock()
+	}
+}
+
+func formatLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	pairs := make([]string, len(names))
+	for i := range names {
+		pairs[i] = fmt.Sprintf("%s=%q", names[i], values[i])
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// handleMetrics serves the metrics for Prometheus scraping
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	writeMetrics(w)
+}
+
+// metricsSnapshot returns the current value of every metric, keyed by name.
+// Labelled metrics map each label set to its value.
+func metricsSnapshot() map[string]any {
+	snap := make(map[string]any, len(registry))
+	for _, m := range registry {
+		m.mu.Lock()
+		if len(m.labels) == 0 {
+			snap[m.name] = m.series[""].value.Load()
+		} else {
+			values := make(map[string]int64, len(m.series))
+			for _, s := range m.series {
+				values[strings.Trim(formatLabels(m.labels, s.labelValues), "{}")] = s.value.Load()
+			}
+			snap[m.name] = values
+		}
+		m.mu.Unlock()
+	}
+	return snap
+}
+
+// The metrics are published once; expvar panics on a name published twice
+func init() {
+	expvar.Publish("proxys", expvar.Func(func() any { return metricsSnapshot() }))
+}
+
+// startExpvar binds a server exposing the metrics through expvar at
+// /debug/vars and serves it in the background
+func startExpvar(addr string, tlsCfg *tls.Config) error {
+	l, err := listenAdmin("expvar", addr, tlsCfg)
+	if err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/debug/vars", expvar.Handler())
+
+	log.Printf("Starting expvar server on %s", addr)
+	go func() {
+		if err := http.Serve(l, mux); err != nil {
+			log.Fatalf("Expvar server failed: %v", err)
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExpvarReportsCounters(t *testing.T) {
+	backend := startBackend(t, func(conn net.Conn) {
+		defer conn.Close()
+		io.Copy(io.Discard, conn)
+	})
+	addr := serveTest(t, newTestServer(t, "example.com="+backend))
+	accepted := connsAccepted.with().Load()
+	upstream := bytesTransferred.with("upstream").Load()
+
+	hello := helloFor(t, "example.com")
+	routed := dialHello(t, addr, hello)
+	routed.(*net.TCPConn).CloseWrite()
+	if !waitClosed(routed, 5*time.Second) {
+		t.Fatal("routed connection was not closed")
+	}
+	rejected := dialHello(t, addr, []byte("GET / HTTP/1.1\r\n\r\n"))
+	if !waitClosed(rejected, 5*time.Second) {
+		t.Fatal("HTTP request was not rejected")
+	}
+	waitIdle(t)
+
+	expvarAddr := closedAddr(t)
+	if err := startExpvar(expvarAddr, nil); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.Get("http://" + expvarAddr + "/debug/vars")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var vars struct {
+		Proxys struct {
+			Accepted int64            `json:"connections_accepted_total"`
+			Rejected map[string]int64 `json:"connections_rejected_total"`
+			Active   int64            `json:"connections_active"`
+			Bytes    map[string]int64 `json:"bytes_transferred_total"`
+		} `json:"proxys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&vars); err != nil {
+		t.Fatalf("/debug/vars is not valid JSON: %v", err)
+	}
+
+	m := vars.Proxys
+	if m.Accepted < accepted+2 {
+		t.Errorf("connections_accepted_total = %d, want at least %d", m.Accepted, accepted+2)
+	}
+	if n := m.Rejected[`class="malformed",reason="not_tls"`]; n == 0 {
+		t.Errorf("connections_rejected_total = %v, want a malformed/not_tls rejection", m.Rejected)
+	}
+	if m.Active != 0 {
+		t.Errorf("connections_active = %d, want 0", m.Active)
+	}
+	if n := m.Bytes[`direction="upstream"`]; n < upstream+int64(len(hello)) {
+		t.Errorf("upstream bytes = %d, want at least %d", n, upstream+int64(len(hello)))
+	}
+}
+
+func TestMetricsPrefixAndConstantLabels(t *testing.T) {
+	defer func(prefix string, names, values []string) {
+		metricNamePrefix, constLabelNames, constLabelValues = prefix, names, values
+	}(metricNamePrefix, constLabelNames, constLabelValues)
+	if err := configureMetrics("edge_", []string{"instance=edge1", "region=eu"}); err != nil {
+		t.Fatal(err)
+	}
+	bytesTransferred.with("upstream")
+
+	var out strings.Builder
+	writeMetrics(&out)
+	for _, want := range []string{
+		"# TYPE edge_connections_accepted_total counter\n",
+		`edge_connections_accepted_total{instance="edge1",region="eu"} `,
+		`edge_bytes_transferred_total{instance="edge1",region="eu",direction="upstream"} `,
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("metrics lack %q:\n%s", want, out.String())
+		}
+	}
+	if strings.Contains(out.String(), "proxys_") {
+		t.Errorf("metrics still carry the default prefix:\n%s", out.String())
+	}
+
+	for _, tt := range []struct {
+		prefix string
+		labels []string
+	}{
+		{"9edge_", nil},
+		{"edge-", nil},
+		{"edge_", []string{"instance"}},
+		{"edge_", []string{"direction=up"}},
+		{"edge_", []string{"instance=a", "instance=b"}},
+	} {
+		metricNamePrefix, constLabelNames, constLabelValues = "", nil, nil
+		if err := configureMetrics(tt.prefix, tt.labels); err == nil {
+			t.Errorf("configureMetrics(%q, %q) succeeded, want an error", tt.prefix, tt.labels)
+		}
+	}
+}
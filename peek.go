@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"time"
+)
+
+// maxCoalesceBytes bounds how many extra client bytes are held back to be
+// sent with the ClientHello
+const maxCoalesceBytes = 16 * 1024
+
+// peeker holds the bytes read from a client before the routing decision.
+// Whatever is still held when a backend is chosen is replayed to it exactly
+// once; on reject, or for records that must not reach the backend, the bytes
+// are discarded instead.
+type peeker struct {
+	conn net.Conn
+	buf  bytes.Buffer
+}
+
+// Peek reads exactly n more bytes from the client, holds them for replay and
+// returns them
+func (p *peeker) Peek(n int) ([]byte, error) {
+	start := p.buf.Len()
+	if _, err := io.CopyN(&p.buf, p.conn, int64(n)); err != nil {
+		return nil, err
+	}
+	return p.buf.Bytes()[start:], nil
+}
+
+// Bytes returns the bytes held for replay
+func (p *peeker) Bytes() []byte {
+	return p.buf.Bytes()
+}
+
+// Discard drops the held bytes so they are never replayed, releasing the
+// buffer like Replay does
+func (p *peeker) Discard() {
+	p.buf = bytes.Buffer{}
+}
+
+// Coalesce waits up to wait for client bytes that follow the held ones,
+// holding at most max more so they go out in the same write. It returns after
+// a single read, as soon as any bytes arrive, since a client that has sent
+// its first flight waits for the server before sending more. Errors are left
+// for the copy to surface, since the connection reports them again on the
+// next read. It returns how many bytes were added
+func (p *peeker) Coalesce(max int, wait time.Duration) int {
+	p.buf.Grow(max)
+	more := p.buf.AvailableBuffer()[:max]
+	p.conn.SetReadDeadline(time.Now().Add(wait))
+	n, _ := p.conn.Read(more)
+	p.conn.SetReadDeadline(time.Time{})
+	p.buf.Write(more[:n])
+	return n
+}
+
+// Replay writes the held bytes to w and releases them, returning how many
+// were written. The buffer itself is dropped rather than reset, since the
+// peeker lives as long as the connection and Reset would keep the backing
+// array of the whole handshake alive while the rest streams through.
+func (p *peeker) Replay(w io.Writer) (int, error) {
+	n, err := w.Write(p.buf.Bytes())
+	p.buf = bytes.Buffer{}
+	return n, err
+}
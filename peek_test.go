@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestPeekerCoalesceReturnsOnData(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	p := &peeker{conn: server}
+	go client.Write([]byte("hello"))
+	if _, err := p.Peek(5); err != nil {
+		t.Fatal(err)
+	}
+	go client.Write([]byte(" world"))
+
+	const wait = 5 * time.Second
+	start := time.Now()
+	n := p.Coalesce(maxCoalesceBytes, wait)
+	if took := time.Since(start); took >= wait {
+		t.Errorf("Coalesce took %s, want it to return once data arrived", took)
+	}
+	if n != 6 {
+		t.Errorf("Coalesce added %d bytes, want 6", n)
+	}
+
+	var got bytes.Buffer
+	if _, err := p.Replay(&got); err != nil {
+		t.Fatal(err)
+	}
+	if got.String() != "hello world" {
+		t.Errorf("Replay wrote %q, want %q", got.String(), "hello world")
+	}
+}
+
+func TestPeekerCoalesceTimesOut(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	p := &peeker{conn: server}
+	if n := p.Coalesce(maxCoalesceBytes, 10*time.Millisecond); n != 0 {
+		t.Errorf("Coalesce added %d bytes from a silent client, want 0", n)
+	}
+
+	// The deadline is cleared again for the copy that follows
+	go client.Write([]byte("late"))
+	buf := make([]byte, 4)
+	server.SetReadDeadline(time.Time{})
+	if _, err := server.Read(buf); err != nil {
+		t.Errorf("Read after Coalesce: %v", err)
+	}
+}
+
+func TestPeekerCoalesceHoldsAtMostMax(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	p := &peeker{conn: server}
+	go client.Write(bytes.Repeat([]byte("x"), 100))
+	if n := p.Coalesce(10, time.Second); n != 10 {
+		t.Errorf("Coalesce added %d bytes, want 10", n)
+	}
+	if len(p.Bytes()) != 10 {
+		t.Errorf("peeker holds %d bytes, want 10", len(p.Bytes()))
+	}
+}
+
+func TestPeekerReplayReleasesBuffer(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	p := &peeker{conn: server}
+	hello := bytes.Repeat([]byte("h"), 16<<10)
+	go client.Write(hello)
+	if _, err := p.Peek(len(hello)); err != nil {
+		t.Fatal(err)
+	}
+
+	var got bytes.Buffer
+	n, err := p.Replay(&got)
+	if err != nil || n != len(hello) || !bytes.Equal(got.Bytes(), hello) {
+		t.Fatalf("Replay wrote %d bytes, err %v; want the %d peeked bytes", n, err, len(hello))
+	}
+	if c := p.buf.Cap(); c != 0 {
+		t.Errorf("peeker still holds a %d byte buffer after Replay", c)
+	}
+
+	go client.Write(hello)
+	if _, err := p.Peek(len(hello)); err != nil {
+		t.Fatal(err)
+	}
+	p.Discard()
+	if c := p.buf.Cap(); c != 0 {
+		t.Errorf("peeker still holds a %d byte buffer after Discard", c)
+	}
+}
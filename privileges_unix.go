@@ -0,0 +1,54 @@
+//go:build unix
+
+package main
+
+import (
+	"fmt"
+	"os/user"
+	"strconv"
+	"syscall"
+)
+
+// dropPrivileges switches the process to the given user and group. An empty
+// group defaults to the user's primary group; an empty user only changes group.
+func dropPrivileges(userName, groupName string) error {
+	uid, gid := -1, -1
+
+	if userName != "" {
+		u, err := user.Lookup(userName)
+		if err != nil {
+			return fmt.Errorf("unknown user '%s': %v", userName, err)
+		}
+		if uid, err = strconv.Atoi(u.Uid); err != nil {
+			return fmt.Errorf("invalid uid for user '%s': %v", userName, err)
+		}
+		if gid, err = strconv.Atoi(u.Gid); err != nil {
+			return fmt.Errorf("invalid gid for user '%s': %v", userName, err)
+		}
+	}
+	if groupName != "" {
+		g, err := user.LookupGroup(groupName)
+		if err != nil {
+			return fmt.Errorf("unknown group '%s': %v", groupName, err)
+		}
+		if gid, err = strconv.Atoi(g.Gid); err != nil {
+			return fmt.Errorf("invalid gid for group '%s': %v", groupName, err)
+		}
+	}
+
+	// Group must change first, while we still have the privilege to do so
+	if gid != -1 {
+		if err := syscall.Setgroups([]int{gid}); err != nil {
+			return fmt.Errorf("setgroups: %v", err)
+		}
+		if err := syscall.Setgid(gid); err != nil {
+			return fmt.Errorf("setgid: %v", err)
+		}
+	}
+	if uid != -1 {
+		if err := syscall.Setuid(uid); err != nil {
+			return fmt.Errorf("setuid: %v", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,50 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"os/exec"
+	"os/user"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestDropPrivilegesUnknownUser(t *testing.T) {
+	if err := dropPrivileges("proxys-no-such-user", ""); err == nil || !strings.Contains(err.Error(), "unknown user 'proxys-no-such-user'") {
+		t.Errorf("dropPrivileges to a missing user: %v", err)
+	}
+	if err := dropPrivileges("", "proxys-no-such-group"); err == nil || !strings.Contains(err.Error(), "unknown group 'proxys-no-such-group'") {
+		t.Errorf("dropPrivileges to a missing group: %v", err)
+	}
+}
+
+// TestDropPrivileges drops to nobody in a child process, since a process
+// cannot get its privileges back
+func TestDropPrivileges(t *testing.T) {
+	if name := os.Getenv("PROXYS_TEST_DROP_TO"); name != "" {
+		if err := dropPrivileges(name, ""); err != nil {
+			t.Fatal(err)
+		}
+		os.Stdout.WriteString(strconv.Itoa(os.Getuid()) + " " + strconv.Itoa(os.Getgid()) + "\n")
+		return
+	}
+	if os.Getuid() != 0 {
+		t.Skip("dropping privileges needs root")
+	}
+	nobody, err := user.Lookup("nobody")
+	if err != nil {
+		t.Skipf("no nobody user: %v", err)
+	}
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestDropPrivileges$")
+	cmd.Env = append(os.Environ(), "PROXYS_TEST_DROP_TO=nobody")
+	out, err := cmd.Output()
+	if err != nil {
+		t.Fatalf("child: %v\n%s", err, out)
+	}
+	if got, want := strings.Fields(string(out)), []string{nobody.Uid, nobody.Gid}; len(got) < 2 || got[0] != want[0] || got[1] != want[1] {
+		t.Errorf("child runs as uid/gid %q, want %q", out, want)
+	}
+}
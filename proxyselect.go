@@ -0,0 +1,96 @@
+package main
+
+import (
+	"math/rand/v2"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Proxy selection policies for routes with several SOCKS proxies
+const (
+	proxySelectRoundRobin = "roundrobin"
+	proxySelectLatency    = "latency"
+)
+
+// proxyLatencyWeight is the weight of a new dial sample in a proxy's latency
+// estimate; older samples decay by 1-proxyLatencyWeight per dial
+const proxyLatencyWeight = 0.3
+
+// proxyExploreRate sends 1 in this many latency-selected dials to a random
+// proxy, so a proxy that was slow once can win back traffic
+const proxyExploreRate = 20
+
+// latencyTracker keeps a decaying estimate of each SOCKS proxy's dial latency
+type latencyTracker struct {
+	mu  sync.Mutex
+	est map[string]time.Duration
+}
+
+// proxyLatency holds the dial latency estimates shared by all routes
+var proxyLatency = &latencyTracker{est: make(map[string]time.Duration)}
+
+// Observe folds a dial through proxy that took d into its estimate and
+// returns the new estimate
+func (t *latencyTracker) Observe(proxy string, d time.Duration) time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if prev, ok := t.est[proxy]; ok {
+		d = prev + time.Duration(proxyLatencyWeight*float64(d-prev))
+	}
+	t.est[proxy] = d
+	return d
+}
+
+// Fastest returns the proxy with the lowest estimate. Unmeasured proxies are
+// tried first, and an occasional random pick keeps the other estimates fresh.
+func (t *latencyTracker) Fastest(proxies []string) string {
+	if rand.IntN(proxyExploreRate) == 0 {
+		return proxies[rand.IntN(len(proxies))]
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	best, bestEst := "", time.Duration(0)
+	for _, p := range proxies {
+		d, ok := t.est[p]
+		if !ok {
+			return p
+		}
+		if best == "" || d < bestEst {
+			best, bestEst = p, d
+		}
+	}
+	return best
+}
+
+// proxies returns every SOCKS proxy of the route, primary first
+func (c *RouteConfig) proxies() []string {
+	if c.ProxyAddr == "" {
+		return nil
+	}
+	return append([]string{c.ProxyAddr}, c.ExtraProxies...)
+}
+
+// pickProxy returns the SOCKS proxy to dial through for one connection,
+// following the route's proxyselect policy when it lists several
+func (c *RouteConfig) pickProxy() string {
+	if len(c.ExtraProxies) == 0 {
+		return c.ProxyAddr
+	}
+	proxies := c.proxies()
+	if c.ProxySelect == proxySelectLatency {
+		return proxyLatency.Fastest(proxies)
+	}
+	return proxies[(c.proxyNext.Add(1)-1)%uint64(len(proxies))]
+}
+
+// setProxies sets the route's SOCKS proxies, defaulting to round-robin
+// selection when there are several
+func (c *RouteConfig) setProxies(primary string, extra []string) {
+	c.ProxyAddr = primary
+	if len(extra) > 0 {
+		c.ExtraProxies = extra
+		c.ProxySelect = proxySelectRoundRobin
+		c.proxyNext = new(atomic.Uint64)
+	}
+}
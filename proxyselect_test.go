@@ -0,0 +1,55 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLatencySelectionPrefersFasterProxy(t *testing.T) {
+	defer func(v *latencyTracker) { proxyLatency = v }(proxyLatency)
+	proxyLatency = &latencyTracker{est: make(map[string]time.Duration)}
+
+	rm, err := parseRoutes([]string{"example.com=:8080@fast:1080|slow:1080,proxyselect=latency"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := rm.Routes()[0]
+
+	// picks counts how often each proxy is chosen when every dial through
+	// it takes the given simulated latency
+	latency := map[string]time.Duration{"fast:1080": 20 * time.Millisecond, "slow:1080": 200 * time.Millisecond}
+	picks := func(n int) map[string]int {
+		got := make(map[string]int)
+		for range n {
+			p := cfg.pickProxy()
+			got[p]++
+			proxyLatency.Observe(p, latency[p])
+		}
+		return got
+	}
+
+	// Both proxies are measured once, then the faster one takes nearly all
+	// dials, leaving only the occasional exploring pick to the other
+	picks(2)
+	if got := picks(1000); got["fast:1080"] < 900 {
+		t.Errorf("picks with fast:1080 faster = %v, want most on fast:1080", got)
+	}
+
+	// Once the first proxy slows down, the estimates shift traffic over
+	latency["fast:1080"] = time.Second
+	picks(200)
+	if got := picks(1000); got["slow:1080"] < 900 {
+		t.Errorf("picks after fast:1080 slowed = %v, want most on slow:1080", got)
+	}
+}
+
+func TestLatencyTrackerDecays(t *testing.T) {
+	lt := &latencyTracker{est: make(map[string]time.Duration)}
+	if got := lt.Observe("p:1080", 100*time.Millisecond); got != 100*time.Millisecond {
+		t.Errorf("first estimate = %s, want the sample itself", got)
+	}
+	want := 100*time.Millisecond + time.Duration(proxyLatencyWeight*float64(100*time.Millisecond))
+	if got := lt.Observe("p:1080", 200*time.Millisecond); got != want {
+		t.Errorf("estimate after a slower sample = %s, want %s", got, want)
+	}
+}
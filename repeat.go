@@ -0,0 +1,85 @@
+package main
+
+import (
+	"container/list"
+	"hash/fnv"
+	"sync"
+	"time"
+)
+
+var (
+	helloRepeats     = newCounter("clienthello_repeats_total", "Identical ClientHellos seen from a new client IP within the repeat window")
+	helloRepeatAlert = newCounter("clienthello_repeat_alerts_total", "ClientHellos seen from too many distinct client IPs within the repeat window")
+)
+
+// repeatTracker detects identical ClientHello bytes arriving from several
+// client IPs, which a real client never produces since each hello carries
+// fresh random bytes. Hellos are tracked by hash in a bounded LRU.
+type repeatTracker struct {
+	window    time.Duration // How long a hello is remembered after first being seen
+	threshold int           // Distinct client IPs that trigger an alert
+	size      int           // Maximum hellos tracked
+
+	mu      sync.Mutex
+	lru     *list.List // Of *repeatState, most recently seen first
+	entries map[uint64]*list.Element
+}
+
+type repeatState struct {
+	hash    uint64
+	first   time.Time
+	ips     map[string]struct{} // Distinct client IPs, capped at threshold
+	alerted bool
+}
+
+func newRepeatTracker(window time.Duration, threshold, size int) *repeatTracker {
+	return &repeatTracker{
+		window:    window,
+		threshold: threshold,
+		size:      size,
+		lru:       list.New(),
+		entries:   make(map[uint64]*list.Element),
+	}
+}
+
+// Observe records that ip sent hello and reports whether this crossed the
+// alert threshold, along with the number of distinct IPs seen
+func (t *repeatTracker) Observe(ip string, hello []byte) (alert bool, distinct int) {
+	h := fnv.New64a()
+	h.Write(hello)
+	sum := h.Sum64()
+	now := clk.Now()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var st *repeatState
+	if el, ok := t.entries[sum]; ok && now.Sub(el.Value.(*repeatState).first) < t.window {
+		st = el.Value.(*repeatState)
+		t.lru.MoveToFront(el)
+	} else {
+		if ok {
+			t.lru.Remove(el)
+		}
+		st = &repeatState{hash: sum, first: now, ips: make(map[string]struct{})}
+		t.entries[sum] = t.lru.PushFront(st)
+		if t.lru.Len() > t.size {
+			oldest := t.lru.Remove(t.lru.Back()).(*repeatState)
+			delete(t.entries, oldest.hash)
+		}
+	}
+
+	if _, seen := st.ips[ip]; !seen && len(st.ips) < t.threshold {
+		if len(st.ips) > 0 {
+			helloRepeats.inc()
+		}
+		st.ips[ip] = struct{}{}
+	}
+
+	distinct = len(st.ips)
+	if distinct < t.threshold || st.alerted {
+		return false, distinct
+	}
+	st.alerted = true
+	return true, distinct
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRepeatTrackerCountsDistinctIPs(t *testing.T) {
+	fc := useFakeClock(t)
+	tr := newRepeatTracker(time.Minute, 3, 16)
+	hello := []byte("identical ClientHello bytes")
+	repeats := helloRepeats.with().Load()
+
+	steps := []struct {
+		ip       string
+		alert    bool
+		distinct int
+	}{
+		{"192.0.2.1", false, 1},
+		{"192.0.2.1", false, 1}, // A retry from the same client is no repeat
+		{"192.0.2.2", false, 2},
+		{"192.0.2.3", true, 3},
+		{"192.0.2.4", false, 3}, // One alert per hello
+	}
+	for i, s := range steps {
+		if alert, distinct := tr.Observe(s.ip, hello); alert != s.alert || distinct != s.distinct {
+			t.Errorf("step %d: Observe(%s) = %v, %d; want %v, %d", i, s.ip, alert, distinct, s.alert, s.distinct)
+		}
+	}
+	if got := helloRepeats.with().Load() - repeats; got != 2 {
+		t.Errorf("clienthello_repeats_total rose by %d, want 2", got)
+	}
+	if _, distinct := tr.Observe("192.0.2.1", []byte("another ClientHello")); distinct != 1 {
+		t.Errorf("a different hello counts %d IPs, want its own count of 1", distinct)
+	}
+
+	// Past the window the hello starts over
+	fc.Advance(time.Minute)
+	if _, distinct := tr.Observe("192.0.2.2", hello); distinct != 1 {
+		t.Errorf("after the window the hello counts %d IPs, want 1", distinct)
+	}
+}
+
+func TestRepeatTrackerEvictsLeastRecent(t *testing.T) {
+	useFakeClock(t)
+	tr := newRepeatTracker(time.Minute, 3, 2)
+
+	tr.Observe("192.0.2.1", []byte("a"))
+	tr.Observe("192.0.2.1", []byte("b"))
+	tr.Observe("192.0.2.2", []byte("a")) // a is now the most recent
+	tr.Observe("192.0.2.1", []byte("c")) // Evicts b
+
+	if _, distinct := tr.Observe("192.0.2.3", []byte("a")); distinct != 3 {
+		t.Errorf("recently seen hello counts %d IPs, want 3", distinct)
+	}
+	if _, distinct := tr.Observe("192.0.2.2", []byte("b")); distinct != 1 {
+		t.Errorf("evicted hello counts %d IPs, want a fresh count of 1", distinct)
+	}
+}
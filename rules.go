@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net/netip"
+	"os"
+	"strings"
+	"time"
+)
+
+// rule is one line of a -rules file: an action for connections whose SNI,
+// client address and local time of day all match. Rules are tried in file
+// order and the first match wins.
+type rule struct {
+	line   int
+	text   string
+	deny   bool
+	route  *RouteConfig   // Host fields match the SNI; the rest routes allowed connections
+	from   []netip.Prefix // Client networks (empty matches any client)
+	during *timeWindow    // Local time of day (nil matches any time)
+}
+
+// ruleSet is an ordered list of rules loaded from -rules
+type ruleSet struct {
+	rules []*rule
+}
+
+// loadRules reads a rules file, one rule per line. Blank lines and lines
+// starting with # are ignored.
+func loadRules(path string) (*ruleSet, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open rules file '%s': %v", path, err)
+	}
+	defer f.Close()
+
+	rs := &ruleSet{}
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		r, err := parseRule(line)
+		if err != nil {
+			return nil, fmt.Errorf("rules file '%s' line %d: %v", path, n, err)
+		}
+		r.line = n
+		rs.rules = append(rs.rules, r)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read rules file '%s': %v", path, err)
+	}
+	return rs, nil
+}
+
+// parseRule parses a rule of the form
+//
+//	allow|deny <host> [from <cidr>,...] [during HH:MM-HH:MM] [to <target>|...] [via <proxy>] [with <options>]
+//
+// where host is anything a route accepts, including * for any SNI. to, via
+// and with take the values of the corresponding -route parts and only apply
+// to allow rules; an allow rule without to is a passthrough.
+func parseRule(line string) (*rule, error) {
+	fields := strings.Fields(line)
+	if len(fields) < 2 || len(fields)%2 != 0 {
+		return nil, fmt.Errorf("invalid rule '%s' (use allow|deny <host> followed by keyword value pairs)", line)
+	}
+
+	r := &rule{text: line}
+	switch fields[0] {
+	case "allow":
+	case "deny":
+		r.deny = true
+	default:
+		return nil, fmt.Errorf("unknown rule action '%s' (use allow or deny)", fields[0])
+	}
+
+	clauses := make(map[string]string)
+	for i := 2; i < len(fields); i += 2 {
+		key, value := fields[i], fields[i+1]
+		if _, dup := clauses[key]; dup {
+			return nil, fmt.Errorf("duplicate '%s' in rule", key)
+		}
+		clauses[key] = value
+		switch key {
+		case "from":
+			for _, cidr := range strings.Split(value, ",") {
+				prefix, err := netip.ParsePrefix(cidr)
+				if err != nil {
+					ip, ipErr := netip.ParseAddr(cidr)
+					if ipErr != nil {
+						return nil, fmt.Errorf("invalid client network '%s' (use a CIDR or IP)", cidr)
+					}
+					prefix = netip.PrefixFrom(ip, ip.BitLen())
+				}
+				r.from = append(r.from, prefix.Masked())
+			}
+		case "during":
+			w, err := parseTimeWindow(value)
+			if err != nil {
+				return nil, err
+			}
+			r.during = w
+		case "to", "via", "with":
+			if r.deny {
+				return nil, fmt.Errorf("'%s' cannot be used in a deny rule", key)
+			}
+		default:
+			return nil, fmt.Errorf("unknown rule keyword '%s' (use from, during, to, via or with)", key)
+		}
+	}
+
+	// The routing part reuses the -route parser
+	spec := fields[1]
+	if target, ok := clauses["to"]; ok {
+		spec += "=" + target
+	}
+	if proxy, ok := clauses["via"]; ok {
+		spec += "@" + proxy
+	}
+	if opts, ok := clauses["with"]; ok {
+		spec += "," + opts
+	}
+	cfg, err := parseRoute(spec)
+	if err != nil {
+		return nil, err
+	}
+	r.route = cfg
+	return r, nil
+}
+
+// matches reports whether the rule applies to a connection for sni from ip at now
+func (r *rule) matches(sni string, hasALPN bool, ip netip.Addr, now time.Time) bool {
+	if !r.route.Matches(sni) || (r.route.NoALPN && hasALPN) {
+		return false
+	}
+	if len(r.from) > 0 {
+		in := false
+		for _, p := range r.from {
+			if p.Contains(ip) {
+				in = true
+				break
+			}
+		}
+		if !in {
+			return false
+		}
+	}
+	return r.during == nil || r.during.Contains(now)
+}
+
+// Match returns the first rule that applies to a connection for sni from
+// clientIP at now, or nil if none does
+func (rs *ruleSet) Match(sni string, hasALPN bool, clientIP string, now time.Time) *rule {
+	ip, _ := netip.ParseAddr(clientIP)
+	ip = ip.Unmap()
+	for _, r := range rs.rules {
+		if r.matches(sni, hasALPN, ip, now) {
+			return r
+		}
+	}
+	return nil
+}
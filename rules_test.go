@@ -0,0 +1,82 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRuleSetFirstMatchWins(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rules")
+	os.WriteFile(path, []byte(`# Staff reach the admin host through the proxy during office hours
+allow admin.example.com from 10.0.0.0/8 during 09:00-17:00 to 10.1.0.1:443 via 127.0.0.1:1080
+deny admin.example.com
+deny .example.com from 192.0.2.0/24
+
+allow .example.com to 10.2.0.1:443 with log=summary
+allow * from 2001:db8::/32,198.51.100.7
+`), 0o644)
+	rs, err := loadRules(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	office := time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC)
+	night := time.Date(2024, 1, 1, 22, 0, 0, 0, time.UTC)
+	tests := []struct {
+		sni, ip string
+		now     time.Time
+		line    int // Line of the matching rule (0 for none)
+	}{
+		{"admin.example.com", "10.0.0.5", office, 2},
+		{"admin.example.com", "10.0.0.5", night, 3},
+		{"admin.example.com", "198.51.100.1", office, 3},
+		{"www.example.com", "192.0.2.9", office, 4},
+		{"www.example.com", "10.0.0.5", office, 6},
+		{"example.com", "10.0.0.5", office, 0},
+		{"other.test", "2001:db8::1", office, 7},
+		{"other.test", "::ffff:198.51.100.7", office, 7},
+		{"other.test", "198.51.100.8", office, 0},
+	}
+	for _, tt := range tests {
+		var line int
+		if r := rs.Match(tt.sni, false, tt.ip, tt.now); r != nil {
+			line = r.line
+		}
+		if line != tt.line {
+			t.Errorf("Match(%s from %s at %s) = line %d, want %d", tt.sni, tt.ip, tt.now.Format("15:04"), line, tt.line)
+		}
+	}
+
+	r := rs.rules[0]
+	if r.deny || r.route.Target != "10.1.0.1:443" || r.route.ProxyAddr != "127.0.0.1:1080" {
+		t.Errorf("rule on line 2 routes %+v, want 10.1.0.1:443 via 127.0.0.1:1080", r.route)
+	}
+	if r := rs.rules[3]; r.route.Target != "10.2.0.1:443" || r.route.Log != routeLogSummary {
+		t.Errorf("rule on line 6 routes %+v, want 10.2.0.1:443 with log=summary", r.route)
+	}
+	if r := rs.rules[4]; !r.route.Passthrough {
+		t.Errorf("rule on line 7 routes %+v, want passthrough", r.route)
+	}
+}
+
+func TestParseRuleErrors(t *testing.T) {
+	tests := []struct{ rule, err string }{
+		{"allow", "invalid rule"},
+		{"permit example.com", "unknown rule action 'permit'"},
+		{"allow example.com from", "invalid rule"},
+		{"allow example.com at 10.0.0.0/8", "unknown rule keyword 'at'"},
+		{"allow example.com from 10.0.0.0/33", "invalid client network '10.0.0.0/33'"},
+		{"allow example.com during 9-17", "invalid time window '9-17'"},
+		{"deny example.com to 10.0.0.1:443", "'to' cannot be used in a deny rule"},
+		{"allow example.com from 10.0.0.0/8 from 192.0.2.0/24", "duplicate 'from' in rule"},
+		{"allow example.com to 10.0.0.1:443 with speed=fast", "unknown route option"},
+	}
+	for _, tt := range tests {
+		if _, err := parseRule(tt.rule); err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("parseRule(%q) = %v, want an error containing %q", tt.rule, err, tt.err)
+		}
+	}
+}
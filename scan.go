@@ -0,0 +1,102 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+var scanAlerts = newCounter("sni_scan_alerts_total", "Client IPs that probed too many distinct SNIs within the scan window")
+
+// scanTracker detects client IPs probing many distinct SNIs in a sliding window
+type scanTracker struct {
+	window    time.Duration // Sliding window over which distinct SNIs are counted
+	threshold int           // Distinct SNIs within the window that trigger an alert
+	blockFor  time.Duration // How long to block an alerting IP (0 disables blocking)
+
+	mu      sync.Mutex
+	clients map[string]*scanState
+}
+
+type scanState struct {
+	snis         map[string]time.Time // Last time each SNI was seen
+	alerted      bool                 // Alert already raised for the current burst
+	blockedUntil time.Time
+}
+
+func newScanTracker(window time.Duration, threshold int, blockFor time.Duration) *scanTracker {
+	t := &scanTracker{
+		window:    window,
+		threshold: threshold,
+		blockFor:  blockFor,
+		clients:   make(map[string]*scanState),
+	}
+	go t.evictLoop(clk.NewTicker(window))
+	return t
+}
+
+// Blocked reports whether ip is currently blocked for scanning
+func (t *scanTracker) Blocked(ip string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	st, ok := t.clients[ip]
+	return ok && clk.Now().Before(st.blockedUntil)
+}
+
+// Observe records that ip requested sni and reports whether this crossed
+// the scan threshold. The number of distinct SNIs seen is returned as well.
+func (t *scanTracker) Observe(ip, sni string) (alert bool, distinct int) {
+	now := clk.Now()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	st, ok := t.clients[ip]
+	if !ok {
+		st = &scanState{snis: make(map[string]time.Time)}
+		t.clients[ip] = st
+	}
+	st.prune(now.Add(-t.window))
+
+	// Once at the threshold there is nothing more to learn, so cap memory per IP
+	if _, seen := st.snis[sni]; seen || len(st.snis) < t.threshold {
+		st.snis[sni] = now
+	}
+
+	distinct = len(st.snis)
+	if distinct < t.threshold {
+		st.alerted = false
+		return false, distinct
+	}
+	if st.alerted {
+		return false, distinct
+	}
+
+	st.alerted = true
+	if t.blockFor > 0 {
+		st.blockedUntil = now.Add(t.blockFor)
+	}
+	return true, distinct
+}
+
+func (st *scanState) prune(cutoff time.Time) {
+	for sni, seen := range st.snis {
+		if seen.Before(cutoff) {
+			delete(st.snis, sni)
+		}
+	}
+}
+
+// evictLoop drops state for IPs that are idle and not blocked on every tick
+func (t *scanTracker) evictLoop(ticker ticker) {
+	defer ticker.Stop()
+	for now := range ticker.C() {
+		t.mu.Lock()
+		for ip, st := range t.clients {
+			st.prune(now.Add(-t.window))
+			if len(st.snis) == 0 && !now.Before(st.blockedUntil) {
+				delete(t.clients, ip)
+			}
+		}
+		t.mu.Unlock()
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestScanTrackerAlertsAndBlocks(t *testing.T) {
+	fc := useFakeClock(t)
+	tr := newScanTracker(time.Minute, 3, 10*time.Minute)
+
+	steps := []struct {
+		sni      string
+		alert    bool
+		distinct int
+	}{
+		{"a.example.com", false, 1},
+		{"a.example.com", false, 1},
+		{"b.example.com", false, 2},
+		{"c.example.com", true, 3},
+		{"d.example.com", false, 3}, // One alert per burst
+	}
+	for i, s := range steps {
+		if alert, distinct := tr.Observe("192.0.2.1", s.sni); alert != s.alert || distinct != s.distinct {
+			t.Errorf("step %d: Observe(%s) = %v, %d; want %v, %d", i, s.sni, alert, distinct, s.alert, s.distinct)
+		}
+	}
+	if !tr.Blocked("192.0.2.1") {
+		t.Error("scanning IP not blocked after the alert")
+	}
+	if tr.Blocked("192.0.2.2") {
+		t.Error("another IP is blocked")
+	}
+	if alert, distinct := tr.Observe("192.0.2.2", "a.example.com"); alert || distinct != 1 {
+		t.Errorf("other IP: Observe = %v, %d; want its own count", alert, distinct)
+	}
+
+	// Past the block and the window, the IP starts over and a new burst alerts
+	fc.Advance(10 * time.Minute)
+	if tr.Blocked("192.0.2.1") {
+		t.Error("IP still blocked after -sni-scan-block")
+	}
+	var alerts int
+	for _, sni := range []string{"x.example.com", "y.example.com", "z.example.com"} {
+		if alert, _ := tr.Observe("192.0.2.1", sni); alert {
+			alerts++
+		}
+	}
+	if alerts != 1 {
+		t.Errorf("new burst raised %d alerts, want 1", alerts)
+	}
+}
+
+func TestScanTrackerWindowSlides(t *testing.T) {
+	fc := useFakeClock(t)
+	tr := newScanTracker(time.Minute, 3, 0)
+
+	tr.Observe("192.0.2.1", "a.example.com")
+	fc.Advance(40 * time.Second)
+	tr.Observe("192.0.2.1", "b.example.com")
+	fc.Advance(40 * time.Second)
+
+	// a.example.com has left the window, so this is only the second SNI
+	if alert, distinct := tr.Observe("192.0.2.1", "c.example.com"); alert || distinct != 2 {
+		t.Errorf("Observe after a.example.com expired = %v, %d; want false, 2", alert, distinct)
+	}
+	if alert, _ := tr.Observe("192.0.2.1", "d.example.com"); !alert {
+		t.Error("third SNI within the window did not alert")
+	}
+	if tr.Blocked("192.0.2.1") {
+		t.Error("IP blocked with blocking disabled")
+	}
+
+	// Idle IPs are evicted on a tick once their SNIs leave the window.
+	// Advance a tick at a time, since ticks the loop is not ready for are
+	// dropped.
+	evicted := func() bool {
+		tr.mu.Lock()
+		defer tr.mu.Unlock()
+		return len(tr.clients) == 0
+	}
+	for range 3 {
+		fc.Advance(time.Minute)
+		if waitFor(100*time.Millisecond, evicted) {
+			return
+		}
+	}
+	t.Error("idle IP not evicted")
+}
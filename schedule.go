@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// timeWindow is a daily local time range such as 09:00-17:00. A window whose
+// end is before its start wraps past midnight.
+type timeWindow struct {
+	start, end int // Minutes since midnight; end is exclusive
+}
+
+// parseTimeWindow parses a window of the form HH:MM-HH:MM
+func parseTimeWindow(value string) (*timeWindow, error) {
+	from, to, ok := strings.Cut(value, "-")
+	if !ok {
+		return nil, fmt.Errorf("invalid time window '%s' (use HH:MM-HH:MM)", value)
+	}
+	start, err := time.Parse("15:04", from)
+	if err != nil {
+		return nil, fmt.Errorf("invalid time window '%s' (use HH:MM-HH:MM)", value)
+	}
+	end, err := time.Parse("15:04", to)
+	if err != nil {
+		return nil, fmt.Errorf("invalid time window '%s' (use HH:MM-HH:MM)", value)
+	}
+
+	w := &timeWindow{
+		start: start.Hour()*60 + start.Minute(),
+		end:   end.Hour()*60 + end.Minute(),
+	}
+	if w.start == w.end {
+		return nil, fmt.Errorf("invalid time window '%s': start and end are equal", value)
+	}
+	return w, nil
+}
+
+// Contains reports whether t's local time of day falls inside the window
+func (w *timeWindow) Contains(t time.Time) bool {
+	m := t.Hour()*60 + t.Minute()
+	if w.start < w.end {
+		return m >= w.start && m < w.end
+	}
+	return m >= w.start || m < w.end
+}
+
+func (w *timeWindow) String() string {
+	return fmt.Sprintf("%02d:%02d-%02d:%02d", w.start/60, w.start%60, w.end/60, w.end%60)
+}
+
+// MarshalText renders the window in its HH:MM-HH:MM form, e.g. for -dump-config
+func (w *timeWindow) MarshalText() ([]byte, error) {
+	return []byte(w.String()), nil
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"io"
+	"testing"
+	"time"
+)
+
+func TestTimeWindowContains(t *testing.T) {
+	at := func(hour, min int) time.Time { return time.Date(2024, 1, 1, hour, min, 0, 0, time.UTC) }
+	tests := []struct {
+		window string
+		t      time.Time
+		want   bool
+	}{
+		{"09:00-17:00", at(8, 59), false},
+		{"09:00-17:00", at(9, 0), true},
+		{"09:00-17:00", at(16, 59), true},
+		{"09:00-17:00", at(17, 0), false},
+		{"22:00-06:00", at(21, 59), false},
+		{"22:00-06:00", at(22, 0), true},
+		{"22:00-06:00", at(0, 0), true},
+		{"22:00-06:00", at(5, 59), true},
+		{"22:00-06:00", at(6, 0), false},
+	}
+	for _, tt := range tests {
+		w, err := parseTimeWindow(tt.window)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := w.Contains(tt.t); got != tt.want {
+			t.Errorf("%s contains %s = %v, want %v", tt.window, tt.t.Format("15:04"), got, tt.want)
+		}
+	}
+
+	for _, bad := range []string{"09:00", "9-17", "09:00-24:00", "09:00-09:00"} {
+		if _, err := parseTimeWindow(bad); err == nil {
+			t.Errorf("parseTimeWindow(%q) succeeded, want an error", bad)
+		}
+	}
+}
+
+func TestProxyWindowPicksDialPath(t *testing.T) {
+	fc := useFakeClock(t) // 12:00
+	hello := helloFor(t, "example.com")
+	backend := startAnswerBackend(t, len(hello), "ok")
+	// Nothing listens on the proxy, so only direct dials reach the backend
+	addr := serveTest(t, newTestServer(t, "example.com="+backend+"@"+closedAddr(t)+",proxywindow=09:00-17:00"))
+
+	read := func() string {
+		conn := dialHello(t, addr, hello)
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		b, _ := io.ReadAll(conn)
+		return string(b)
+	}
+	if got := read(); got != "" {
+		t.Errorf("inside the proxy window the backend answered %q, want a failed proxy dial", got)
+	}
+	fc.Advance(5 * time.Hour)
+	if got := read(); got != "ok" {
+		t.Errorf("outside the proxy window the backend answered %q, want a direct dial", got)
+	}
+	waitIdle(t) // Before the fake clock is removed
+}
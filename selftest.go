@@ -0,0 +1,127 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// selfTestTimeout bounds each dial and TLS handshake of `proxys test`
+const selfTestTimeout = 5 * time.Second
+
+// selfTestReport collects the rows of the `proxys test` table
+type selfTestReport struct {
+	tw            *tabwriter.Writer
+	checks, fails int
+}
+
+// pass, fail and skip add a row for one check of a route
+func (r *selfTestReport) pass(route, check, addr string, took time.Duration) {
+	r.checks++
+	fmt.Fprintf(r.tw, "%s\t%s\t%s\tok (%s)\n", route, check, addr, took.Round(time.Millisecond))
+}
+
+func (r *selfTestReport) fail(route, check, addr string, err error) {
+	r.checks++
+	r.fails++
+	fmt.Fprintf(r.tw, "%s\t%s\t%s\tFAIL: %v\n", route, check, addr, err)
+}
+
+func (r *selfTestReport) skip(route, check, addr, reason string) {
+	fmt.Fprintf(r.tw, "%s\t%s\t%s\tskipped (%s)\n", route, check, addr, reason)
+}
+
+// runSelfTest dials every proxy and backend of rm the way connections would,
+// completes a TLS handshake with backends of routes that have a fixed SNI,
+// and writes a pass/fail table to w. It reports whether every check passed.
+func runSelfTest(w io.Writer, rm *RouteMap, resolver *net.Resolver) bool {
+	r := &selfTestReport{tw: tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)}
+	fmt.Fprintln(r.tw, "ROUTE\tCHECK\tADDRESS\tRESULT")
+	for _, cfg := range rm.Routes() {
+		selfTestRoute(r, cfg, resolver)
+	}
+	r.tw.Flush()
+	fmt.Fprintf(w, "%d checks, %d failed\n", r.checks, r.fails)
+	return r.fails == 0
+}
+
+// selfTestRoute checks the proxies and backends of one route
+func selfTestRoute(r *selfTestReport, cfg *RouteConfig, resolver *net.Resolver) {
+	route := cfg.Host
+	if cfg.Reject {
+		r.skip(route, "route", "-", "blocked")
+		return
+	}
+
+	d := &net.Dialer{Timeout: selfTestTimeout, Resolver: resolver}
+	for _, proxy := range cfg.proxies() {
+		start := time.Now()
+		conn, err := d.Dial("tcp", proxy)
+		if err != nil {
+			r.fail(route, "proxy", proxy, err)
+			continue
+		}
+		conn.Close()
+		r.pass(route, "proxy", proxy, time.Since(start))
+	}
+
+	var backends []string
+	switch {
+	case cfg.Upstream != "":
+		backends = upstreams[cfg.Upstream].backends
+	case cfg.Passthrough && transparent:
+		r.skip(route, "dial", "-", "original destination")
+		return
+	case cfg.Passthrough && !cfg.exactHost():
+		r.skip(route, "dial", "<sni>:"+cfg.passthroughPort(), "depends on the SNI")
+		return
+	case cfg.Passthrough:
+		backends = []string{net.JoinHostPort(cfg.Host, cfg.passthroughPort())}
+	default:
+		backends = append([]string{cfg.Target}, cfg.Fallbacks...)
+	}
+
+	// Only a route for a single hostname knows the SNI clients will send
+	sni := ""
+	if cfg.exactHost() {
+		sni = cfg.Host
+	}
+
+	dialer, err := createDialer(cfg.ProxyAddr, cfg.baseDialer(resolver), selfTestTimeout)
+	if err != nil {
+		r.fail(route, "dial", cfg.ProxyAddr, err)
+		return
+	}
+	for _, backend := range backends {
+		if cfg.Pattern != nil && strings.Contains(backend, "$") {
+			r.skip(route, "dial", backend, "depends on the SNI")
+			continue
+		}
+		start := time.Now()
+		conn, err := dialer(backendNetwork, backend)
+		if err != nil {
+			r.fail(route, "dial", backend, err)
+			continue
+		}
+		r.pass(route, "dial", backend, time.Since(start))
+
+		if sni == "" {
+			r.skip(route, "tls", backend, "no fixed SNI")
+			conn.Close()
+			continue
+		}
+		start = time.Now()
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: sni})
+		tlsConn.SetDeadline(start.Add(selfTestTimeout))
+		if err := tlsConn.Handshake(); err != nil {
+			r.fail(route, "tls", backend, err)
+		} else {
+			r.pass(route, "tls", backend, time.Since(start))
+		}
+		tlsConn.Close()
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestSelfTestReportsReachability(t *testing.T) {
+	up := startBackend(t, func(c net.Conn) { c.Close() })
+	down := closedAddr(t)
+
+	rm, err := parseRoutes([]string{".up.example.com=" + up, ".down.example.com=" + down, "blocked.example.com=reject"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	if runSelfTest(&out, rm, nil) {
+		t.Errorf("runSelfTest passed with an unreachable backend:\n%s", out.String())
+	}
+
+	// rows returns the table rows of the route for host
+	rows := func(host string) string {
+		var got []string
+		for _, line := range strings.Split(out.String(), "\n") {
+			if strings.HasPrefix(line, host+" ") {
+				got = append(got, line)
+			}
+		}
+		return strings.Join(got, "\n")
+	}
+	if r := rows(".up.example.com"); !strings.Contains(r, up) || !strings.Contains(r, " ok (") {
+		t.Errorf("rows for the reachable backend:\n%s\nwant a passing dial", r)
+	}
+	if r := rows(".down.example.com"); !strings.Contains(r, down) || !strings.Contains(r, " FAIL: ") {
+		t.Errorf("rows for the unreachable backend:\n%s\nwant a failing dial", r)
+	}
+	if r := rows("blocked.example.com"); !strings.Contains(r, "skipped (blocked)") {
+		t.Errorf("rows for the reject route:\n%s\nwant it skipped", r)
+	}
+	if !strings.Contains(out.String(), "2 checks, 1 failed") {
+		t.Errorf("summary missing from:\n%s", out.String())
+	}
+
+	// Without the unreachable route every check passes
+	rm, err = parseRoutes([]string{".up.example.com=" + up})
+	if err != nil {
+		t.Fatal(err)
+	}
+	out.Reset()
+	if !runSelfTest(&out, rm, nil) {
+		t.Errorf("runSelfTest failed with only a reachable backend:\n%s", out.String())
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"io"
+	"maps"
+	"slices"
+	"time"
+)
+
+// summaryLogRoutes is how many of the busiest routes the shutdown summary
+// lists in the log; -summary-file lists them all
+const summaryLogRoutes = 10
+
+// writeSummary writes the totals for the process lifetime, taken from the
+// metrics: connections, bytes, rejections by reason and connections per route.
+// At most maxRoutes routes are listed, busiest first (0 lists all).
+func writeSummary(w io.Writer, uptime time.Duration, maxRoutes int) {
+	routed := routeALPN.sumBy("route")
+	rejected := connsRejected.sumBy("class", "reason")
+	bytes := bytesTransferred.sumBy("direction")
+
+	var routedTotal, rejectedTotal int64
+	for _, n := range routed {
+		routedTotal += n
+	}
+	for _, n := range rejected {
+		rejectedTotal += n
+	}
+	fmt.Fprintf(w, "Accepted %d connections in %s: %d routed, %d rejected\n",
+		connsAccepted.sumBy()[""], uptime.Round(time.Second), routedTotal, rejectedTotal)
+	fmt.Fprintf(w, "Transferred %d bytes upstream, %d bytes downstream\n", bytes["upstream"], bytes["downstream"])
+	for _, reason := range busiest(rejected) {
+		fmt.Fprintf(w, "Rejected %s: %d\n", reason, rejected[reason])
+	}
+	routes := busiest(routed)
+	for i, route := range routes {
+		if maxRoutes > 0 && i == maxRoutes {
+			fmt.Fprintf(w, "... and %d more routes\n", len(routes)-i)
+			break
+		}
+		fmt.Fprintf(w, "Route %s: %d connections\n", route, routed[route])
+	}
+}
+
+// busiest returns the keys of counts, highest count first
+func busiest(counts map[string]int64) []string {
+	return slices.SortedFunc(maps.Keys(counts), func(a, b string) int {
+		return cmp.Or(cmp.Compare(counts[b], counts[a]), cmp.Compare(a, b))
+	})
+}
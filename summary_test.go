@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// summaryTotals holds the totals from the first two lines of a summary
+type summaryTotals struct {
+	accepted, routed, rejected int64
+	upstream, downstream       int64
+}
+
+func readSummary(t *testing.T, maxRoutes int) (summaryTotals, string) {
+	t.Helper()
+	var b strings.Builder
+	writeSummary(&b, time.Minute, maxRoutes)
+	var s summaryTotals
+	if _, err := fmt.Sscanf(b.String(), "Accepted %d connections in 1m0s: %d routed, %d rejected\nTransferred %d bytes upstream, %d bytes downstream\n",
+		&s.accepted, &s.routed, &s.rejected, &s.upstream, &s.downstream); err != nil {
+		t.Fatalf("summary does not start with the totals: %v\n%s", err, b.String())
+	}
+	return s, b.String()
+}
+
+// routeConns returns the connections a summary lists for route
+func routeConns(summary, route string) int64 {
+	var n int64
+	for _, line := range strings.Split(summary, "\n") {
+		if rest, ok := strings.CutPrefix(line, "Route "+route+": "); ok {
+			fmt.Sscanf(rest, "%d connections", &n)
+		}
+	}
+	return n
+}
+
+func TestShutdownSummaryTotals(t *testing.T) {
+	waitIdle(t)
+	before, beforeOut := readSummary(t, 0)
+
+	hello := helloFor(t, "a.summary.test")
+	backend := startAnswerBackend(t, len(hello), "ok")
+	srv := newTestServer(t, "a.summary.test="+backend, "b.summary.test="+backend)
+	addr := serveTest(t, srv)
+	for _, sni := range []string{"a.summary.test", "a.summary.test", "b.summary.test", "c.summary.test"} {
+		conn := dialHello(t, addr, helloFor(t, sni))
+		if !waitClosed(conn, 2*time.Second) {
+			t.Fatalf("%s: connection was not closed", sni)
+		}
+	}
+	srv.waitForDrain(time.Second)
+	waitIdle(t)
+
+	after, out := readSummary(t, 0)
+	got := summaryTotals{
+		accepted:   after.accepted - before.accepted,
+		routed:     after.routed - before.routed,
+		rejected:   after.rejected - before.rejected,
+		upstream:   after.upstream - before.upstream,
+		downstream: after.downstream - before.downstream,
+	}
+	want := summaryTotals{accepted: 4, routed: 3, rejected: 1, upstream: 3 * int64(len(hello)), downstream: 3 * int64(len("ok"))}
+	if got != want {
+		t.Errorf("summary totals rose by %+v, want %+v", got, want)
+	}
+	for route, n := range map[string]int64{"a.summary.test": 2, "b.summary.test": 1} {
+		if got := routeConns(out, route) - routeConns(beforeOut, route); got != n {
+			t.Errorf("summary counts %d more connections for %s, want %d:\n%s", got, route, n, out)
+		}
+	}
+	if !strings.Contains(out, "Rejected policy/unconfigured: ") {
+		t.Errorf("summary lacks the unconfigured rejections:\n%s", out)
+	}
+
+	// The log lists only the busiest routes
+	if _, out := readSummary(t, 1); strings.Count(out, "Route ") != 1 || !strings.Contains(out, " more routes\n") {
+		t.Errorf("summary limited to one route:\n%s", out)
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+)
+
+// listenFDsStart is the first file descriptor passed by systemd
+const listenFDsStart = 3
+
+// systemdListener returns the listening socket passed by systemd socket
+// activation, or nil if the process was not socket-activated
+func systemdListener() (net.Listener, error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n < 1 {
+		return nil, nil
+	}
+
+	// Keep the variables from leaking into child processes
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	if n > 1 {
+		log.Printf("Warning: systemd passed %d sockets, using only the first", n)
+	}
+
+	f := os.NewFile(listenFDsStart, "systemd-listener")
+	defer f.Close()
+	l, err := net.FileListener(f)
+	if err != nil {
+		return nil, fmt.Errorf("failed to use socket-activated listener: %v", err)
+	}
+	return l, nil
+}
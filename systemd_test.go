@@ -0,0 +1,81 @@
+//go:build unix
+
+package main
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestSystemdListenerNotActivated(t *testing.T) {
+	t.Setenv("LISTEN_FDS", "1")
+	t.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()+1))
+	if l, err := systemdListener(); l != nil || err != nil {
+		t.Errorf("systemdListener for another process = %v, %v; want nil, nil", l, err)
+	}
+}
+
+// TestSystemdListener passes a listening socket to a child process as fd 3,
+// as systemd does, and has the child serve on it
+func TestSystemdListener(t *testing.T) {
+	if backend := os.Getenv("PROXYS_TEST_SYSTEMD_BACKEND"); backend != "" {
+		// systemd sets LISTEN_PID after forking, which exec cannot
+		os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+		l, err := systemdListener()
+		if err != nil || l == nil {
+			t.Fatalf("systemdListener = %v, %v", l, err)
+		}
+		if os.Getenv("LISTEN_FDS") != "" {
+			t.Error("LISTEN_FDS is still set for child processes")
+		}
+		newTestServer(t, "example.com="+backend).serve(l)
+		return
+	}
+
+	hello := helloFor(t, "example.com")
+	got := make(chan []byte, 1)
+	backend := startBackend(t, func(c net.Conn) {
+		defer c.Close()
+		buf := make([]byte, len(hello))
+		n, _ := io.ReadFull(c, buf)
+		got <- buf[:n]
+	})
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	f, err := l.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestSystemdListener$")
+	cmd.Env = append(os.Environ(), "LISTEN_FDS=1", "PROXYS_TEST_SYSTEMD_BACKEND="+backend)
+	cmd.ExtraFiles = []*os.File{f}
+	var out syncBuffer
+	cmd.Stdout, cmd.Stderr = &out, &out
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer cmd.Wait()
+	defer cmd.Process.Kill()
+
+	// Only the child accepts on the shared socket
+	dialHello(t, l.Addr().String(), hello)
+	select {
+	case b := <-got:
+		if !bytes.Equal(b, hello) {
+			t.Errorf("backend received %d bytes differing from the %d byte ClientHello", len(b), len(hello))
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("the child did not proxy a connection to the inherited socket:\n%s", out.String())
+	}
+}
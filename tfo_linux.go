@@ -0,0 +1,35 @@
+//go:build linux
+
+package main
+
+import (
+	"sync"
+	"syscall"
+)
+
+// tfoSupported reports whether -backend-tfo can be used on this platform
+const tfoSupported = true
+
+// tcpFastOpenConnect is TCP_FASTOPEN_CONNECT (Linux 4.11+): connect returns
+// at once and the first write is sent in the SYN
+const tcpFastOpenConnect = 30
+
+var tfoWarnOnce sync.Once
+
+// tfoControl enables TCP Fast Open on a dialing socket. Kernels without it
+// dial normally; the failure is logged once at debug level.
+func tfoControl(network, address string, c syscall.RawConn) error {
+	var sockErr error
+	err := c.Control(func(fd uintptr) {
+		sockErr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_TCP, tcpFastOpenConnect, 1)
+	})
+	if err == nil {
+		err = sockErr
+	}
+	if err != nil {
+		tfoWarnOnce.Do(func() {
+			debugf("TCP Fast Open unavailable for backend dials, dialing normally: %v", err)
+		})
+	}
+	return nil
+}
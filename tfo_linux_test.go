@@ -0,0 +1,52 @@
+//go:build linux
+
+package main
+
+import (
+	"context"
+	"net"
+	"syscall"
+	"testing"
+)
+
+func TestBackendTFOSetsSocketOption(t *testing.T) {
+	defer func(v bool) { backendTFO = v }(backendTFO)
+	backend := startBackend(t, func(c net.Conn) { c.Close() })
+
+	// fastOpen dials the backend through a route's dialer and reports the
+	// TCP_FASTOPEN_CONNECT value of the socket
+	fastOpen := func() int {
+		t.Helper()
+		cfg, err := parseRoute("example.com=" + backend)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn, err := cfg.baseDialer(nil).DialContext(context.Background(), "tcp", backend)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		raw, err := conn.(*net.TCPConn).SyscallConn()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var v int
+		var sockErr error
+		raw.Control(func(fd uintptr) {
+			v, sockErr = syscall.GetsockoptInt(int(fd), syscall.IPPROTO_TCP, tcpFastOpenConnect)
+		})
+		if sockErr != nil {
+			t.Skipf("kernel does not support TCP_FASTOPEN_CONNECT: %v", sockErr)
+		}
+		return v
+	}
+
+	backendTFO = true
+	if v := fastOpen(); v != 1 {
+		t.Errorf("with -backend-tfo TCP_FASTOPEN_CONNECT = %d, want 1", v)
+	}
+	backendTFO = false
+	if v := fastOpen(); v != 0 {
+		t.Errorf("without -backend-tfo TCP_FASTOPEN_CONNECT = %d, want 0", v)
+	}
+}
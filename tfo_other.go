@@ -0,0 +1,12 @@
+//go:build !linux
+
+package main
+
+import "syscall"
+
+// tfoSupported reports whether -backend-tfo can be used on this platform
+const tfoSupported = false
+
+func tfoControl(network, address string, c syscall.RawConn) error {
+	return nil
+}
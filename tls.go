@@ -16,12 +16,87 @@ package main
 
 import "golang.org/x/crypto/cryptobyte"
 
+// TLS record content types
+const (
+	recordTypeChangeCipherSpec = 20
+	recordTypeAlert            = 21
+	recordTypeHandshake        = 22
+)
+
+// plausibleRecordHeader reports whether hdr, the first 5 bytes of a
+// connection, can start a TLS handshake: a handshake or change_cipher_spec
+// record with a legacy record version of 3.x
+func plausibleRecordHeader(hdr []byte) bool {
+	if hdr[0] != recordTypeHandshake && hdr[0] != recordTypeChangeCipherSpec {
+		return false
+	}
+	return hdr[1] == 3 && hdr[2] <= 4
+}
+
+// minRecordLength returns the smallest valid body length for a record of
+// the given type: a change_cipher_spec message is 1 byte and a handshake
+// message header alone is 4
+func minRecordLength(recordType byte) int {
+	if recordType == recordTypeChangeCipherSpec {
+		return 1
+	}
+	return 4
+}
+
+// ClientHello holds the fields of a parsed ClientHello message
 type ClientHello struct {
-	SNI string
+	SNI               string
+	ALPN              []string // Offered application protocols, in client preference order
+	HasALPN           bool     // Whether the ALPN extension was sent at all
+	RecordVersion     uint16   // legacy_record_version from the record header, often TLS 1.0
+	Version           uint16   // legacy_version from the ClientHello body
+	SupportedVersions []uint16 // Versions from the supported_versions extension
+	Extensions        []uint16 // Extension types in the order they were sent
+	ExtensionData     [][]byte // Body of each extension, parallel to Extensions; aliases the parsed record
+}
+
+// Extension returns the body of the first extension of type typ
+func (c *ClientHello) Extension(typ uint16) ([]byte, bool) {
+	for i, t := range c.Extensions {
+		if t == typ {
+			return c.ExtensionData[i], true
+		}
+	}
+	return nil, false
+}
+
+// MaxVersion returns the highest TLS version the client offers, taking
+// supported_versions into account and ignoring GREASE values
+func (c *ClientHello) MaxVersion() uint16 {
+	if len(c.SupportedVersions) == 0 {
+		return c.Version
+	}
+	var max uint16
+	for _, v := range c.SupportedVersions {
+		if v&0x0f0f != 0x0a0a && v > max {
+			max = v
+		}
+	}
+	return max
 }
 
-func ParseClientHello(record []byte) (c *ClientHello, ok bool) {
-	c = &ClientHello{}
+// handshakeTypeClientHello is the msg_type of a ClientHello message
+const handshakeTypeClientHello = 1
+
+// ParseError reports which part of a ClientHello record is malformed
+type ParseError struct {
+	Field string // Structure that failed to parse, e.g. "extensions"
+}
+
+func (e *ParseError) Error() string {
+	return "malformed ClientHello: invalid " + e.Field
+}
+
+// ParseClientHello parses a TLS record holding a complete ClientHello. Every
+// read is bounds-checked, so any input yields either a result or a
+// *ParseError, never a panic.
+func ParseClientHello(record []byte) (*ClientHello, error) {
+	c := &ClientHello{}
 
 	/* struct {
 		ContentType type;
@@ -31,12 +106,12 @@ func ParseClientHello(record []byte) (c *ClientHello, ok bool) {
 	} TLSPlaintext; */
 
 	in := cryptobyte.String(record)
-	if !in.Skip(1) || !in.Skip(2) {
-		return nil, false
+	if !in.Skip(1) || !in.ReadUint16(&c.RecordVersion) {
+		return nil, &ParseError{"record header"}
 	}
 	var msg cryptobyte.String
 	if !in.ReadUint16LengthPrefixed(&msg) || !in.Empty() {
-		return nil, false
+		return nil, &ParseError{"record length"}
 	}
 
 	/* struct {
@@ -48,12 +123,12 @@ func ParseClientHello(record []byte) (c *ClientHello, ok bool) {
 	} Handshake; */
 
 	var msgType uint8
-	if !msg.ReadUint8(&msgType) {
-		return nil, false
+	if !msg.ReadUint8(&msgType) || msgType != handshakeTypeClientHello {
+		return nil, &ParseError{"handshake type"}
 	}
 	var ch cryptobyte.String
 	if !msg.ReadUint24LengthPrefixed(&ch) || !msg.Empty() {
-		return nil, false
+		return nil, &ParseError{"handshake length"}
 	}
 
 	/* struct {
@@ -65,18 +140,22 @@ func ParseClientHello(record []byte) (c *ClientHello, ok bool) {
 		Extension extensions<8..2^16-1>;
 	} ClientHello; */
 
-	if !ch.Skip(2) || !ch.Skip(32) {
-		return nil, false
+	if !ch.ReadUint16(&c.Version) || !ch.Skip(32) {
+		return nil, &ParseError{"version or random"}
 	}
 	var skip cryptobyte.String
-	if !ch.ReadUint8LengthPrefixed(&skip) ||
-		!ch.ReadUint16LengthPrefixed(&skip) ||
-		!ch.ReadUint8LengthPrefixed(&skip) {
-		return nil, false
+	if !ch.ReadUint8LengthPrefixed(&skip) {
+		return nil, &ParseError{"session ID"}
+	}
+	if !ch.ReadUint16LengthPrefixed(&skip) {
+		return nil, &ParseError{"cipher suites"}
+	}
+	if !ch.ReadUint8LengthPrefixed(&skip) {
+		return nil, &ParseError{"compression methods"}
 	}
 	var exts cryptobyte.String
 	if !ch.ReadUint16LengthPrefixed(&exts) || !ch.Empty() {
-		return nil, false
+		return nil, &ParseError{"extensions"}
 	}
 
 	/* struct {
@@ -86,48 +165,105 @@ func ParseClientHello(record []byte) (c *ClientHello, ok bool) {
 
 	for !exts.Empty() {
 		var extensionType uint16
-		if !exts.ReadUint16(&extensionType) {
-			return nil, false
-		}
 		var ex cryptobyte.String
-		if !exts.ReadUint16LengthPrefixed(&ex) {
-			return nil, false
+		if !exts.ReadUint16(&extensionType) || !exts.ReadUint16LengthPrefixed(&ex) {
+			return nil, &ParseError{"extensions"}
 		}
 
-		if extensionType != 0 /* server_name */ {
-			continue
+		c.Extensions = append(c.Extensions, extensionType)
+		c.ExtensionData = append(c.ExtensionData, ex)
+
+		switch extensionType {
+		case 0: /* server_name */
+			if !parseServerName(ex, c) {
+				return nil, &ParseError{"server_name extension"}
+			}
+		case 16: /* application_layer_protocol_negotiation */
+			if !parseALPN(ex, c) {
+				return nil, &ParseError{"application_layer_protocol_negotiation extension"}
+			}
+		case 43: /* supported_versions */
+			if !parseSupportedVersions(ex, c) {
+				return nil, &ParseError{"supported_versions extension"}
+			}
 		}
+	}
+
+	return c, nil
+}
+
+func parseServerName(ex cryptobyte.String, c *ClientHello) bool {
+	/* struct {
+		ServerName server_name_list<1..2^16-1>
+	} ServerNameList; */
 
+	var snl cryptobyte.String
+	if !ex.ReadUint16LengthPrefixed(&snl) || !ex.Empty() {
+		return false
+	}
+
+	for !snl.Empty() {
 		/* struct {
-			ServerName server_name_list<1..2^16-1>
-		} ServerNameList; */
+			NameType name_type;
+			opaque HostName<1..2^16-1>;
+		} ServerName; */
+
+		var nameType uint8
+		if !snl.ReadUint8(&nameType) {
+			return false
+		}
+		var hostName cryptobyte.String
+		if !snl.ReadUint16LengthPrefixed(&hostName) {
+			return false
+		}
 
-		var snl cryptobyte.String
-		if !ex.ReadUint16LengthPrefixed(&snl) || !ex.Empty() {
-			return nil, false
+		if nameType != 0 /* host_name */ {
+			return false
 		}
+		c.SNI = string(hostName)
+	}
+	return true
+}
 
-		for !snl.Empty() {
-			/* struct {
-				NameType name_type;
-				opaque HostName<1..2^16-1>;
-			} ServerName; */
+func parseALPN(ex cryptobyte.String, c *ClientHello) bool {
+	/* opaque ProtocolName<1..2^8-1>;
 
-			var nameType uint8
-			if !snl.ReadUint8(&nameType) {
-				return nil, false
-			}
-			var hostName cryptobyte.String
-			if !snl.ReadUint16LengthPrefixed(&hostName) {
-				return nil, false
-			}
+	struct {
+		ProtocolName protocol_name_list<2..2^16-1>
+	} ProtocolNameList; */
 
-			if nameType != 0 /* host_name */ {
-				return nil, false
-			}
-			c.SNI = string(hostName)
+	var pnl cryptobyte.String
+	if !ex.ReadUint16LengthPrefixed(&pnl) || !ex.Empty() {
+		return false
+	}
+	c.HasALPN = true
+
+	for !pnl.Empty() {
+		var proto cryptobyte.String
+		if !pnl.ReadUint8LengthPrefixed(&proto) || proto.Empty() {
+			return false
 		}
+		c.ALPN = append(c.ALPN, string(proto))
 	}
+	return true
+}
 
-	return c, true
+func parseSupportedVersions(ex cryptobyte.String, c *ClientHello) bool {
+	/* struct {
+		ProtocolVersion versions<2..254>;
+	} SupportedVersions; */
+
+	var versions cryptobyte.String
+	if !ex.ReadUint8LengthPrefixed(&versions) || !ex.Empty() {
+		return false
+	}
+
+	for !versions.Empty() {
+		var v uint16
+		if !versions.ReadUint16(&v) {
+			return false
+		}
+		c.SupportedVersions = append(c.SupportedVersions, v)
+	}
+	return true
 }
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"slices"
+	"testing"
+
+	"golang.org/x/crypto/cryptobyte"
+)
+
+// testExt is an extension for buildHello
+type testExt struct {
+	typ  uint16
+	body []byte
+}
+
+// buildHello returns a ClientHello record with fixed version, random, session
+// ID, cipher suites and compression methods, carrying exts
+func buildHello(exts ...testExt) []byte {
+	var b cryptobyte.Builder
+	b.AddUint8(22)
+	b.AddUint16(tls.VersionTLS10)
+	b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddUint8(handshakeTypeClientHello)
+		b.AddUint24LengthPrefixed(func(b *cryptobyte.Builder) {
+			b.AddUint16(tls.VersionTLS12)
+			b.AddBytes(make([]byte, 32))
+			b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {})
+			b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) { b.AddUint16(tls.TLS_AES_128_GCM_SHA256) })
+			b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) { b.AddUint8(0) })
+			b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+				for _, e := range exts {
+					b.AddUint16(e.typ)
+					b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) { b.AddBytes(e.body) })
+				}
+			})
+		})
+	})
+	return b.BytesOrPanic()
+}
+
+// sniExt returns a server_name extension body naming host with nameType
+func sniExt(nameType uint8, host string) []byte {
+	var b cryptobyte.Builder
+	b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddUint8(nameType)
+		b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) { b.AddBytes([]byte(host)) })
+	})
+	return b.BytesOrPanic()
+}
+
+// fixLengths rewrites the record and handshake lengths of a truncated record
+// to match what is left, so parsing gets past them to the cut
+func fixLengths(record []byte) []byte {
+	record = slices.Clone(record)
+	if len(record) >= 5 {
+		n := len(record) - 5
+		record[3], record[4] = byte(n>>8), byte(n)
+	}
+	if len(record) >= 9 {
+		n := len(record) - 9
+		record[6], record[7], record[8] = byte(n>>16), byte(n>>8), byte(n)
+	}
+	return record
+}
+
+func TestParseClientHello(t *testing.T) {
+	hello := helloFor(t, "example.com", "h2", "http/1.1")
+	ch, err := ParseClientHello(hello)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ch.SNI != "example.com" {
+		t.Errorf("SNI = %q, want example.com", ch.SNI)
+	}
+	if !ch.HasALPN || !slices.Equal(ch.ALPN, []string{"h2", "http/1.1"}) {
+		t.Errorf("ALPN = %q (sent: %v), want [h2 http/1.1]", ch.ALPN, ch.HasALPN)
+	}
+	if ch.Version != tls.VersionTLS12 || ch.MaxVersion() != tls.VersionTLS13 {
+		t.Errorf("version = %#x, max version = %#x; want TLS 1.2 and TLS 1.3", ch.Version, ch.MaxVersion())
+	}
+	if len(ch.Extensions) != len(ch.ExtensionData) {
+		t.Fatalf("%d extension types but %d bodies", len(ch.Extensions), len(ch.ExtensionData))
+	}
+	for _, typ := range []uint16{0, 16, 43} {
+		if _, ok := ch.Extension(typ); !ok {
+			t.Errorf("extension %d not recorded in %v", typ, ch.Extensions)
+		}
+	}
+
+	ch, err = ParseClientHello(clientHello(t, &tls.Config{ServerName: "old.example.com", MinVersion: tls.VersionTLS10, MaxVersion: tls.VersionTLS11}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ch.HasALPN || ch.MaxVersion() != tls.VersionTLS11 {
+		t.Errorf("TLS 1.1 client: ALPN sent %v, max version %#x; want no ALPN and TLS 1.1", ch.HasALPN, ch.MaxVersion())
+	}
+}
+
+func TestParseClientHelloRecordVersion(t *testing.T) {
+	ch, err := ParseClientHello(clientHello(t, &tls.Config{ServerName: "example.com", MinVersion: tls.VersionTLS13}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ch.RecordVersion != tls.VersionTLS10 && ch.RecordVersion != tls.VersionTLS12 {
+		t.Errorf("record version = %s, want TLS 1.0 or TLS 1.2", tls.VersionName(ch.RecordVersion))
+	}
+	if ch.Version != tls.VersionTLS12 {
+		t.Errorf("legacy version = %s, want TLS 1.2", tls.VersionName(ch.Version))
+	}
+	if !slices.Equal(ch.SupportedVersions, []uint16{tls.VersionTLS13}) || ch.MaxVersion() != tls.VersionTLS13 {
+		t.Errorf("supported versions = %s, effective version = %s; want TLS 1.3", formatVersions(ch.SupportedVersions), tls.VersionName(ch.MaxVersion()))
+	}
+}
+
+func TestParseClientHelloTruncated(t *testing.T) {
+	hello := helloFor(t, "example.com", "h2")
+	for cut := range len(hello) {
+		// Cut as received, with lengths that overrun what is left, and with
+		// the lengths fixed up, to reach the structures further in
+		for _, record := range [][]byte{hello[:cut], fixLengths(hello[:cut])} {
+			var perr *ParseError
+			if _, err := ParseClientHello(record); !errors.As(err, &perr) {
+				t.Fatalf("ParseClientHello cut at %d of %d bytes: got %v, want a *ParseError", cut, len(hello), err)
+			}
+		}
+	}
+}
+
+func TestParseClientHelloMalformed(t *testing.T) {
+	valid := buildHello(testExt{0, sniExt(0, "example.com")})
+	tests := []struct {
+		name   string
+		record []byte
+		field  string
+	}{
+		{"empty", nil, "record header"},
+		{"trailing byte", append(slices.Clone(valid), 0), "record length"},
+		{"server hello", func() []byte { r := slices.Clone(valid); r[5] = 2; return r }(), "handshake type"},
+		{"handshake length past the record", func() []byte { r := slices.Clone(valid); r[8]++; return r }(), "handshake length"},
+		{"no random", fixLengths(valid[:20]), "version or random"},
+		{"extension body past the list", func() []byte {
+			r := slices.Clone(valid)
+			r[len(r)-len(sniExt(0, "example.com"))-1]++
+			return r
+		}(), "extensions"},
+		{"non-host_name server name", buildHello(testExt{0, sniExt(1, "example.com")}), "server_name extension"},
+		{"server name list past the extension", buildHello(testExt{0, sniExt(0, "example.com")[:5]}), "server_name extension"},
+		{"ALPN protocol past the list", buildHello(testExt{16, []byte{0, 2, 2, 'h'}}), "application_layer_protocol_negotiation extension"},
+		{"zero-length ALPN protocol", buildHello(testExt{16, []byte{0, 1, 0}}), "application_layer_protocol_negotiation extension"},
+		{"odd supported_versions", buildHello(testExt{43, []byte{3, 3, 4, 3}}), "supported_versions extension"},
+	}
+	for _, tt := range tests {
+		_, err := ParseClientHello(tt.record)
+		var perr *ParseError
+		if !errors.As(err, &perr) || perr.Field != tt.field {
+			t.Errorf("%s: got %v, want invalid %s", tt.name, err, tt.field)
+		}
+	}
+
+	if _, err := ParseClientHello(valid); err != nil {
+		t.Errorf("valid built ClientHello: %v", err)
+	}
+}
+
+func FuzzParseClientHello(f *testing.F) {
+	hello := helloFor(f, "example.com", "h2", "http/1.1")
+	f.Add(hello)
+	f.Add(hello[:len(hello)/2])
+	f.Add(fixLengths(hello[:len(hello)/2]))
+	f.Add(helloFor(f, "example.com"))
+	f.Add(clientHello(f, &tls.Config{ServerName: "example.com", MinVersion: tls.VersionTLS10, MaxVersion: tls.VersionTLS11}))
+	f.Add(buildHello())
+	f.Add(buildHello(testExt{0, sniExt(0, "")}, testExt{16, []byte{0, 0}}, testExt{43, []byte{0}}))
+
+	f.Fuzz(func(t *testing.T, record []byte) {
+		ch, err := ParseClientHello(record)
+		if err != nil {
+			var perr *ParseError
+			if !errors.As(err, &perr) {
+				t.Fatalf("error %v is not a *ParseError", err)
+			}
+			return
+		}
+		if len(ch.Extensions) != len(ch.ExtensionData) {
+			t.Fatalf("%d extension types but %d bodies", len(ch.Extensions), len(ch.ExtensionData))
+		}
+	})
+}
+
+func TestParseClientHelloCustomExtension(t *testing.T) {
+	ch, err := ParseClientHello(buildHello(
+		testExt{0, sniExt(0, "front.example.com")},
+		testExt{0xfe00, []byte("real.example.com")},
+		testExt{0xfe01, nil},
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body, ok := ch.Extension(0xfe00); !ok || string(body) != "real.example.com" {
+		t.Errorf("Extension(0xfe00) = %q, %v; want real.example.com", body, ok)
+	}
+	if body, ok := ch.Extension(0xfe01); !ok || len(body) != 0 {
+		t.Errorf("Extension(0xfe01) = %q, %v; want an empty body", body, ok)
+	}
+	if _, ok := ch.Extension(0xfe02); ok {
+		t.Error("Extension(0xfe02) found an extension the ClientHello does not carry")
+	}
+}
+
+func TestParseClientHelloALPNPresence(t *testing.T) {
+	tests := []struct {
+		name    string
+		exts    []testExt
+		hasALPN bool
+		alpn    []string
+	}{
+		{"no extension", nil, false, nil},
+		{"empty list", []testExt{{16, []byte{0, 0}}}, true, nil},
+		{"h2", []testExt{{16, []byte{0, 3, 2, 'h', '2'}}}, true, []string{"h2"}},
+	}
+	for _, tt := range tests {
+		ch, err := ParseClientHello(buildHello(append([]testExt{{0, sniExt(0, "example.com")}}, tt.exts...)...))
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if ch.HasALPN != tt.hasALPN || !slices.Equal(ch.ALPN, tt.alpn) {
+			t.Errorf("%s: ALPN = %q (sent: %v), want %q (sent: %v)", tt.name, ch.ALPN, ch.HasALPN, tt.alpn, tt.hasALPN)
+		}
+	}
+}
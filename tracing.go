@@ -0,0 +1,46 @@
+package main
+
+import "time"
+
+// connTracer starts a tracing span per connection for -otel-trace-file
+type connTracer interface {
+	Start(id uint64, clientIP string) connSpan
+}
+
+// connSpan is the span of one connection. Attributes are set as handleConn
+// learns them, and the dial and copy phases are recorded as events.
+type connSpan interface {
+	SetString(key, value string)
+	SetInt(key string, value int64)
+	Event(name string, attrs ...spanAttr)
+	Fail(reason string)
+	End()
+}
+
+// spanAttr is a string attribute of a span event
+type spanAttr struct {
+	Key, Value string
+}
+
+// noSpan is the span of connections when tracing is off
+type noSpan struct{}
+
+func (noSpan) SetString(key, value string)          {}
+func (noSpan) SetInt(key string, value int64)       {}
+func (noSpan) Event(name string, attrs ...spanAttr) {}
+func (noSpan) Fail(reason string)                   {}
+func (noSpan) End()                                 {}
+
+// startSpan starts the span of connection id, or returns noSpan when tracing
+// is off
+func (s *server) startSpan(id uint64, clientIP string) connSpan {
+	if s.tracer == nil {
+		return noSpan{}
+	}
+	return s.tracer.Start(id, clientIP)
+}
+
+// durationAttr formats d for a span event attribute
+func durationAttr(key string, d time.Duration) spanAttr {
+	return spanAttr{key, d.Round(time.Microsecond).String()}
+}
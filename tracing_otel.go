@@ -0,0 +1,106 @@
+//go:build otel
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// otelSupported reports whether this build can write -otel-trace-file
+const otelSupported = true
+
+// otelTracer starts connection spans from an OpenTelemetry tracer
+type otelTracer struct {
+	tracer trace.Tracer
+}
+
+func newOtelTracer(tp trace.TracerProvider) *otelTracer {
+	return &otelTracer{tracer: tp.Tracer("yoncise.com/proxys")}
+}
+
+// openTracer writes a span per connection as JSON to the file at path, or
+// to stdout for "-". The returned function flushes the spans still batched
+// and closes the file.
+func openTracer(path string) (connTracer, func() error, error) {
+	var w io.Writer = os.Stdout
+	var f *os.File
+	if path != "-" {
+		var err error
+		if f, err = os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644); err != nil {
+			return nil, nil, fmt.Errorf("failed to open trace file '%s': %v", path, err)
+		}
+		w = f
+	}
+	exp, err := stdouttrace.New(stdouttrace.WithWriter(w))
+	if err != nil {
+		if f != nil {
+			f.Close()
+		}
+		return nil, nil, fmt.Errorf("failed to create trace exporter: %v", err)
+	}
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exp),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", "proxys"))),
+	)
+	shutdown := func() error {
+		err := tp.Shutdown(context.Background())
+		if f != nil {
+			if cerr := f.Close(); err == nil {
+				err = cerr
+			}
+		}
+		return err
+	}
+	return newOtelTracer(tp), shutdown, nil
+}
+
+// Start begins the span of a connection. TLS is relayed opaquely, so there
+// is no trace context to continue and each connection is a root span.
+func (t *otelTracer) Start(id uint64, clientIP string) connSpan {
+	_, span := t.tracer.Start(context.Background(), "proxys.connection",
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			attribute.Int64("proxys.connection_id", int64(id)),
+			attribute.String("client.address", clientIP),
+		))
+	return otelSpan{span}
+}
+
+// otelSpan adapts an OpenTelemetry span to connSpan
+type otelSpan struct {
+	span trace.Span
+}
+
+func (s otelSpan) SetString(key, value string) {
+	s.span.SetAttributes(attribute.String(key, value))
+}
+
+func (s otelSpan) SetInt(key string, value int64) {
+	s.span.SetAttributes(attribute.Int64(key, value))
+}
+
+func (s otelSpan) Event(name string, attrs ...spanAttr) {
+	kvs := make([]attribute.KeyValue, len(attrs))
+	for i, a := range attrs {
+		kvs[i] = attribute.String(a.Key, a.Value)
+	}
+	s.span.AddEvent(name, trace.WithAttributes(kvs...))
+}
+
+func (s otelSpan) Fail(reason string) {
+	s.span.SetStatus(codes.Error, reason)
+}
+
+func (s otelSpan) End() {
+	s.span.End()
+}
@@ -0,0 +1,119 @@
+//go:build otel
+
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// spanAttrs returns the attributes of a recorded span by key
+func spanAttrs(span sdktrace.ReadOnlySpan) map[string]attribute.Value {
+	attrs := make(map[string]attribute.Value)
+	for _, kv := range span.Attributes() {
+		attrs[string(kv.Key)] = kv.Value
+	}
+	return attrs
+}
+
+func TestConnectionSpan(t *testing.T) {
+	exp := tracetest.NewInMemoryExporter()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exp))
+	defer tp.Shutdown(t.Context())
+
+	hello := helloFor(t, "example.com")
+	backend := startAnswerBackend(t, len(hello), "answer")
+	srv := newTestServer(t, "example.com="+backend, "down.example.com="+closedAddr(t))
+	srv.tracer = newOtelTracer(tp)
+	addr := serveTest(t, srv)
+
+	conn := dialHello(t, addr, hello)
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if got, _ := io.ReadAll(conn); string(got) != "answer" {
+		t.Fatalf("client got %q, want the backend's answer", got)
+	}
+	if !waitFor(2*time.Second, func() bool { return len(exp.GetSpans()) == 1 }) {
+		t.Fatalf("got %d spans, want 1 once the connection closed", len(exp.GetSpans()))
+	}
+
+	span := exp.GetSpans().Snapshots()[0]
+	if span.Name() != "proxys.connection" {
+		t.Errorf("span name = %q, want proxys.connection", span.Name())
+	}
+	attrs := spanAttrs(span)
+	want := map[string]string{
+		"client.address":      "127.0.0.1",
+		"proxys.sni":          "example.com",
+		"proxys.backend":      backend,
+		"proxys.route_type":   "routed",
+		"proxys.bytes_up":     strconv.Itoa(len(hello)),
+		"proxys.bytes_down":   strconv.Itoa(len("answer")),
+		"proxys.close_reason": "eof",
+	}
+	for key, v := range want {
+		if got := attrs[key].Emit(); got != v {
+			t.Errorf("attribute %s = %q, want %q", key, got, v)
+		}
+	}
+	if _, ok := attrs["proxys.duration_ms"]; !ok {
+		t.Error("span has no proxys.duration_ms attribute")
+	}
+	var events []string
+	for _, e := range span.Events() {
+		events = append(events, e.Name)
+	}
+	if want := []string{"dial", "copy_start", "copy_end"}; !slices.Equal(events, want) {
+		t.Errorf("span events = %q, want %q", events, want)
+	}
+	if span.Status().Code == codes.Error {
+		t.Errorf("span of a clean close has status %v", span.Status())
+	}
+
+	// A failed dial ends the span with an error
+	exp.Reset()
+	conn = dialHello(t, addr, helloFor(t, "down.example.com"))
+	if !waitClosed(conn, 2*time.Second) {
+		t.Fatal("connection to an unreachable backend was not closed")
+	}
+	if !waitFor(2*time.Second, func() bool { return len(exp.GetSpans()) == 1 }) {
+		t.Fatalf("got %d spans, want 1 for the failed dial", len(exp.GetSpans()))
+	}
+	span = exp.GetSpans().Snapshots()[0]
+	if span.Status().Code != codes.Error || len(span.Events()) != 1 || span.Events()[0].Name != "dial_failed" {
+		t.Errorf("span of a failed dial has status %v and events %v, want an error and dial_failed", span.Status(), span.Events())
+	}
+}
+
+func TestOpenTracerWritesJSON(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "spans.json")
+	tracer, stop, err := openTracer(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	span := tracer.Start(1, "192.0.2.1")
+	span.SetString("proxys.sni", "example.com")
+	span.End()
+	if err := stop(); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{`"Name":"proxys.connection"`, `"Key":"proxys.sni"`, `"example.com"`} {
+		if !strings.Contains(string(data), want) {
+			t.Errorf("trace file lacks %s:\n%s", want, data)
+		}
+	}
+}
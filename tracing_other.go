@@ -0,0 +1,12 @@
+//go:build !otel
+
+package main
+
+import "fmt"
+
+// otelSupported reports whether this build can write -otel-trace-file
+const otelSupported = false
+
+func openTracer(path string) (connTracer, func() error, error) {
+	return nil, nil, fmt.Errorf("OpenTelemetry tracing is not built in (build with -tags otel)")
+}
@@ -0,0 +1,5 @@
+package main
+
+// getOriginalDst returns the pre-redirect destination of a connection in
+// transparent mode. It is a variable so the socket lookup can be replaced.
+var getOriginalDst = originalDst
@@ -0,0 +1,75 @@
+//go:build linux
+
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+	"syscall"
+)
+
+// transparentSupported reports whether -transparent can be used on this platform
+const transparentSupported = true
+
+// soOriginalDst is the netfilter socket option (SO_ORIGINAL_DST and
+// IP6T_SO_ORIGINAL_DST) exposing the destination before an iptables REDIRECT
+const soOriginalDst = 80
+
+// originalDst reads the original destination of a redirected TCP connection
+func originalDst(conn net.Conn) (string, error) {
+	tc, ok := conn.(*net.TCPConn)
+	if !ok {
+		return "", fmt.Errorf("not a TCP connection")
+	}
+	local, ok := tc.LocalAddr().(*net.TCPAddr)
+	if !ok {
+		return "", fmt.Errorf("unexpected local address %v", tc.LocalAddr())
+	}
+	rc, err := tc.SyscallConn()
+	if err != nil {
+		return "", err
+	}
+
+	var addr string
+	var sockErr error
+	err = rc.Control(func(fd uintptr) {
+		if local.IP.To4() != nil {
+			addr, sockErr = originalDst4(int(fd))
+		} else {
+			addr, sockErr = originalDst6(int(fd))
+		}
+	})
+	if err != nil {
+		return "", err
+	}
+	if sockErr != nil {
+		return "", fmt.Errorf("getsockopt SO_ORIGINAL_DST: %v", sockErr)
+	}
+	return addr, nil
+}
+
+func originalDst4(fd int) (string, error) {
+	// The option fills a struct sockaddr_in, which fits in an IPv6Mreq
+	mreq, err := syscall.GetsockoptIPv6Mreq(fd, syscall.IPPROTO_IP, soOriginalDst)
+	if err != nil {
+		return "", err
+	}
+	ip := net.IP(mreq.Multiaddr[4:8])
+	port := binary.BigEndian.Uint16(mreq.Multiaddr[2:4])
+	return net.JoinHostPort(ip.String(), strconv.Itoa(int(port))), nil
+}
+
+func originalDst6(fd int) (string, error) {
+	// The option fills a struct sockaddr_in6, which fits in an IPv6MTUInfo
+	info, err := syscall.GetsockoptIPv6MTUInfo(fd, syscall.IPPROTO_IPV6, soOriginalDst)
+	if err != nil {
+		return "", err
+	}
+	ip := net.IP(info.Addr.Addr[:])
+	var p [2]byte
+	binary.NativeEndian.PutUint16(p[:], info.Addr.Port)
+	port := binary.BigEndian.Uint16(p[:])
+	return net.JoinHostPort(ip.String(), strconv.Itoa(int(port))), nil
+}
@@ -0,0 +1,15 @@
+//go:build !linux
+
+package main
+
+import (
+	"fmt"
+	"net"
+)
+
+// transparentSupported reports whether -transparent can be used on this platform
+const transparentSupported = false
+
+func originalDst(conn net.Conn) (string, error) {
+	return "", fmt.Errorf("transparent mode is only supported on Linux")
+}
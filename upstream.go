@@ -0,0 +1,83 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ringReplicas is the number of points each backend occupies on the hash
+// ring, which evens out the share of keys each backend receives
+const ringReplicas = 128
+
+// upstreams holds the named backend pools defined with -upstream
+var upstreams = make(map[string]*upstreamPool)
+
+// upstreamPool is a named set of backends selected by consistent hashing.
+// Hashing on SNI keeps each hostname on the same backend, and adding or
+// removing a backend only remaps the keys that backend owns.
+type upstreamPool struct {
+	name     string
+	backends []string
+	ring     []ringPoint // Sorted by hash
+}
+
+type ringPoint struct {
+	hash    uint32
+	backend string
+}
+
+// parseUpstream parses an upstream definition of the form name=target,target,...
+func parseUpstream(spec string) (*upstreamPool, error) {
+	name, list, ok := strings.Cut(spec, "=")
+	name = strings.TrimSpace(name)
+	if !ok || name == "" {
+		return nil, fmt.Errorf("invalid upstream '%s' (use name=target,target,...)", spec)
+	}
+
+	var backends []string
+	for _, t := range strings.Split(list, ",") {
+		target, err := parseTarget(strings.TrimSpace(t))
+		if err != nil {
+			return nil, fmt.Errorf("upstream %s: %v", name, err)
+		}
+		backends = append(backends, target)
+	}
+	return newUpstreamPool(name, backends), nil
+}
+
+// String renders the pool in -upstream syntax
+func (p *upstreamPool) String() string {
+	return p.name + "=" + strings.Join(p.backends, ",")
+}
+
+func newUpstreamPool(name string, backends []string) *upstreamPool {
+	p := &upstreamPool{name: name, backends: backends}
+	for _, b := range backends {
+		for i := 0; i < ringReplicas; i++ {
+			p.ring = append(p.ring, ringPoint{hash: ringHash(b + "#" + strconv.Itoa(i)), backend: b})
+		}
+	}
+	sort.Slice(p.ring, func(i, j int) bool { return p.ring[i].hash < p.ring[j].hash })
+	return p
+}
+
+// Pick returns the backend owning key on the ring
+func (p *upstreamPool) Pick(key string) string {
+	h := ringHash(key)
+	i := sort.Search(len(p.ring), func(i int) bool { return p.ring[i].hash >= h })
+	if i == len(p.ring) {
+		i = 0
+	}
+	return p.ring[i].backend
+}
+
+// ringHash hashes s onto the ring. SHA-256 spreads similar keys such as
+// replica names far more evenly than a checksum would.
+func ringHash(s string) uint32 {
+	sum := sha256.Sum256([]byte(s))
+	return binary.BigEndian.Uint32(sum[:4])
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestUpstreamPoolMinimalDisruption(t *testing.T) {
+	backends := []string{"10.0.0.1:443", "10.0.0.2:443", "10.0.0.3:443"}
+	pool := newUpstreamPool("cache", backends)
+
+	hosts := make([]string, 1000)
+	before := make(map[string]string)
+	for i := range hosts {
+		hosts[i] = fmt.Sprintf("host%d.example.com", i)
+		before[hosts[i]] = pool.Pick(hosts[i])
+	}
+
+	// Routing a new host into the pool leaves every other host where it was
+	pool.Pick("new.example.com")
+	for _, h := range hosts {
+		if got := pool.Pick(h); got != before[h] {
+			t.Fatalf("Pick(%s) = %s after a new host, was %s", h, got, before[h])
+		}
+	}
+
+	// A new backend only takes keys over, never moves them between the
+	// existing backends, and takes about its share
+	grown := newUpstreamPool("cache", append(backends, "10.0.0.4:443"))
+	moved := 0
+	for _, h := range hosts {
+		got := grown.Pick(h)
+		if got == before[h] {
+			continue
+		}
+		if got != "10.0.0.4:443" {
+			t.Errorf("Pick(%s) moved from %s to %s, want it kept or moved to the new backend", h, before[h], got)
+		}
+		moved++
+	}
+	if moved < len(hosts)/8 || moved > len(hosts)*3/8 {
+		t.Errorf("%d of %d hosts moved to the new backend, want about a quarter", moved, len(hosts))
+	}
+}
+
+func TestParseUpstream(t *testing.T) {
+	pool, err := parseUpstream("cache = 10.0.0.1:443, :8443")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := pool.String(), "cache=10.0.0.1:443,localhost:8443"; got != want {
+		t.Errorf("parseUpstream = %s, want %s", got, want)
+	}
+
+	for _, spec := range []string{"10.0.0.1:443", "=10.0.0.1:443", "cache=10.0.0.1"} {
+		if _, err := parseUpstream(spec); err == nil {
+			t.Errorf("parseUpstream(%q) succeeded, want an error", spec)
+		}
+	}
+}